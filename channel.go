@@ -18,6 +18,7 @@ package eps
 
 import (
 	"fmt"
+	"github.com/kiprotect/go-helpers/forms"
 )
 
 type ChannelDefinition struct {
@@ -25,6 +26,8 @@ type ChannelDefinition struct {
 	Description       string            `json:"description"`
 	Maker             ChannelMaker      `json:"-"`
 	SettingsValidator SettingsValidator `json:"-"`
+	// optional form for the settings of the channel in directory entries
+	EntrySettingsForm *forms.Form `json:"-"`
 }
 
 type ChannelDefinitions map[string]ChannelDefinition
@@ -43,6 +46,13 @@ type Channel interface {
 	Open() error
 }
 
+// A channel that can report problems (e.g. a server that stopped), which
+// are taken into account by health checks
+type CheckableChannel interface {
+	Channel
+	Check() error
+}
+
 type ProxyChannel interface {
 	HandleConnectionRequest(address *Address, request *Request) (*Response, error)
 }
@@ -50,5 +50,6 @@ var Channels = eps.ChannelDefinitions{
 		Description:       "Accepts incoming gRPC connections to deliver and receive messages",
 		Maker:             MakeGRPCServerChannel,
 		SettingsValidator: GRPCServerSettingsValidator,
+		EntrySettingsForm: &GRPCServerEntrySettingsForm,
 	},
 }
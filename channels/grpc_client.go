@@ -33,6 +33,7 @@ type GRPCClientChannel struct {
 	eps.BaseChannel
 	Settings    grpc.GRPCClientSettings
 	connections map[string]*GRPCServerConnection
+	watcher     chan []*eps.DirectoryEntryChange
 	stop        chan bool
 	mutex       sync.Mutex
 }
@@ -201,6 +202,11 @@ func MakeGRPCClientChannel(settings interface{}) (eps.Channel, error) {
 }
 
 func (c *GRPCClientChannel) Open() error {
+	if watchableDirectory, ok := c.Directory().(eps.WatchableDirectory); ok {
+		// we get notified about directory changes immediately
+		c.watcher = make(chan []*eps.DirectoryEntryChange, 10)
+		watchableDirectory.Watch(c.watcher)
+	}
 	// we start the background task
 	go c.backgroundTask()
 	if err := c.openConnections(); err != nil {
@@ -210,11 +216,71 @@ func (c *GRPCClientChannel) Open() error {
 }
 
 func (c *GRPCClientChannel) Close() error {
+	if c.watcher != nil {
+		c.Directory().(eps.WatchableDirectory).Unwatch(c.watcher)
+	}
 	c.stop <- true
 	<-c.stop
 	return c.closeConnections()
 }
 
+// Reports an error if we are not connected to one of the servers we keep
+// connections to (e.g. because the server call failed)
+func (c *GRPCClientChannel) Check() error {
+	c.mutex.Lock()
+	connections := make([]*GRPCServerConnection, 0, len(c.connections))
+	for _, connection := range c.connections {
+		connections = append(connections, connection)
+	}
+	c.mutex.Unlock()
+	for _, connection := range connections {
+		connection.mutex.Lock()
+		connected := connection.connected || connection.connecting
+		connection.mutex.Unlock()
+		if !connected {
+			return fmt.Errorf("not connected to server '%s'", connection.Name)
+		}
+	}
+	return nil
+}
+
+// Closes and removes the connection with the given name
+func (c *GRPCClientChannel) removeConnection(name string) {
+	c.mutex.Lock()
+	connection, ok := c.connections[name]
+	delete(c.connections, name)
+	c.mutex.Unlock()
+	if ok {
+		if err := connection.Close(); err != nil {
+			eps.Log.Error(err)
+		}
+	}
+}
+
+// Reacts to changes in the directory: Connections to changed entries are
+// reestablished (so that certificates get checked again) and new peers are
+// connected. If our own entry changed we reestablish all connections.
+func (c *GRPCClientChannel) handleChanges(changes []*eps.DirectoryEntryChange) {
+	for _, change := range changes {
+		if change.Name == c.Directory().Name() {
+			c.mutex.Lock()
+			names := make([]string, 0, len(c.connections))
+			for name := range c.connections {
+				names = append(names, name)
+			}
+			c.mutex.Unlock()
+			for _, name := range names {
+				c.removeConnection(name)
+			}
+			break
+		}
+		c.removeConnection(change.Name)
+	}
+	if err := c.openConnections(); err != nil {
+		eps.Log.Error(err)
+	}
+}
+
 func (c *GRPCClientChannel) markConnectionsStale() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -283,6 +349,8 @@ func (c *GRPCClientChannel) backgroundTask() {
 			eps.Log.Debug("Stopping gRPC client background task")
 			c.stop <- true
 			return
+		case changes := <-c.watcher:
+			c.handleChanges(changes)
 		case <-time.After(60 * time.Second):
 			if err := c.openConnections(); err != nil {
 				eps.Log.Error(err)
@@ -471,7 +539,7 @@ func (c *GRPCClientChannel) DeliverRequest(request *eps.Request) (*eps.Response,
 				return nil, err
 			} else {
 
-				proxyConnection, err := net.Dial("tcp", requestConnectionResponse.Endpoint)
+				proxyConnection, err := grpc.DialContext(context, &c.Settings, requestConnectionResponse.Endpoint)
 
 				if err != nil {
 					return nil, err
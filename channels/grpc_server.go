@@ -17,6 +17,7 @@
 package channels
 
 import (
+	"context"
 	"fmt"
 	"github.com/iris-connect/eps"
 	"github.com/iris-connect/eps/grpc"
@@ -26,10 +27,15 @@ import (
 	"time"
 )
 
+// how long we wait for a connection to a public proxy
+const proxyDialTimeout = 30 * time.Second
+
 type GRPCServerChannel struct {
 	eps.BaseChannel
 	server        *grpc.Server
 	proxyListener *ProxyListener
+	watcher       chan []*eps.DirectoryEntryChange
+	stop          chan bool
 	Settings      grpc.GRPCServerSettings
 }
 
@@ -59,7 +65,11 @@ func (c *GRPCServerChannel) HandleConnectionRequest(address *eps.Address, reques
 		return nil, nil
 	} else {
 
-		proxyConnection, err := net.Dial("tcp", connectionRequest.Endpoint)
+		ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+		defer cancel()
+
+		// the public proxy might only be reachable via an outbound proxy
+		proxyConnection, err := grpc.DialViaProxy(ctx, c.Settings.ProxyURL, c.Settings.NoProxy, connectionRequest.Endpoint)
 
 		if err != nil {
 			return nil, err
@@ -82,6 +92,22 @@ func (c *GRPCServerChannel) HandleConnectionRequest(address *eps.Address, reques
 	return &eps.Response{}, nil
 }
 
+// Checks the other channels of the message broker, so that the health status
+// of the server reflects whether we can deliver requests
+func (c *GRPCServerChannel) checkChannels() error {
+	if c.MessageBroker() == nil {
+		return nil
+	}
+	for _, channel := range c.MessageBroker().Channels() {
+		if checkableChannel, ok := channel.(eps.CheckableChannel); ok {
+			if err := checkableChannel.Check(); err != nil {
+				return fmt.Errorf("%s channel: %w", channel.Type(), err)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *GRPCServerChannel) HandleRequest(request *eps.Request, clientInfo *eps.ClientInfo) (*eps.Response, error) {
 	return c.MessageBroker().DeliverRequest(request, clientInfo)
 }
@@ -159,10 +185,48 @@ func (c *GRPCServerChannel) Open() error {
 	if c.server, err = grpc.MakeServer(&c.Settings, c, c.proxyListener, c.Directory()); err != nil {
 		return err
 	}
+
+	c.server.SetHealthCheck(c.checkChannels)
+
+	if watchableDirectory, ok := c.Directory().(eps.WatchableDirectory); ok {
+		c.watcher = make(chan []*eps.DirectoryEntryChange, 10)
+		c.stop = make(chan bool)
+		watchableDirectory.Watch(c.watcher)
+		go c.watchDirectory()
+	}
+
 	return c.server.Start()
 }
 
+// Disconnects clients whose directory entries changed, so that their
+// certificates get checked again when they reconnect
+func (c *GRPCServerChannel) watchDirectory() {
+	for {
+		select {
+		case <-c.stop:
+			c.stop <- true
+			return
+		case changes := <-c.watcher:
+			for _, change := range changes {
+				if change.Name == c.Directory().Name() {
+					continue
+				}
+				c.server.DisconnectClient(change.Name)
+			}
+		}
+	}
+}
+
 func (c *GRPCServerChannel) Close() error {
+	if c.watcher != nil {
+		c.Directory().(eps.WatchableDirectory).Unwatch(c.watcher)
+		c.stop <- true
+		<-c.stop
+		c.watcher = nil
+	}
+	if c.server != nil {
+		return c.server.Stop()
+	}
 	return nil
 }
 
@@ -17,9 +17,11 @@
 package channels
 
 import (
+	"crypto/x509"
 	"fmt"
 	"github.com/iris-connect/eps"
 	"github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/helpers"
 	"github.com/iris-connect/eps/jsonrpc"
 )
 
@@ -52,10 +54,19 @@ func MakeJSONRPCServerChannel(settings interface{}) (eps.Channel, error) {
 		return nil, fmt.Errorf("error creating JSON-RPC server: %w", err)
 	} else {
 		s.Server = server
+		// we reject client certificates that were revoked in the directory
+		server.SetCertificateCheck(s.checkCertificate)
 		return s, nil
 	}
 }
 
+func (c *JSONRPCServerChannel) checkCertificate(cert *x509.Certificate) error {
+	if c.Directory() == nil {
+		return nil
+	}
+	return helpers.CheckRevocation(cert, c.Directory().EntryFor)
+}
+
 func (c *JSONRPCServerChannel) handler(context *jsonrpc.Context) *jsonrpc.Response {
 
 	request := &eps.Request{}
@@ -112,6 +123,14 @@ func (c *JSONRPCServerChannel) Open() error {
 	return c.Server.Start()
 }
 
+// Reports an error if the server stopped unexpectedly
+func (c *JSONRPCServerChannel) Check() error {
+	if err := c.Server.HTTPServer().Err(); err != nil {
+		return fmt.Errorf("JSON-RPC server stopped: %w", err)
+	}
+	return nil
+}
+
 func (c *JSONRPCServerChannel) Close() error {
 	return c.Server.Stop()
 }
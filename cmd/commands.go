@@ -30,4 +30,8 @@ var Commands = eps.CommandsDefinitions{
 		Name:  "records",
 		Maker: helpers.RecordsCommands,
 	},
+	eps.CommandsDefinition{
+		Name:  "certs",
+		Maker: helpers.CertsCommands,
+	},
 }
@@ -0,0 +1,212 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/urfave/cli"
+	"time"
+)
+
+// Logs a warning for all certificates that expire within the given period
+func warnAboutExpiringCertificates(entry *eps.DirectoryEntry, within time.Duration) {
+	now := time.Now()
+	for _, certificate := range entry.Certificates {
+		if certificate.NotAfter == nil {
+			continue
+		}
+		if certificate.NotAfter.Before(now) {
+			eps.Log.Warningf("Certificate '%s' (%s) of '%s' expired at %v", certificate.Fingerprint, certificate.KeyUsage, entry.Name, *certificate.NotAfter)
+		} else if certificate.NotAfter.Before(now.Add(within)) {
+			eps.Log.Warningf("Certificate '%s' (%s) of '%s' expires soon (at %v)", certificate.Fingerprint, certificate.KeyUsage, entry.Name, *certificate.NotAfter)
+		}
+	}
+}
+
+func getOperatorEntry(c *cli.Context, settings *eps.Settings) *eps.DirectoryEntry {
+
+	directory, err := helpers.InitializeDirectory(settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	name := c.String("name")
+
+	if name == "" {
+		name = settings.Name
+	}
+
+	entry, err := directory.EntryFor(name)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return entry
+}
+
+func checkCerts(c *cli.Context, settings *eps.Settings) error {
+	entry := getOperatorEntry(c, settings)
+	warnAboutExpiringCertificates(entry, time.Duration(c.Int("warn-days"))*24*time.Hour)
+	return nil
+}
+
+// Generates a change record that replaces the current certificates of an
+// operator with new ones. The old certificates stay valid for the overlap
+// period so that peers can pick up the change.
+func rotateCerts(c *cli.Context, settings *eps.Settings) error {
+
+	newCertificateFiles := map[string]string{
+		"encryption": c.String("encryption-cert"),
+		"signing":    c.String("signing-cert"),
+	}
+
+	if newCertificateFiles["encryption"] == "" && newCertificateFiles["signing"] == "" {
+		eps.Log.Fatal("please specify a new encryption and/or signing certificate")
+	}
+
+	entry := getOperatorEntry(c, settings)
+
+	warnAboutExpiringCertificates(entry, time.Duration(c.Int("warn-days"))*24*time.Hour)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	overlapUntil := now.Add(time.Duration(c.Int("overlap-days")) * 24 * time.Hour)
+
+	certificates := make([]*eps.OperatorCertificate, 0)
+
+	for _, certificate := range entry.Certificates {
+		// we drop certificates that are no longer valid anyway
+		if certificate.NotAfter != nil && certificate.NotAfter.Before(now) {
+			continue
+		}
+		if newCertificateFiles[certificate.KeyUsage] != "" {
+			// the old certificate is only valid during the overlap period
+			if certificate.NotAfter == nil || certificate.NotAfter.After(overlapUntil) {
+				notAfter := overlapUntil
+				certificate.NotAfter = &notAfter
+			}
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	for _, keyUsage := range []string{"encryption", "signing"} {
+
+		certificateFile := newCertificateFiles[keyUsage]
+
+		if certificateFile == "" {
+			continue
+		}
+
+		cert, err := helpers.LoadCertificate(certificateFile, keyUsage == "signing")
+
+		if err != nil {
+			eps.Log.Fatal(err)
+		}
+
+		if cert.NotAfter.Before(overlapUntil) {
+			eps.Log.Warningf("New %s certificate expires at %v, before the end of the overlap period", keyUsage, cert.NotAfter)
+		}
+
+		notBefore := cert.NotBefore.UTC()
+		notAfter := cert.NotAfter.UTC()
+
+		certificates = append(certificates, &eps.OperatorCertificate{
+			Fingerprint: helpers.CertificateFingerprint(cert),
+			KeyUsage:    keyUsage,
+			NotBefore:   &notBefore,
+			NotAfter:    &notAfter,
+		})
+	}
+
+	// the records can be signed and submitted with 'sd submit-records'
+	records := map[string]interface{}{
+		"records": []*eps.ChangeRecord{
+			{
+				Name:      entry.Name,
+				Section:   "certificates",
+				Data:      certificates,
+				CreatedAt: eps.HashableTime{Time: now},
+			},
+		},
+	}
+
+	jsonData, err := json.MarshalIndent(records, "", "  ")
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	fmt.Println(string(jsonData))
+
+	return nil
+}
+
+func CertsCommands(settings *eps.Settings) ([]cli.Command, error) {
+
+	nameFlag := cli.StringFlag{
+		Name:  "name",
+		Usage: "the name of the operator (defaults to our own name)",
+	}
+
+	warnDaysFlag := cli.IntFlag{
+		Name:  "warn-days",
+		Value: 30,
+		Usage: "warn about certificates that expire within this number of days",
+	}
+
+	return []cli.Command{
+		{
+			Name:  "certs",
+			Flags: []cli.Flag{},
+			Usage: "Manage operator certificates.",
+			Subcommands: []cli.Command{
+				{
+					Name:   "check",
+					Flags:  []cli.Flag{nameFlag, warnDaysFlag},
+					Usage:  "Warn about certificates in the service directory that expire soon",
+					Action: func(c *cli.Context) error { return checkCerts(c, settings) },
+				},
+				{
+					Name: "rotate",
+					Flags: []cli.Flag{
+						nameFlag,
+						warnDaysFlag,
+						cli.StringFlag{
+							Name:  "encryption-cert",
+							Usage: "the new certificate for encryption (TLS)",
+						},
+						cli.StringFlag{
+							Name:  "signing-cert",
+							Usage: "the new certificate for signing",
+						},
+						cli.IntFlag{
+							Name:  "overlap-days",
+							Value: 7,
+							Usage: "the number of days in which old and new certificates are both accepted",
+						},
+					},
+					Usage:  "Generate change records that rotate certificates and print them as JSON",
+					Action: func(c *cli.Context) error { return rotateCerts(c, settings) },
+				},
+			},
+		},
+	}, nil
+}
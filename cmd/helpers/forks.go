@@ -0,0 +1,303 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+The service directory does not adopt chains with a different root on its own.
+Admins inspect the known chains with 'sd forks list' and pin the record that
+should be canonical. Like proposals, pins can be passed around as JSON files
+if the directory requires several admins to sign them.
+*/
+
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/urfave/cli"
+	"io/ioutil"
+)
+
+func forkableDirectory(settings *eps.Settings) eps.ForkableDirectory {
+
+	directory, err := helpers.InitializeDirectory(settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	forkableDirectory, ok := directory.(eps.ForkableDirectory)
+
+	if !ok {
+		eps.Log.Fatalf("the service directory does not support forks")
+	}
+
+	return forkableDirectory
+}
+
+func loadPin(filename string) (*eps.SignedPin, error) {
+
+	jsonBytes, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rawPin map[string]interface{}
+
+	if err := json.Unmarshal(jsonBytes, &rawPin); err != nil {
+		return nil, err
+	}
+
+	signedPin := &eps.SignedPin{}
+
+	if params, err := epsForms.SignedPinForm.Validate(rawPin); err != nil {
+		return nil, err
+	} else if err := epsForms.SignedPinForm.Coerce(signedPin, params); err != nil {
+		return nil, err
+	}
+
+	return signedPin, nil
+}
+
+func printJSON(value interface{}) error {
+
+	jsonBytes, err := json.MarshalIndent(value, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(jsonBytes))
+
+	return nil
+}
+
+// Prints all chains known to the service directory
+func listForks(c *cli.Context, settings *eps.Settings) error {
+
+	forks, err := forkableDirectory(settings).Forks()
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if err := printJSON(forks); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return nil
+}
+
+func adminSigner(settings *eps.Settings) *signer {
+
+	if settings.Signing == nil {
+		eps.Log.Fatalf("Signing settings undefined!")
+	}
+
+	signer, err := loadSigner(settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if !helpers.IsAdmin(signer.subjectInfo) {
+		eps.Log.Fatalf("only service directory admins can sign pins")
+	}
+
+	return signer
+}
+
+// Returns the signer for pins, which is either the admin from the settings or
+// a separate pin key (see the 'pin_certificate_files' setting)
+func pinSigner(c *cli.Context, settings *eps.Settings) *signer {
+
+	if c.String("pin-key") == "" {
+		return adminSigner(settings)
+	}
+
+	key, err := helpers.LoadPrivateKey(c.String("pin-key"))
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	certificate, err := helpers.LoadCertificate(c.String("pin-cert"), true)
+
+	if err != nil {
+		eps.Log.Fatalf("cannot load pin certificate: %v", err)
+	}
+
+	subjectInfo, err := helpers.GetSubjectInfo(certificate)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return &signer{
+		key:         key,
+		certificate: certificate,
+		subjectInfo: subjectInfo,
+	}
+}
+
+// Signs a pin for the given record hash and either prints it (so that other
+// admins can co-sign it) or submits it right away
+func pinRecord(c *cli.Context, settings *eps.Settings) error {
+
+	hash := c.Args().Get(0)
+
+	if hash == "" {
+		eps.Log.Fatal("please specify the hash of the record to pin")
+	}
+
+	signer := pinSigner(c, settings)
+
+	signedPin, err := helpers.SignPin(helpers.MakePin(hash), signer.key, signer.certificate)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if !c.Bool("submit") {
+		if err := printJSON(signedPin); err != nil {
+			eps.Log.Fatal(err)
+		}
+		return nil
+	}
+
+	if err := forkableDirectory(settings).Pin(signedPin); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	eps.Log.Infof("Pinned record %s.", hash)
+
+	return nil
+}
+
+// Adds the signature of the current admin to a pin and prints it
+func cosignPin(c *cli.Context, settings *eps.Settings) error {
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		eps.Log.Fatal("please specify a filename")
+	}
+
+	signedPin, err := loadPin(filename)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	signer := pinSigner(c, settings)
+
+	for _, signature := range append([]*eps.Signature{signedPin.Signature}, signedPin.Signatures...) {
+		if cert, err := helpers.LoadCertificateFromString(signature.Certificate, true); err != nil {
+			eps.Log.Fatal(err)
+		} else if subjectInfo, err := helpers.GetSubjectInfo(cert); err != nil {
+			eps.Log.Fatal(err)
+		} else if subjectInfo.Name == signer.subjectInfo.Name {
+			eps.Log.Fatalf("'%s' has already signed the pin", subjectInfo.Name)
+		}
+	}
+
+	if err := helpers.CosignPin(signedPin, signer.key, signer.certificate); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if err := printJSON(signedPin); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return nil
+}
+
+// Submits a (co-signed) pin from the given file
+func submitPin(c *cli.Context, settings *eps.Settings) error {
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		eps.Log.Fatal("please specify a filename")
+	}
+
+	signedPin, err := loadPin(filename)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if err := forkableDirectory(settings).Pin(signedPin); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	eps.Log.Infof("Pinned record %s.", signedPin.Pin.Hash)
+
+	return nil
+}
+
+func forksCommand(settings *eps.Settings) cli.Command {
+
+	pinKeyFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "pin-key",
+			Usage: "sign with a separate pin key instead of the admin key from the settings",
+		},
+		cli.StringFlag{
+			Name:  "pin-cert",
+			Usage: "the certificate of the pin key",
+		},
+	}
+
+	return cli.Command{
+		Name:  "forks",
+		Usage: "Inspect competing record chains and pin the canonical one.",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Flags:  []cli.Flag{},
+				Usage:  "Print all verified chains and show which one is canonical",
+				Action: func(c *cli.Context) error { return listForks(c, settings) },
+			},
+			{
+				Name: "pin",
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "submit",
+						Usage: "submit the pin right away instead of printing it",
+					},
+				}, pinKeyFlags...),
+				Usage:  "Sign a pin for the record with the given hash, making its chain canonical",
+				Action: func(c *cli.Context) error { return pinRecord(c, settings) },
+			},
+			{
+				Name:   "cosign",
+				Flags:  pinKeyFlags,
+				Usage:  "Add your signature to a pin and print the updated pin",
+				Action: func(c *cli.Context) error { return cosignPin(c, settings) },
+			},
+			{
+				Name:   "submit",
+				Flags:  []cli.Flag{},
+				Usage:  "Submit a (co-signed) pin",
+				Action: func(c *cli.Context) error { return submitPin(c, settings) },
+			},
+		},
+	}
+}
@@ -0,0 +1,751 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/kiprotect/go-helpers/forms"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The sections that can be managed via a desired-state file. Only sections
+// that are given for an entry are managed, so e.g. the preferences of an
+// operator can be left to the operator.
+var ManagedSections = []string{"groups", "labels", "channels", "services", "settings", "preferences", "certificates", "revocations"}
+
+var DesiredStateForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "entries",
+			Validators: []forms.Validator{
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{},
+					},
+				},
+			},
+		},
+	},
+}
+
+type DesiredState struct {
+	Entries []map[string]interface{} `json:"entries"`
+}
+
+// A change of a single section of an entry (or of the entire entry)
+type SectionChange struct {
+	Name    string
+	Section string
+	Old     interface{}
+	New     interface{}
+	Record  *eps.ChangeRecord
+	// pending scheduled records of the section, which the change replaces
+	Scheduled []*eps.ChangeRecord
+}
+
+func loadDesiredState(filename string) (*DesiredState, error) {
+
+	jsonBytes, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rawState map[string]interface{}
+
+	if err := json.Unmarshal(jsonBytes, &rawState); err != nil {
+		return nil, err
+	}
+
+	state := &DesiredState{}
+
+	if params, err := DesiredStateForm.Validate(rawState); err != nil {
+		return nil, err
+	} else if err := DesiredStateForm.Coerce(state, params); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Converts a value to its generic JSON form, so that we can compare values
+// from entries and desired-state files
+func genericValue(value interface{}) (interface{}, error) {
+	var genericValue interface{}
+	if jsonBytes, err := json.Marshal(value); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonBytes, &genericValue); err != nil {
+		return nil, err
+	}
+	return genericValue, nil
+}
+
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func isManagedSection(section string) bool {
+	for _, managedSection := range ManagedSections {
+		if managedSection == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the desired data of a section like the data of a change record
+func desiredRecord(name, section string, data interface{}) (*eps.ChangeRecord, error) {
+
+	rawRecord := map[string]interface{}{
+		"name":    name,
+		"section": section,
+		"data":    data,
+		// only required for validation, we set it again when signing
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	record := &eps.ChangeRecord{}
+
+	if params, err := epsForms.ChangeRecordForm.Validate(rawRecord); err != nil {
+		return nil, fmt.Errorf("invalid section '%s' of entry '%s': %w", section, name, err)
+	} else if err := epsForms.ChangeRecordForm.Coerce(record, params); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Checks whether all given revocations are already on record, as existing
+// revocations cannot be removed
+func hasRevocations(existing, desired interface{}) bool {
+	fingerprints := map[interface{}]bool{}
+	if existingList, ok := existing.([]interface{}); ok {
+		for _, revocation := range existingList {
+			if revocationMap, ok := revocation.(map[string]interface{}); ok {
+				fingerprints[revocationMap["fingerprint"]] = true
+			}
+		}
+	}
+	if desiredList, ok := desired.([]interface{}); ok {
+		for _, revocation := range desiredList {
+			if revocationMap, ok := revocation.(map[string]interface{}); !ok || !fingerprints[revocationMap["fingerprint"]] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the scheduled records of the given entries whose validity window did
+// not end yet, by entry name and section
+func pendingScheduledRecords(entries []*eps.DirectoryEntry, t time.Time) map[string]map[string][]*eps.ChangeRecord {
+	pending := map[string]map[string][]*eps.ChangeRecord{}
+	for _, entry := range entries {
+		for _, record := range entry.Scheduled {
+			if record.Record.ValidUntil != nil && !t.Before(record.Record.ValidUntil.Time) {
+				continue
+			}
+			if pending[entry.Name] == nil {
+				pending[entry.Name] = map[string][]*eps.ChangeRecord{}
+			}
+			pending[entry.Name][record.Record.Section] = append(pending[entry.Name][record.Record.Section], record.Record)
+		}
+	}
+	return pending
+}
+
+// Computes the changes that are necessary to get from the given entries to
+// the desired state, with (at most) one change record per section. If prune
+// is set, entries that are not part of the desired state will be deleted.
+// The entries need to be unscheduled (see 'eps.SchedulingDirectory'), as a
+// change of a section replaces its scheduled records, which are therefore
+// returned with the change.
+func PlanChanges(entries []*eps.DirectoryEntry, state *DesiredState, prune bool) ([]*SectionChange, error) {
+
+	pending := pendingScheduledRecords(entries, time.Now())
+
+	currentEntries := map[string]map[string]interface{}{}
+
+	for _, entry := range entries {
+		if value, err := genericValue(entry); err != nil {
+			return nil, err
+		} else {
+			currentEntries[entry.Name] = value.(map[string]interface{})
+		}
+	}
+
+	changes := make([]*SectionChange, 0)
+	desiredNames := map[string]bool{}
+
+	for _, desiredEntry := range state.Entries {
+
+		name, ok := desiredEntry["name"].(string)
+
+		if !ok || name == "" {
+			return nil, fmt.Errorf("entry without a name found")
+		}
+
+		if desiredNames[name] {
+			return nil, fmt.Errorf("duplicate entry '%s'", name)
+		}
+
+		desiredNames[name] = true
+
+		for section := range desiredEntry {
+			if section != "name" && !isManagedSection(section) {
+				return nil, fmt.Errorf("section '%s' of entry '%s' cannot be managed", section, name)
+			}
+		}
+
+		currentEntry := currentEntries[name]
+
+		for _, section := range ManagedSections {
+
+			data, ok := desiredEntry[section]
+
+			if !ok {
+				continue
+			}
+
+			record, err := desiredRecord(name, section, data)
+
+			if err != nil {
+				return nil, err
+			}
+
+			newValue, err := genericValue(record.Data)
+
+			if err != nil {
+				return nil, err
+			}
+
+			var oldValue interface{}
+
+			if currentEntry != nil {
+				oldValue = currentEntry[section]
+			}
+
+			if isEmpty(oldValue) && isEmpty(newValue) || reflect.DeepEqual(oldValue, newValue) {
+				continue
+			}
+
+			if section == "revocations" {
+				if hasRevocations(oldValue, newValue) {
+					continue
+				}
+			} else if isEmpty(newValue) {
+				// we clear the section
+				record = &eps.ChangeRecord{
+					Name:    name,
+					Section: section,
+					Op:      eps.DeleteOp,
+				}
+			}
+
+			changes = append(changes, &SectionChange{
+				Name:      name,
+				Section:   section,
+				Old:       oldValue,
+				New:       newValue,
+				Record:    record,
+				Scheduled: pending[name][section],
+			})
+		}
+	}
+
+	if prune {
+		for _, entry := range entries {
+			if desiredNames[entry.Name] {
+				continue
+			}
+			var scheduled []*eps.ChangeRecord
+			for _, records := range pending[entry.Name] {
+				scheduled = append(scheduled, records...)
+			}
+			changes = append(changes, &SectionChange{
+				Name:    entry.Name,
+				Section: "entry",
+				Old:     currentEntries[entry.Name],
+				Record: &eps.ChangeRecord{
+					Name:    entry.Name,
+					Section: "entry",
+					Op:      eps.DeleteOp,
+				},
+				Scheduled: scheduled,
+			})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+	return changes, nil
+}
+
+// Returns the key that identifies an item of a list section
+func itemKey(section string, item interface{}) string {
+
+	itemMap, ok := item.(map[string]interface{})
+
+	if !ok {
+		return fmt.Sprintf("%v", item)
+	}
+
+	switch section {
+	case "channels":
+		return fmt.Sprintf("%v", itemMap["type"])
+	case "services":
+		return fmt.Sprintf("%v", itemMap["name"])
+	case "certificates", "revocations":
+		return fmt.Sprintf("%v", itemMap["fingerprint"])
+	case "settings", "preferences":
+		scope := make([]string, 0)
+		for _, key := range []string{"operator", "service", "environment"} {
+			if value, ok := itemMap[key].(string); ok && value != "" {
+				scope = append(scope, fmt.Sprintf("%s=%s", key, value))
+			}
+		}
+		if len(scope) == 0 {
+			return "(default)"
+		}
+		return strings.Join(scope, ", ")
+	}
+
+	return fmt.Sprintf("%v", item)
+}
+
+func asList(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok {
+		return list
+	}
+	return nil
+}
+
+func asMap(value interface{}) map[string]interface{} {
+	if m, ok := value.(map[string]interface{}); ok {
+		return m
+	}
+	return nil
+}
+
+func describePermission(permission interface{}) string {
+	permissionMap := asMap(permission)
+	rights := make([]string, 0)
+	for _, right := range asList(permissionMap["rights"]) {
+		rights = append(rights, fmt.Sprintf("%v", right))
+	}
+	return fmt.Sprintf("group '%v' may %s", permissionMap["group"], strings.Join(rights, ", "))
+}
+
+func diffPermissions(indent string, oldPermissions, newPermissions interface{}) []string {
+
+	lines := make([]string, 0)
+	oldDescriptions := map[string]bool{}
+	newDescriptions := map[string]bool{}
+
+	for _, permission := range asList(oldPermissions) {
+		oldDescriptions[describePermission(permission)] = true
+	}
+
+	for _, permission := range asList(newPermissions) {
+		newDescriptions[describePermission(permission)] = true
+	}
+
+	for _, permission := range asList(oldPermissions) {
+		if description := describePermission(permission); !newDescriptions[description] {
+			lines = append(lines, fmt.Sprintf("%s- permission: %s", indent, description))
+		}
+	}
+
+	for _, permission := range asList(newPermissions) {
+		if description := describePermission(permission); !oldDescriptions[description] {
+			lines = append(lines, fmt.Sprintf("%s+ permission: %s", indent, description))
+		}
+	}
+
+	return lines
+}
+
+// Describes the permission changes of a service and its methods
+func diffService(indent string, oldService, newService interface{}) []string {
+
+	oldMap, newMap := asMap(oldService), asMap(newService)
+	lines := diffPermissions(indent, oldMap["permissions"], newMap["permissions"])
+
+	oldMethods := map[string]interface{}{}
+
+	for _, method := range asList(oldMap["methods"]) {
+		oldMethods[fmt.Sprintf("%v", asMap(method)["name"])] = method
+	}
+
+	newMethods := map[string]bool{}
+
+	for _, method := range asList(newMap["methods"]) {
+		name := fmt.Sprintf("%v", asMap(method)["name"])
+		newMethods[name] = true
+		if oldMethod, ok := oldMethods[name]; !ok {
+			lines = append(lines, fmt.Sprintf("%s+ method '%s'", indent, name))
+			lines = append(lines, diffPermissions(indent+"    ", nil, asMap(method)["permissions"])...)
+		} else if !reflect.DeepEqual(oldMethod, method) {
+			lines = append(lines, fmt.Sprintf("%s~ method '%s'", indent, name))
+			lines = append(lines, diffPermissions(indent+"    ", asMap(oldMethod)["permissions"], asMap(method)["permissions"])...)
+		}
+	}
+
+	for _, method := range asList(oldMap["methods"]) {
+		if name := fmt.Sprintf("%v", asMap(method)["name"]); !newMethods[name] {
+			lines = append(lines, fmt.Sprintf("%s- method '%s'", indent, name))
+		}
+	}
+
+	return lines
+}
+
+// Describes the changes of a section item by item
+func diffSection(indent, section string, oldValue, newValue interface{}) []string {
+
+	lines := make([]string, 0)
+
+	if section == "labels" {
+		oldLabels, newLabels := asMap(oldValue), asMap(newValue)
+		keys := make([]string, 0)
+		for key := range oldLabels {
+			keys = append(keys, key)
+		}
+		for key := range newLabels {
+			if _, ok := oldLabels[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			oldLabel, inOld := oldLabels[key]
+			newLabel, inNew := newLabels[key]
+			if !inNew {
+				lines = append(lines, fmt.Sprintf("%s- %s=%v", indent, key, oldLabel))
+			} else if !inOld {
+				lines = append(lines, fmt.Sprintf("%s+ %s=%v", indent, key, newLabel))
+			} else if oldLabel != newLabel {
+				lines = append(lines, fmt.Sprintf("%s~ %s: %v -> %v", indent, key, oldLabel, newLabel))
+			}
+		}
+		return lines
+	}
+
+	oldItems := map[string]interface{}{}
+
+	for _, item := range asList(oldValue) {
+		oldItems[itemKey(section, item)] = item
+	}
+
+	newKeys := map[string]bool{}
+
+	for _, item := range asList(newValue) {
+		newKeys[itemKey(section, item)] = true
+	}
+
+	for _, item := range asList(oldValue) {
+		// existing revocations are always kept
+		if key := itemKey(section, item); !newKeys[key] && section != "revocations" {
+			lines = append(lines, fmt.Sprintf("%s- %s", indent, key))
+		}
+	}
+
+	for _, item := range asList(newValue) {
+		key := itemKey(section, item)
+		if oldItem, ok := oldItems[key]; !ok {
+			lines = append(lines, fmt.Sprintf("%s+ %s", indent, key))
+			if section == "services" {
+				lines = append(lines, diffService(indent+"    ", nil, item)...)
+			}
+		} else if !reflect.DeepEqual(oldItem, item) {
+			lines = append(lines, fmt.Sprintf("%s~ %s", indent, key))
+			if section == "services" {
+				lines = append(lines, diffService(indent+"    ", oldItem, item)...)
+			}
+		}
+	}
+
+	return lines
+}
+
+// Describes the validity window of a scheduled record
+func describeValidity(record *eps.ChangeRecord) string {
+	parts := make([]string, 0, 2)
+	if record.ValidFrom != nil {
+		parts = append(parts, fmt.Sprintf("from %s", record.ValidFrom.Format(time.RFC3339)))
+	}
+	if record.ValidUntil != nil {
+		parts = append(parts, fmt.Sprintf("until %s", record.ValidUntil.Format(time.RFC3339)))
+	}
+	return "valid " + strings.Join(parts, " ")
+}
+
+func describeScheduled(indent string, records []*eps.ChangeRecord) []string {
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		lines = append(lines, fmt.Sprintf("%s! scheduled change of section '%s' (%s) will be dropped", indent, record.Section, describeValidity(record)))
+	}
+	return lines
+}
+
+// Returns a human-readable description of the given changes
+func DescribeChanges(changes []*SectionChange) string {
+
+	lines := make([]string, 0)
+	lastName := ""
+
+	for _, change := range changes {
+
+		if change.Section == "entry" {
+			lines = append(lines, fmt.Sprintf("- %s (entry will be deleted)", change.Name))
+			lines = append(lines, describeScheduled("    ", change.Scheduled)...)
+			lastName = change.Name
+			continue
+		}
+
+		if change.Name != lastName {
+			lines = append(lines, fmt.Sprintf("~ %s", change.Name))
+			lastName = change.Name
+		}
+
+		if change.Record.IsDelete() {
+			lines = append(lines, fmt.Sprintf("    - %s (section will be cleared)", change.Section))
+		} else {
+			lines = append(lines, fmt.Sprintf("    ~ %s", change.Section))
+		}
+
+		lines = append(lines, describeScheduled("        ", change.Scheduled)...)
+		lines = append(lines, diffSection("        ", change.Section, change.Old, change.New)...)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Describes the pending scheduled records of sections that are not changed,
+// as they will change the entries later on
+func DescribeScheduled(entries []*eps.DirectoryEntry, changes []*SectionChange) string {
+
+	changed := map[string]bool{}
+
+	for _, change := range changes {
+		changed[change.Name+"/"+change.Section] = true
+		if change.Section == "entry" {
+			changed[change.Name] = true
+		}
+	}
+
+	lines := make([]string, 0)
+
+	for _, entry := range entries {
+		if changed[entry.Name] {
+			continue
+		}
+		for _, record := range entry.Scheduled {
+			if changed[entry.Name+"/"+record.Record.Section] {
+				continue
+			}
+			if record.Record.ValidUntil != nil && !time.Now().Before(record.Record.ValidUntil.Time) {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("! %s: scheduled change of section '%s' (%s)", entry.Name, record.Record.Section, describeValidity(record.Record)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Returns the entries of the directory without applying scheduled records if
+// possible, as changes are based on them
+func unscheduledEntries(directory eps.Directory) ([]*eps.DirectoryEntry, error) {
+	if schedulingDirectory, ok := directory.(eps.SchedulingDirectory); ok {
+		return schedulingDirectory.UnscheduledEntries(&eps.DirectoryQuery{})
+	}
+	return directory.Entries(&eps.DirectoryQuery{})
+}
+
+// A plan for bringing the directory to the desired state
+type directoryPlan struct {
+	directory eps.Directory
+	// the tip the changes are based on
+	tip *eps.SignedChangeRecord
+	// the current (unscheduled) entries
+	entries []*eps.DirectoryEntry
+	changes []*SectionChange
+}
+
+// Loads the desired state and the current entries and computes the changes
+func planChanges(c *cli.Context, settings *eps.Settings) (*directoryPlan, error) {
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		return nil, fmt.Errorf("please specify a filename")
+	}
+
+	state, err := loadDesiredState(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	directory, err := helpers.InitializeDirectory(settings)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tip *eps.SignedChangeRecord
+
+	// we retrieve the tip before the entries, so that the service directory
+	// rejects our records if the entries changed in the meantime
+	if writableDirectory, ok := directory.(eps.WritableDirectory); ok {
+		if tip, err = writableDirectory.Tip(); err != nil {
+			return nil, err
+		}
+	}
+
+	// changes replace scheduled records, so we compare the desired state with
+	// the entries as they are on record
+	entries, err := unscheduledEntries(directory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := PlanChanges(entries, state, c.Bool("prune"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &directoryPlan{
+		directory: directory,
+		tip:       tip,
+		entries:   entries,
+		changes:   changes,
+	}, nil
+}
+
+func printChanges(plan *directoryPlan) {
+	if scheduled := DescribeScheduled(plan.entries, plan.changes); scheduled != "" {
+		fmt.Printf("Pending scheduled changes:\n%s\n\n", scheduled)
+	}
+	if len(plan.changes) == 0 {
+		fmt.Println("No changes, the directory is up to date.")
+		return
+	}
+	fmt.Println(DescribeChanges(plan.changes))
+	fmt.Printf("\n%d change record(s) necessary.\n", len(plan.changes))
+}
+
+func plan(c *cli.Context, settings *eps.Settings) error {
+
+	plan, err := planChanges(c, settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	printChanges(plan)
+
+	return nil
+}
+
+// Asks for confirmation on stderr, so that stdout can be redirected
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s Only 'yes' will be accepted: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(answer) == "yes"
+}
+
+func apply(c *cli.Context, settings *eps.Settings) error {
+
+	if settings.Signing == nil {
+		eps.Log.Fatalf("Signing settings undefined!")
+	}
+
+	plan, err := planChanges(c, settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	writableDirectory, ok := plan.directory.(eps.WritableDirectory)
+
+	if !ok {
+		eps.Log.Fatalf("not a writable service directory")
+	}
+
+	printChanges(plan)
+
+	if len(plan.changes) == 0 {
+		return nil
+	}
+
+	if !c.Bool("yes") && !confirm("\nDo you want to apply these changes?") {
+		fmt.Println("Apply cancelled.")
+		return nil
+	}
+
+	var parentHash string
+
+	if plan.tip != nil {
+		parentHash = plan.tip.Hash
+	}
+
+	records := make([]*eps.ChangeRecord, len(plan.changes))
+
+	for i, change := range plan.changes {
+		records[i] = change.Record
+	}
+
+	signedChangeRecords, err := signChangeRecords(records, parentHash, settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if err := writableDirectory.Submit(signedChangeRecords); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	fmt.Printf("Applied %d change record(s).\n", len(signedChangeRecords))
+
+	return nil
+}
@@ -0,0 +1,379 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+If the service directory requires a quorum of admins, changes are made via
+proposals: One admin signs the records ('sd propose'), the others add their
+signatures ('sd cosign') and finally someone submits the proposal ('sd
+submit-proposal'). Proposals are simple JSON files that can be passed around.
+*/
+
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/kiprotect/go-helpers/forms"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var ProposalForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "records",
+			Validators: []forms.Validator{
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &epsForms.SignedChangeRecordForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func loadProposal(filename string) (*eps.Proposal, error) {
+
+	jsonBytes, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rawProposal map[string]interface{}
+
+	if err := json.Unmarshal(jsonBytes, &rawProposal); err != nil {
+		return nil, err
+	}
+
+	proposal := &eps.Proposal{}
+
+	if params, err := ProposalForm.Validate(rawProposal); err != nil {
+		return nil, err
+	} else if err := ProposalForm.Coerce(proposal, params); err != nil {
+		return nil, err
+	}
+
+	if len(proposal.Records) == 0 {
+		return nil, fmt.Errorf("proposal does not contain any records")
+	}
+
+	return proposal, nil
+}
+
+func printProposal(proposal *eps.Proposal) error {
+
+	proposalBytes, err := json.MarshalIndent(proposal, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(proposalBytes))
+
+	return nil
+}
+
+// Signs the records in the given file, chaining them to the current tip, and
+// prints them as a proposal
+func propose(c *cli.Context, settings *eps.Settings) error {
+
+	if settings.Signing == nil {
+		eps.Log.Fatalf("Signing settings undefined!")
+	}
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		eps.Log.Fatal("please specify a filename")
+	}
+
+	jsonBytes, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	records := &Records{}
+	var rawRecords map[string]interface{}
+
+	if err := json.Unmarshal(jsonBytes, &rawRecords); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if params, err := RecordsForm.Validate(rawRecords); err != nil {
+		eps.Log.Fatal(err)
+	} else if err := RecordsForm.Coerce(records, params); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	var parentHash string
+
+	if !c.Bool("reset") {
+
+		directory, err := helpers.InitializeDirectory(settings)
+
+		if err != nil {
+			eps.Log.Fatal(err)
+		}
+
+		writableDirectory, ok := directory.(eps.WritableDirectory)
+
+		if !ok {
+			eps.Log.Fatalf("not a writable service directory")
+		}
+
+		if tip, err := writableDirectory.Tip(); err != nil {
+			eps.Log.Fatal(err)
+		} else if tip != nil {
+			parentHash = tip.Hash
+		}
+	}
+
+	signedChangeRecords, err := signChangeRecords(records.Records, parentHash, settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if err := printProposal(&eps.Proposal{Records: signedChangeRecords}); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return nil
+}
+
+// Describes the records of a proposal: changes are compared with the current
+// entries (if a directory is configured), followed by the full records
+func describeProposal(proposal *eps.Proposal, settings *eps.Settings) (string, error) {
+
+	currentEntries := map[string]map[string]interface{}{}
+
+	if settings.Directory != nil {
+
+		directory, err := helpers.InitializeDirectory(settings)
+
+		if err != nil {
+			return "", err
+		}
+
+		entries, err := unscheduledEntries(directory)
+
+		if err != nil {
+			return "", err
+		}
+
+		for _, entry := range entries {
+			if value, err := genericValue(entry); err != nil {
+				return "", err
+			} else {
+				currentEntries[entry.Name] = value.(map[string]interface{})
+			}
+		}
+	}
+
+	changes := make([]*SectionChange, 0, len(proposal.Records))
+
+	for _, record := range proposal.Records {
+
+		newValue, err := genericValue(record.Record.Data)
+
+		if err != nil {
+			return "", err
+		}
+
+		currentEntry, ok := currentEntries[record.Record.Name]
+
+		if !ok {
+			currentEntry = map[string]interface{}{}
+			currentEntries[record.Record.Name] = currentEntry
+		}
+
+		var oldValue interface{} = currentEntry[record.Record.Section]
+
+		if record.Record.Section == "entry" {
+			oldValue = currentEntry
+		}
+
+		changes = append(changes, &SectionChange{
+			Name:    record.Record.Name,
+			Section: record.Record.Section,
+			Old:     oldValue,
+			New:     newValue,
+			Record:  record.Record,
+		})
+
+		// later records of the proposal are based on this one
+		if !record.Record.IsScheduled() {
+			currentEntry[record.Record.Section] = newValue
+		}
+	}
+
+	lines := []string{DescribeChanges(changes), ""}
+
+	for i, record := range proposal.Records {
+		if recordBytes, err := json.MarshalIndent(record.Record, "", "  "); err != nil {
+			return "", err
+		} else {
+			lines = append(lines, fmt.Sprintf("Record %d (%s):\n%s", i, record.Hash, string(recordBytes)))
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// Adds the signature of the current admin to all records of a proposal and
+// prints the updated proposal. The records are shown before, as admins need
+// to know what they sign.
+func cosign(c *cli.Context, settings *eps.Settings) error {
+
+	if settings.Signing == nil {
+		eps.Log.Fatalf("Signing settings undefined!")
+	}
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		eps.Log.Fatal("please specify a filename")
+	}
+
+	proposal, err := loadProposal(filename)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	signer, err := loadSigner(settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if !helpers.IsAdmin(signer.subjectInfo) {
+		eps.Log.Fatalf("only service directory admins can co-sign proposals")
+	}
+
+	for i, record := range proposal.Records {
+
+		if i > 0 && record.ParentHash != proposal.Records[i-1].Hash {
+			eps.Log.Fatalf("records of the proposal do not form a chain (record %d)", i)
+		}
+
+		// we make sure that the records contain the data we show
+		if ok, err := helpers.VerifyRecordHash(record); err != nil {
+			eps.Log.Fatal(err)
+		} else if !ok {
+			eps.Log.Fatalf("invalid hash of record %d", i)
+		}
+
+		// we make sure that nobody signs the same record twice
+		for _, signature := range append([]*eps.Signature{record.Signature}, record.Signatures...) {
+			if signature == nil {
+				continue
+			}
+			if cert, err := helpers.LoadCertificateFromString(signature.Certificate, true); err != nil {
+				eps.Log.Fatal(err)
+			} else if subjectInfo, err := helpers.GetSubjectInfo(cert); err != nil {
+				eps.Log.Fatal(err)
+			} else if subjectInfo.Name == signer.subjectInfo.Name {
+				eps.Log.Fatalf("'%s' has already signed record %d", subjectInfo.Name, i)
+			}
+		}
+	}
+
+	description, err := describeProposal(proposal, settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	// the proposal itself is printed to stdout
+	fmt.Fprintln(os.Stderr, description)
+
+	if !c.Bool("yes") && !confirm(fmt.Sprintf("\nDo you want to co-sign these %d record(s)?", len(proposal.Records))) {
+		eps.Log.Fatal("Co-signing cancelled.")
+	}
+
+	for _, record := range proposal.Records {
+
+		eps.Log.Infof("Co-signing change of section '%s' of '%s' (%s)...", record.Record.Section, record.Record.Name, record.Hash)
+
+		if err := helpers.CosignRecord(record, signer.key, signer.certificate); err != nil {
+			eps.Log.Fatal(err)
+		}
+	}
+
+	if err := printProposal(proposal); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return nil
+}
+
+// Submits the records of a proposal, which need to extend the current tip
+func submitProposal(c *cli.Context, settings *eps.Settings) error {
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		eps.Log.Fatal("please specify a filename")
+	}
+
+	proposal, err := loadProposal(filename)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	directory, err := helpers.InitializeDirectory(settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	writableDirectory, ok := directory.(eps.WritableDirectory)
+
+	if !ok {
+		eps.Log.Fatalf("not a writable service directory")
+	}
+
+	tip, err := writableDirectory.Tip()
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	// proposals that reset the directory start a new chain instead
+	if parentHash := proposal.Records[0].ParentHash; parentHash != "" && (tip == nil || tip.Hash != parentHash) {
+		eps.Log.Fatalf("the directory changed since the proposal was made, please create a new proposal")
+	}
+
+	if err := writableDirectory.Submit(proposal.Records); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	eps.Log.Infof("Submitted %d record(s).", len(proposal.Records))
+
+	return nil
+}
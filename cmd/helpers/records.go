@@ -17,12 +17,14 @@
 package helpers
 
 import (
+	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/iris-connect/eps"
 	epsForms "github.com/iris-connect/eps/forms"
 	"github.com/iris-connect/eps/helpers"
+	"github.com/iris-connect/eps/tls"
 	"github.com/kiprotect/go-helpers/forms"
 	"github.com/urfave/cli"
 	"io/ioutil"
@@ -136,23 +138,60 @@ func submitChangeRecords(changeRecords []*eps.ChangeRecord, settings *eps.Settin
 		eps.Log.Fatalf("not a writable service directory")
 	}
 
-	certificate, err := helpers.LoadCertificate(settings.Signing.CertificateFile, true)
+	lastRecord, err := writableDirectory.Tip()
 
 	if err != nil {
 		eps.Log.Fatal(err)
 	}
 
-	rootCertificate, err := helpers.LoadCertificate(settings.Signing.CACertificateFile, false)
+	var parentHash string
+
+	if lastRecord != nil && !reset {
+		parentHash = lastRecord.Hash
+	}
+
+	signedChangeRecords, err := signChangeRecords(changeRecords, parentHash, settings)
 
 	if err != nil {
 		eps.Log.Fatal(err)
 	}
 
+	if err := writableDirectory.Submit(signedChangeRecords); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	return nil
+
+}
+
+// The signing key and certificates of the current operator
+type signer struct {
+	key                      *ecdsa.PrivateKey
+	certificate              *x509.Certificate
+	rootCertificate          *x509.Certificate
+	intermediateCertificates []*x509.Certificate
+	subjectInfo              *helpers.SubjectInfo
+}
+
+func loadSigner(settings *eps.Settings) (*signer, error) {
+
+	certificate, err := helpers.LoadCertificate(settings.Signing.CertificateFile, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rootCertificate, err := helpers.LoadCertificate(settings.Signing.CACertificateFile, false)
+
+	if err != nil {
+		return nil, err
+	}
+
 	intermediateCertificates := []*x509.Certificate{}
 
 	for _, certificateFile := range settings.Signing.CAIntermediateCertificateFiles {
 		if cert, err := helpers.LoadCertificate(certificateFile, false); err != nil {
-			eps.Log.Fatal(err)
+			return nil, err
 		} else {
 			intermediateCertificates = append(intermediateCertificates, cert)
 		}
@@ -160,54 +199,123 @@ func submitChangeRecords(changeRecords []*eps.ChangeRecord, settings *eps.Settin
 
 	// we ensure the certificate is valid for signing
 	if err := helpers.VerifyCertificate(certificate, rootCertificate, intermediateCertificates, settings.Name); err != nil {
-		eps.Log.Fatal(err)
+		return nil, err
+	}
+
+	subjectInfo, err := helpers.GetSubjectInfo(certificate)
+
+	if err != nil {
+		return nil, err
 	}
 
 	key, err := helpers.LoadPrivateKey(settings.Signing.KeyFile)
 
 	if err != nil {
-		eps.Log.Fatal(err)
+		return nil, err
 	}
 
-	lastRecord, err := writableDirectory.Tip()
+	return &signer{
+		key:                      key,
+		certificate:              certificate,
+		rootCertificate:          rootCertificate,
+		intermediateCertificates: intermediateCertificates,
+		subjectInfo:              subjectInfo,
+	}, nil
+}
+
+// Verifies signed data against the signing settings. Certificates revoked by
+// the configured CRLs or by one of the given revocations are rejected.
+func verifySignedData(signedData *eps.SignedData, rootCertificate *x509.Certificate, intermediateCertificates []*x509.Certificate, name string, revocations []*eps.OperatorRevocation, settings *eps.Settings) (bool, error) {
+
+	var revocationList *tls.RevocationList
+
+	if len(settings.Signing.CRLFiles) > 0 {
+		var err error
+		if revocationList, err = tls.LoadRevocationList(settings.Signing.CRLFiles, append([]*x509.Certificate{rootCertificate}, intermediateCertificates...)); err != nil {
+			return false, fmt.Errorf("error loading CRLs: %w", err)
+		}
+	}
+
+	return helpers.VerifyWithRevocationList(signedData, []*x509.Certificate{rootCertificate}, intermediateCertificates, name, revocations, revocationList)
+}
+
+// Returns the revocations of the given operator from the directory (if one
+// is configured)
+func directoryRevocations(name string, settings *eps.Settings) ([]*eps.OperatorRevocation, error) {
+
+	if settings.Directory == nil {
+		return nil, nil
+	}
+
+	directory, err := helpers.InitializeDirectory(settings)
 
 	if err != nil {
-		eps.Log.Fatal(err)
+		return nil, err
 	}
 
-	var parentHash string
+	if entry, err := directory.EntryFor(name); err != nil {
+		if err == eps.NoEntryFound {
+			return nil, nil
+		}
+		return nil, err
+	} else {
+		return entry.Revocations, nil
+	}
+}
 
-	if lastRecord != nil && !reset {
-		parentHash = lastRecord.Hash
+// Signs the given change records, chaining them to the given parent hash
+func signChangeRecords(changeRecords []*eps.ChangeRecord, parentHash string, settings *eps.Settings) ([]*eps.SignedChangeRecord, error) {
+
+	signer, err := loadSigner(settings)
+
+	if err != nil {
+		return nil, err
 	}
 
 	signedChangeRecords := make([]*eps.SignedChangeRecord, 0)
 
 	for _, changeRecord := range changeRecords {
 
-		changeRecord.CreatedAt = eps.HashableTime{time.Now()}
+		changeRecord.CreatedAt = eps.HashableTime{Time: time.Now()}
 
 		signedChangeRecord := &eps.SignedChangeRecord{
 			ParentHash: parentHash,
 			Record:     changeRecord,
 		}
 
+		// we check this here already to provide a helpful error message,
+		// the service directory will perform the same check
+		if !helpers.IsAuthorizedFor(signer.subjectInfo, signedChangeRecord) {
+			if parentHash == "" {
+				return nil, fmt.Errorf("only service directory admins can create a new record chain")
+			}
+			return nil, fmt.Errorf("'%s' is not authorized to change section '%s' of operator '%s'", signer.subjectInfo.Name, changeRecord.Section, changeRecord.Name)
+		}
+
+		if err := helpers.ValidateChangeRecordOp(changeRecord); err != nil {
+			return nil, err
+		}
+
+		if err := helpers.ValidateRecordChannels(changeRecord, settings.Definitions); err != nil {
+			return nil, err
+		}
+
 		if err := helpers.CalculateRecordHash(signedChangeRecord); err != nil {
-			eps.Log.Fatal(err)
+			return nil, err
 		}
 
-		signedData, err := helpers.Sign(signedChangeRecord, key, certificate)
+		signedData, err := helpers.Sign(signedChangeRecord, signer.key, signer.certificate)
 
 		if err != nil {
-			eps.Log.Fatal(err)
+			return nil, err
 		}
 
 		eps.Log.Info(signedChangeRecord.Hash)
 
-		if ok, err := helpers.Verify(signedData, []*x509.Certificate{rootCertificate}, intermediateCertificates, settings.Name); err != nil {
-			eps.Log.Fatal(err)
+		if ok, err := verifySignedData(signedData, signer.rootCertificate, signer.intermediateCertificates, settings.Name, nil, settings); err != nil {
+			return nil, err
 		} else if !ok {
-			eps.Log.Fatalf("cannot verify signature")
+			return nil, fmt.Errorf("cannot verify signature")
 		}
 
 		signedChangeRecord.Signature = signedData.Signature
@@ -215,12 +323,57 @@ func submitChangeRecords(changeRecords []*eps.ChangeRecord, settings *eps.Settin
 		parentHash = signedChangeRecord.Hash
 	}
 
-	if err := writableDirectory.Submit(signedChangeRecords); err != nil {
+	return signedChangeRecords, nil
+}
+
+// Signs change records and prints them, so that they can be used with a
+// signed JSON directory (e.g. in air-gapped setups)
+func signRecords(c *cli.Context, settings *eps.Settings) error {
+
+	if settings.Signing == nil {
+		eps.Log.Fatalf("Signing settings undefined!")
+	}
+
+	filename := c.Args().Get(0)
+
+	if filename == "" {
+		eps.Log.Fatal("please specify a filename")
+	}
+
+	jsonBytes, err := ioutil.ReadFile(filename)
+
+	if err != nil {
 		eps.Log.Fatal(err)
 	}
 
-	return nil
+	records := &Records{}
+	var rawRecords map[string]interface{}
 
+	if err := json.Unmarshal(jsonBytes, &rawRecords); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if params, err := RecordsForm.Validate(rawRecords); err != nil {
+		eps.Log.Fatal(err)
+	} else if err := RecordsForm.Coerce(records, params); err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	signedChangeRecords, err := signChangeRecords(records.Records, c.String("parent"), settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	signedRecordsBytes, err := json.MarshalIndent(map[string]interface{}{"records": signedChangeRecords}, "", "  ")
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	fmt.Println(string(signedRecordsBytes))
+
+	return nil
 }
 
 func sign(c *cli.Context, settings *eps.Settings) error {
@@ -299,7 +452,7 @@ func sign(c *cli.Context, settings *eps.Settings) error {
 		eps.Log.Fatal(err)
 	}
 
-	if ok, err := helpers.Verify(loadedSignedData, []*x509.Certificate{rootCertificate}, intermediateCertificates, settings.Name); err != nil {
+	if ok, err := verifySignedData(loadedSignedData, rootCertificate, intermediateCertificates, settings.Name, nil, settings); err != nil {
 		eps.Log.Fatal(err)
 	} else if !ok {
 		eps.Log.Fatal("Signature is not valid!")
@@ -354,7 +507,13 @@ func verify(c *cli.Context, settings *eps.Settings) error {
 		}
 	}
 
-	if ok, err := helpers.Verify(signedData, []*x509.Certificate{rootCertificate}, intermediateCertificates, name); err != nil {
+	revocations, err := directoryRevocations(name, settings)
+
+	if err != nil {
+		eps.Log.Fatal(err)
+	}
+
+	if ok, err := verifySignedData(signedData, rootCertificate, intermediateCertificates, name, revocations, settings); err != nil {
 		eps.Log.Fatal(err)
 	} else if !ok {
 		eps.Log.Fatal("Signature is not valid!")
@@ -394,6 +553,72 @@ func RecordsCommands(settings *eps.Settings) ([]cli.Command, error) {
 					Usage:  "Submit several records at once",
 					Action: func(c *cli.Context) error { return submitRecords(c, settings) },
 				},
+				{
+					Name: "plan",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "prune",
+							Usage: "delete entries that are not part of the desired state",
+						},
+					},
+					Usage:  "Show the changes necessary to bring the directory to the desired state in the given file",
+					Action: func(c *cli.Context) error { return plan(c, settings) },
+				},
+				{
+					Name: "apply",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "prune",
+							Usage: "delete entries that are not part of the desired state",
+						},
+						cli.BoolFlag{
+							Name:  "yes",
+							Usage: "apply the changes without asking for confirmation",
+						},
+					},
+					Usage:  "Bring the directory to the desired state in the given file, after showing the changes",
+					Action: func(c *cli.Context) error { return apply(c, settings) },
+				},
+				{
+					Name: "propose",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "reset",
+							Usage: "propose a new record chain (dangerous)",
+						},
+					},
+					Usage:  "Sign several records and print them as a proposal that other admins can co-sign",
+					Action: func(c *cli.Context) error { return propose(c, settings) },
+				},
+				{
+					Name: "cosign",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "yes",
+							Usage: "co-sign the records without asking for confirmation",
+						},
+					},
+					Usage:  "Show the records of a proposal, add your signature to them and print the updated proposal",
+					Action: func(c *cli.Context) error { return cosign(c, settings) },
+				},
+				{
+					Name:   "submit-proposal",
+					Flags:  []cli.Flag{},
+					Usage:  "Submit the records of a (co-signed) proposal",
+					Action: func(c *cli.Context) error { return submitProposal(c, settings) },
+				},
+				forksCommand(settings),
+				{
+					Name: "sign-records",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "parent",
+							Usage: "the hash of the record the new records should follow",
+						},
+					},
+					Usage:  "Sign several records at once and print them as JSON (for use with a signed JSON directory)",
+					Action: func(c *cli.Context) error { return signRecords(c, settings) },
+				},
 				{
 					Name:   "sign",
 					Flags:  []cli.Flag{},
@@ -34,6 +34,14 @@ type Datastore interface {
 	Init() error
 }
 
+// A datastore whose contents can be replaced, e.g. to discard outdated entries
+type CompactableDatastore interface {
+	Datastore
+	// Replaces all entries of the store with the given ones. Subsequent calls
+	// of 'Read' only return entries written after the compaction.
+	Compact([]*DataEntry) error
+}
+
 const (
 	NullType = 0
 )
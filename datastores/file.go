@@ -466,15 +466,91 @@ func (f *FileDatastore) Read() ([]*eps.DataEntry, error) {
 }
 
 func (f *FileDatastore) Write(entry *eps.DataEntry) error {
+	// we need to hold the mutex as 'Compact' replaces the file
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := writeEntry(f.wfile, entry); err != nil {
+		return err
+	}
+	// we make sure the changes were all written to disk
+	return f.wfile.Sync()
+}
+
+func writeEntry(file *os.File, entry *eps.DataEntry) error {
 	if chunks, err := Split(entry); err != nil {
 		return err
 	} else {
 		for _, chunk := range chunks {
-			if err := chunk.Write(f.wfile); err != nil {
+			if err := chunk.Write(file); err != nil {
 				return err
 			}
 		}
 	}
-	// we make sure the changes were all written to disk
-	return f.wfile.Sync()
+	return nil
+}
+
+// Writes the given entries to a new file, which then replaces the current
+// one. Entries that other processes append to the old file in the meantime
+// are lost, so this should only be used if there is a single writer.
+func (f *FileDatastore) Compact(entries []*eps.DataEntry) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	tmpFilename := f.settings.Filename + ".compact"
+
+	tmpFile, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := writeEntry(tmpFile, entry); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFilename, f.settings.Filename); err != nil {
+		return err
+	}
+
+	wfile, err := os.OpenFile(f.settings.Filename, os.O_APPEND|os.O_WRONLY, 0700)
+
+	if err != nil {
+		return err
+	}
+
+	rfile, err := os.OpenFile(f.settings.Filename, os.O_RDONLY, 0700)
+
+	if err != nil {
+		wfile.Close()
+		return err
+	}
+
+	// the caller already knows the entries we've just written
+	if _, err := rfile.Seek(0, 2); err != nil {
+		wfile.Close()
+		rfile.Close()
+		return err
+	}
+
+	f.wfile.Close()
+	f.rfile.Close()
+
+	f.wfile = wfile
+	f.rfile = rfile
+	f.chunks = make([]*DataChunk, 0, 10)
+
+	return nil
 }
@@ -0,0 +1,99 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package datastores
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"path/filepath"
+	"testing"
+)
+
+func makeTestFile(t *testing.T, filename string) *FileDatastore {
+	store, err := MakeFile(FileSettings{Filename: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store.(*FileDatastore)
+}
+
+func makeTestEntry(i int) *eps.DataEntry {
+	return &eps.DataEntry{
+		Type: 1,
+		ID:   []byte(fmt.Sprintf("%016d", i)),
+		Data: []byte(fmt.Sprintf("entry %d", i)),
+	}
+}
+
+func TestFileCompact(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "store")
+	store := makeTestFile(t, filename)
+
+	for i := 0; i < 10; i++ {
+		if err := store.Write(makeTestEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if entries, err := store.Read(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 10 {
+		t.Fatalf("expected 10 entries, got %d", len(entries))
+	}
+
+	if err := store.Compact([]*eps.DataEntry{makeTestEntry(8), makeTestEntry(9)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// we only receive entries written after the compaction
+	if entries, err := store.Read(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("expected no new entries, got %d", len(entries))
+	}
+
+	if err := store.Write(makeTestEntry(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := store.Read(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || string(entries[0].Data) != "entry 10" {
+		t.Fatalf("expected the entry written after the compaction")
+	}
+
+	// a new instance sees the compacted contents
+	entries, err := makeTestFile(t, filename).Read()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	for i, entry := range entries {
+		if expected := fmt.Sprintf("entry %d", i+8); string(entry.Data) != expected {
+			t.Fatalf("expected '%s', got '%s'", expected, entry.Data)
+		}
+	}
+}
@@ -154,6 +154,23 @@ func (d *Redis) Read() ([]*eps.DataEntry, error) {
 	}
 }
 
+// Replaces the list with the given entries in a single transaction
+func (d *Redis) Compact(entries []*eps.DataEntry) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pipeline := d.Client().TxPipeline()
+	pipeline.Del(d.settings.Key)
+	for _, entry := range entries {
+		pipeline.RPush(d.settings.Key, string(ToBytes(entry)))
+	}
+	if _, err := pipeline.Exec(); err != nil {
+		return err
+	}
+	// the caller already knows the entries we've just written
+	d.index = int64(len(entries)) - 1
+	return nil
+}
+
 func (d *Redis) Init() error {
 	return nil
 }
@@ -18,16 +18,28 @@ package directories
 
 import (
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/iris-connect/eps"
 	epsForms "github.com/iris-connect/eps/forms"
 	"github.com/iris-connect/eps/helpers"
 	"github.com/iris-connect/eps/jsonrpc"
 	"github.com/kiprotect/go-helpers/forms"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"regexp"
 	"sync"
 	"time"
 )
 
+// we tolerate some clock skew between admins and API directories
+const maxPinSkew = 5 * time.Minute
+
+var refusedChainSwitches = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "eps_api_directory_refused_chain_switches_total",
+	Help: "Number of chains with a different root that were not adopted because they are outdated or not endorsed",
+})
+
 var APIDirectorySettingsForm = forms.Form{
 	Fields: []forms.Field{
 		{
@@ -43,6 +55,122 @@ var APIDirectorySettingsForm = forms.Form{
 				forms.IsStringList{},
 			},
 		},
+		{
+			// determines in which order the endpoints are tried
+			Name: "strategy",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: "ordered"},
+				forms.IsString{},
+				forms.IsIn{Choices: []interface{}{"ordered", "round_robin"}},
+			},
+		},
+		{
+			// maximum time (in seconds) an endpoint will be avoided after failures
+			Name: "max_backoff",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 300},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+					HasMax: true,
+					Max:    86400,
+				},
+			},
+		},
+		{
+			// whether to compare the tip hash between different endpoints
+			Name: "cross_check_tips",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: true},
+				forms.IsBoolean{},
+			},
+		},
+		{
+			Name: "cross_check_interval",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 60},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    0,
+					HasMax: true,
+					Max:    86400,
+				},
+			},
+		},
+		{
+			// optional local cache of verified records for offline startup
+			Name: "cache",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsStringMap{
+					Form: &APIDirectoryCacheSettingsForm,
+				},
+			},
+		},
+		{
+			// whether to subscribe to changes via long-polling
+			Name: "subscribe",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: true},
+				forms.IsBoolean{},
+			},
+		},
+		{
+			Name: "subscription_timeout",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 30},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+					HasMax: true,
+					Max:    300,
+				},
+			},
+		},
+		{
+			// we reject records that were not signed by at least this many
+			// admins (except self-service changes of operators)
+			Name: "quorum",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 1},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+				},
+			},
+		},
+		{
+			// whether to start from a signed checkpoint instead of
+			// verifying the whole record chain on the initial sync
+			Name: "use_checkpoints",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: true},
+				forms.IsBoolean{},
+			},
+		},
+		{
+			// certificates of keys that may sign pins on their own
+			Name: "pin_certificate_files",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsString{},
+					},
+				},
+			},
+		},
+		{
+			// if set, only chains starting with this root record are adopted
+			Name: "pinned_root",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+				forms.MatchesRegex{
+					Regexp: regexp.MustCompile(`^([a-f0-9]{64}|)$`),
+				},
+			},
+		},
 		{
 			Name: "cache_entries_for",
 			Validators: []forms.Validator{
@@ -94,6 +222,17 @@ type APIDirectorySettings struct {
 	CACertificateFiles             []string                       `json:"ca_certificate_files"`
 	CAIntermediateCertificateFiles []string                       `json:"ca_intermediate_certificate_files"`
 	CacheEntriesFor                int64                          `json:"cache_entries_for"`
+	Strategy                       string                         `json:"strategy"`
+	MaxBackoff                     int64                          `json:"max_backoff"`
+	CrossCheckTips                 bool                           `json:"cross_check_tips"`
+	CrossCheckInterval             int64                          `json:"cross_check_interval"`
+	Cache                          *APIDirectoryCacheSettings     `json:"cache"`
+	Subscribe                      bool                           `json:"subscribe"`
+	SubscriptionTimeout            int64                          `json:"subscription_timeout"`
+	UseCheckpoints                 bool                           `json:"use_checkpoints"`
+	Quorum                         int                            `json:"quorum"`
+	PinnedRoot                     string                         `json:"pinned_root"`
+	PinCertificateFiles            []string                       `json:"pin_certificate_files"`
 }
 
 type CacheEntry struct {
@@ -107,18 +246,29 @@ type DirectoryCache struct {
 
 type APIDirectory struct {
 	eps.BaseDirectory
+	eps.DirectoryWatchers
 	lastUpdate        time.Time
+	lastCrossCheck    time.Time
+	lastSync          time.Time
+	lastCacheSync     time.Time
+	cache             eps.Datastore
+	cacheDirty        bool
+	cacheSize         int
 	settings          APIDirectorySettings
-	jsonrpcClient     *jsonrpc.Client
+	endpoints         *APIEndpoints
 	rootCerts         []*x509.Certificate
 	intermediateCerts []*x509.Certificate
+	pinCerts          []*x509.Certificate
 	entries           map[string]*eps.DirectoryEntry
 	records           []*eps.SignedChangeRecord
+	checkpoint        *eps.SignedCheckpoint
+	pin               *eps.SignedPin
 	mutex             sync.Mutex
 }
 
 func APIDirectorySettingsValidator(settings map[string]interface{}) (interface{}, error) {
-	if params, err := APIDirectorySettingsForm.Validate(settings); err != nil {
+	// the cache settings require datastore definitions for validation
+	if params, err := APIDirectorySettingsForm.ValidateWithContext(settings, map[string]interface{}{"definitions": CacheDefinitions}); err != nil {
 		return nil, err
 	} else {
 		validatedSettings := &APIDirectorySettings{}
@@ -158,23 +308,54 @@ func MakeAPIDirectory(name string, settings interface{}) (eps.Directory, error)
 
 	}
 
+	pinCerts := make([]*x509.Certificate, 0)
+
+	for _, certificateFile := range apiSettings.PinCertificateFiles {
+		cert, err := helpers.LoadCertificate(certificateFile, true)
+
+		if err != nil {
+			return nil, fmt.Errorf("error loading API directory pin certificate: %w", err)
+		}
+
+		pinCerts = append(pinCerts, cert)
+
+	}
+
+	endpoints, err := MakeAPIEndpoints(&apiSettings)
+
+	if err != nil {
+		return nil, err
+	}
+
 	d := &APIDirectory{
 		BaseDirectory: eps.BaseDirectory{
 			Name_: name,
 		},
-		jsonrpcClient:     jsonrpc.MakeClient(apiSettings.JSONRPCClient),
+		endpoints:         endpoints,
 		entries:           make(map[string]*eps.DirectoryEntry),
 		records:           []*eps.SignedChangeRecord{},
 		rootCerts:         rootCerts,
 		intermediateCerts: intermediateCerts,
+		pinCerts:          pinCerts,
 		settings:          apiSettings,
 	}
 
+	// we load verified records from the local cache (if configured)
+	if err := d.initCache(); err != nil {
+		eps.Log.Error(err)
+	}
+
 	// we still allow the services to start even if the API is not reachable...
 	if err := d.update(); err != nil {
 		eps.Log.Error(err)
 	}
 
+	if apiSettings.Subscribe {
+		// we receive changes from the service directory as soon as they
+		// happen, regular updates via 'getRecords' remain as a fallback
+		go d.subscribe()
+	}
+
 	return d, nil
 }
 
@@ -200,6 +381,14 @@ type UpdateRecords struct {
 }
 
 func (f *APIDirectory) Entries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
+	return f.queryEntries(query, true)
+}
+
+func (f *APIDirectory) UnscheduledEntries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
+	return f.queryEntries(query, false)
+}
+
+func (f *APIDirectory) queryEntries(query *eps.DirectoryQuery, applyScheduled bool) ([]*eps.DirectoryEntry, error) {
 
 	f.mutex.Lock()
 	lastUpdate := f.lastUpdate
@@ -208,7 +397,11 @@ func (f *APIDirectory) Entries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry
 	if time.Now().Add(-time.Duration(2*f.settings.CacheEntriesFor) * time.Second).After(lastUpdate) {
 		// last update was more than 2 minutes ago, we update synchronously
 		if err := f.update(); err != nil {
-			return nil, fmt.Errorf("error updating service directory: %w", err)
+			if !f.canUseStaleData() {
+				return nil, fmt.Errorf("error updating service directory: %w", err)
+			}
+			// we continue with the data we have
+			eps.Log.Errorf("Error updating service directory, using cached data: %v", err)
 		}
 	} else if time.Now().Add(-time.Duration(f.settings.CacheEntriesFor) * time.Second).After(lastUpdate) {
 		// last update was more than 1 minute ago, we update in the background
@@ -228,9 +421,33 @@ func (f *APIDirectory) Entries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry
 		entries[i] = entry
 		i++
 	}
+	if applyScheduled {
+		// we apply scheduled records that are valid right now
+		entries = helpers.EntriesAt(entries, time.Now())
+	}
 	return eps.FilterDirectoryEntriesByQuery(entries, query), nil
 }
 
+// Determines whether we can use our current data even though the service
+// directory is unreachable, which requires a cache to be configured
+func (f *APIDirectory) canUseStaleData() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.cache != nil && f.tipHash() != "" && !f.isStale(f.lastSync)
+}
+
+// Returns an error if we could not synchronize with the service directory
+// for longer than we cache entries (see 'Entries'), i.e. if we only serve
+// cached data
+func (f *APIDirectory) CheckFreshness() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if since := time.Since(f.lastSync); since > time.Duration(2*f.settings.CacheEntriesFor)*time.Second {
+		return fmt.Errorf("last synchronized with the service directory %v ago", since.Round(time.Second))
+	}
+	return nil
+}
+
 func (f *APIDirectory) EntryFor(name string) (*eps.DirectoryEntry, error) {
 	// locking is done by Entries method
 	if entries, err := f.Entries(&eps.DirectoryQuery{Operator: name}); err != nil {
@@ -249,49 +466,55 @@ func (f *APIDirectory) OwnEntry() (*eps.DirectoryEntry, error) {
 
 func (f *APIDirectory) Tip() (*eps.SignedChangeRecord, error) {
 
-	// to do: ensure there's always one server name and endpoint
-	f.jsonrpcClient.SetServerName(f.settings.ServerNames[0])
-	f.jsonrpcClient.SetEndpoint(f.settings.Endpoints[0])
+	request := jsonrpc.MakeRequest("getTip", "", map[string]interface{}{})
+
+	if result, _, err := f.endpoints.Call(request); err != nil {
+		return nil, fmt.Errorf("error getting tip from service directory: %w", err)
+	} else {
+		return parseTip(result)
+	}
+}
+
+// Retrieves the tip from a specific service directory endpoint
+func (f *APIDirectory) tipFrom(endpoint *APIEndpoint) (*eps.SignedChangeRecord, error) {
 
 	request := jsonrpc.MakeRequest("getTip", "", map[string]interface{}{})
 
-	if result, err := f.jsonrpcClient.Call(request); err != nil {
+	if result, err := f.endpoints.CallEndpoint(endpoint, request); err != nil {
 		return nil, fmt.Errorf("error getting tip from service directory: %w", err)
 	} else {
-		if result.Error != nil {
-			return nil, fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
-		}
+		return parseTip(result)
+	}
+}
 
-		if result.Result == nil {
-			return nil, nil
-		}
+func parseTip(result *jsonrpc.Response) (*eps.SignedChangeRecord, error) {
+	if result.Error != nil {
+		return nil, fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
+	}
+
+	if result.Result == nil {
+		return nil, nil
+	}
 
-		if mapResult, ok := result.Result.(map[string]interface{}); !ok {
-			return nil, fmt.Errorf("expected a map as result for 'getTip' call to service directory")
-		} else if params, err := epsForms.SignedChangeRecordForm.Validate(mapResult); err != nil {
+	if mapResult, ok := result.Result.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("expected a map as result for 'getTip' call to service directory")
+	} else if params, err := epsForms.SignedChangeRecordForm.Validate(mapResult); err != nil {
+		return nil, err
+	} else {
+		signedChangeRecord := &eps.SignedChangeRecord{}
+		if err := epsForms.SignedChangeRecordForm.Coerce(signedChangeRecord, params); err != nil {
 			return nil, err
 		} else {
-			signedChangeRecord := &eps.SignedChangeRecord{}
-			if err := epsForms.SignedChangeRecordForm.Coerce(signedChangeRecord, params); err != nil {
-				return nil, err
-			} else {
-				return signedChangeRecord, nil
-			}
+			return signedChangeRecord, nil
 		}
 	}
-
-	return nil, nil
 }
 
 func (f *APIDirectory) Submit(signedChangeRecords []*eps.SignedChangeRecord) error {
-	// to do: ensure there's always one server name and endpoint
-	f.jsonrpcClient.SetServerName(f.settings.ServerNames[0])
-	f.jsonrpcClient.SetEndpoint(f.settings.Endpoints[0])
 
-	// we tell the internal proxy about an incoming connection
 	request := jsonrpc.MakeRequest("submitRecords", "", map[string]interface{}{"records": signedChangeRecords})
 
-	if result, err := f.jsonrpcClient.Call(request); err != nil {
+	if result, _, err := f.endpoints.Call(request); err != nil {
 		return fmt.Errorf("error submitting records to service directory: %w", err)
 	} else {
 		if result.Error != nil {
@@ -303,18 +526,43 @@ func (f *APIDirectory) Submit(signedChangeRecords []*eps.SignedChangeRecord) err
 
 }
 
-func (f *APIDirectory) integrate(records []*eps.SignedChangeRecord) error {
-	for _, record := range records {
-		entry, ok := f.entries[record.Record.Name]
-		if !ok {
-			entry = eps.MakeDirectoryEntry()
-			entry.Name = record.Record.Name
-		}
-		if err := helpers.IntegrateChangeRecord(record, entry); err != nil {
-			return fmt.Errorf("error integrating change record: %w", err)
-		}
-		f.entries[record.Record.Name] = entry
+// Returns the chains known to the service directory
+func (f *APIDirectory) Forks() ([]*eps.Fork, error) {
+
+	request := jsonrpc.MakeRequest("getForks", "", map[string]interface{}{})
+
+	result, _, err := f.endpoints.Call(request)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting forks from service directory: %w", err)
+	}
+
+	if result.Error != nil {
+		return nil, fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
+	}
+
+	forks := make([]*eps.Fork, 0)
+
+	if jsonData, err := json.Marshal(result.Result); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonData, &forks); err != nil {
+		return nil, fmt.Errorf("invalid forks: %w", err)
+	}
+
+	return forks, nil
+}
+
+func (f *APIDirectory) Pin(signedPin *eps.SignedPin) error {
+
+	request := jsonrpc.MakeRequest("submitPin", "", map[string]interface{}{"pin": signedPin})
+
+	if result, _, err := f.endpoints.Call(request); err != nil {
+		return fmt.Errorf("error submitting pin to service directory: %w", err)
+	} else if result.Error != nil {
+		eps.Log.Error(result.Error)
+		return fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
 	}
+
 	return nil
 }
 
@@ -332,81 +580,480 @@ func (f *APIDirectory) update() error {
 	eps.Log.Tracef("Updating service directory...")
 	f.lastUpdate = time.Now()
 
-	// to do: ensure there's always one server name and endpoint
-	f.jsonrpcClient.SetServerName(f.settings.ServerNames[0])
-	f.jsonrpcClient.SetEndpoint(f.settings.Endpoints[0])
-
-	var tipHash string
-
-	if len(f.records) > 0 {
-		tipHash = f.records[len(f.records)-1].Hash
+	if f.settings.UseCheckpoints && f.tipHash() == "" {
+		// this is the initial sync, so we try to start from a checkpoint
+		if err := f.loadCheckpoint(); err != nil {
+			eps.Log.Warningf("Cannot load checkpoint from service directory, verifying all records instead: %v", err)
+		}
 	}
 
-	// we tell the internal proxy about an incoming connection
+	tipHash := f.tipHash()
+
 	request := jsonrpc.MakeRequest("getRecords", "", map[string]interface{}{"after": tipHash})
 
-	if result, err := f.jsonrpcClient.Call(request); err != nil {
+	if result, endpoint, err := f.endpoints.Call(request); err != nil {
 		return fmt.Errorf("error getting records from service directory: %w", err)
 	} else {
+		return f.processRecords(result, endpoint, tipHash)
+	}
+}
 
-		if result.Error != nil {
-			return fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
-		}
+func (f *APIDirectory) tipHash() string {
+	if len(f.records) > 0 {
+		return f.records[len(f.records)-1].Hash
+	}
+	if f.checkpoint != nil {
+		return f.checkpoint.Checkpoint.Hash
+	}
+	return ""
+}
 
-		if result.Result == nil {
+// Returns the creation time of our tip, which is zero if we don't know it
+func (f *APIDirectory) tipCreatedAt() time.Time {
+	if len(f.records) > 0 {
+		return f.records[len(f.records)-1].Record.CreatedAt.Time
+	}
+	if f.checkpoint != nil && f.checkpoint.Checkpoint.TipCreatedAt != nil {
+		return f.checkpoint.Checkpoint.TipCreatedAt.Time
+	}
+	return time.Time{}
+}
+
+// Retrieves the latest checkpoint from the service directory and uses its
+// entries as the basis for further updates (the mutex needs to be held)
+func (f *APIDirectory) loadCheckpoint() error {
+
+	request := jsonrpc.MakeRequest("getCheckpoint", "", map[string]interface{}{})
+
+	result, _, err := f.endpoints.Call(request)
+
+	if err != nil {
+		return err
+	}
+
+	if result.Error != nil {
+		if result.Error.Code == -32601 {
+			// the service directory does not support checkpoints
 			return nil
 		}
+		return fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
+	}
+
+	if result.Result == nil {
+		// there is no checkpoint yet
+		return nil
+	}
+
+	checkpoint, err := helpers.ParseCheckpoint(result.Result)
 
-		config := map[string]interface{}{
-			"records": result.Result,
+	if err != nil {
+		return err
+	}
+
+	// we only trust our own entries to look up the signers (which are empty
+	// on the initial sync, so we rely on the certificates alone)
+	if ok, err := helpers.VerifyCheckpoint(checkpoint, f.entries, f.rootCerts, f.intermediateCerts, f.settings.Quorum); err != nil {
+		return fmt.Errorf("cannot verify checkpoint: %w", err)
+	} else if !ok {
+		return fmt.Errorf("checkpoint is not signed by %d admin(s)", f.settings.Quorum)
+	}
+
+	if f.settings.PinnedRoot != "" && checkpoint.Checkpoint.Root != f.settings.PinnedRoot {
+		return fmt.Errorf("checkpoint does not belong to the pinned root")
+	}
+
+	f.useCheckpoint(checkpoint)
+
+	eps.Log.Infof("Loaded checkpoint at record %d (%s)", checkpoint.Checkpoint.Length, checkpoint.Checkpoint.Hash)
+
+	return nil
+}
+
+// Replaces our entries with the ones from the given (verified) checkpoint
+func (f *APIDirectory) useCheckpoint(checkpoint *eps.SignedCheckpoint) {
+	entries := helpers.CheckpointEntries(checkpoint.Checkpoint)
+	changes := eps.DiffDirectoryEntries(f.entries, entries)
+	f.checkpoint = checkpoint
+	f.records = []*eps.SignedChangeRecord{}
+	f.entries = entries
+	f.cacheDirty = true
+	if len(changes) > 0 {
+		go f.Notify(changes)
+	}
+}
+
+// Receives new records from the service directory via long-polling
+func (f *APIDirectory) subscribe() {
+	for {
+
+		f.mutex.Lock()
+		tipHash := f.tipHash()
+		f.mutex.Unlock()
+
+		request := jsonrpc.MakeRequest("waitForRecords", "", map[string]interface{}{"after": tipHash, "timeout": f.settings.SubscriptionTimeout})
+
+		result, endpoint, err := f.endpoints.Call(request)
+
+		if err != nil {
+			eps.Log.Errorf("Error waiting for service directory records: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if result.Error != nil {
+			if result.Error.Code == -32601 {
+				eps.Log.Warning("Service directory does not support subscriptions, falling back to polling")
+				return
+			}
+			eps.Log.Errorf("Error waiting for service directory records: %s", result.Error.Message)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		f.mutex.Lock()
+		// if the records were updated in the meantime we simply try again
+		if f.tipHash() == tipHash {
+			if err := f.processRecords(result, endpoint, tipHash); err != nil {
+				eps.Log.Errorf("Error processing service directory records: %v", err)
+			} else {
+				f.lastUpdate = time.Now()
+			}
 		}
+		f.mutex.Unlock()
+	}
+}
 
-		if params, err := UpdateForm.Validate(config); err != nil {
+// Verifies and integrates records returned by the service directory (the
+// mutex needs to be held when calling this)
+func (f *APIDirectory) processRecords(result *jsonrpc.Response, endpoint *APIEndpoint, tipHash string) error {
+	if result.Error != nil {
+		return fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
+	}
+
+	f.lastSync = time.Now()
+
+	if result.Result == nil {
+		return nil
+	}
+
+	config := map[string]interface{}{
+		"records": result.Result,
+	}
+
+	if params, err := UpdateForm.Validate(config); err != nil {
+		return err
+	} else {
+		updateRecords := &UpdateRecords{}
+		if err := UpdateForm.Coerce(updateRecords, params); err != nil {
 			return err
 		} else {
-			updateRecords := &UpdateRecords{}
-			if err := UpdateForm.Coerce(updateRecords, params); err != nil {
-				return err
-			} else {
-				records := updateRecords.Records
-
-				var fullRecords []*eps.SignedChangeRecord
-				var resetEntries bool
-
-				if len(records) > 0 && records[0].ParentHash != tipHash {
-					if records[0].ParentHash != "" {
-						return fmt.Errorf("expected a new root record but got one with parent hash '%s'", records[0].ParentHash)
-					}
-					// seems the directory changed, we make sure the new one is actually newer than the current one
-					if len(f.records) > 0 && records[0].Record.CreatedAt.Time.Before(f.records[0].Record.CreatedAt.Time) {
-						return fmt.Errorf("server tried to provide an outdated service directory")
-					} else {
-						eps.Log.Warning("Service directory root changed!")
-						// we reset the entries
-						fullRecords = records
-						resetEntries = true
-					}
+			records := updateRecords.Records
+
+			if len(records) == 0 {
+				// nothing changed
+				if err := f.updateCache(nil, false); err != nil {
+					eps.Log.Errorf("Cannot update API directory cache: %v", err)
+				}
+				return nil
+			}
+
+			var resetEntries bool
+			baseEntries := f.entries
+			parentCreatedAt := f.tipCreatedAt()
+
+			if len(records) > 0 && records[0].ParentHash != tipHash {
+				if records[0].ParentHash != "" {
+					return fmt.Errorf("expected a new root record but got one with parent hash '%s'", records[0].ParentHash)
+				}
+				// seems the directory changed, we make sure the new one is actually newer than the current one
+				if f.isOutdatedRoot(records[0]) {
+					refusedChainSwitches.Inc()
+					return fmt.Errorf("server tried to provide an outdated service directory")
 				} else {
-					fullRecords = append(f.records, records...)
+					eps.Log.Warning("Service directory root changed!")
+					// we reset the entries
+					resetEntries = true
+					baseEntries = map[string]*eps.DirectoryEntry{}
+					parentCreatedAt = time.Time{}
 				}
+			}
+
+			// we verify all new records before we integrate them, this only
+			// requires the current entries and not the full history
+			newEntries, err := helpers.VerifyAndIntegrateRecords(records, baseEntries, parentCreatedAt, f.rootCerts, f.intermediateCerts, f.settings.Quorum)
 
-				// we verify all records before we integate them
-				for i, record := range fullRecords {
-					if ok, err := helpers.VerifyRecord(record, fullRecords[:i], f.rootCerts, f.intermediateCerts); err != nil {
-						return fmt.Errorf("cannot verify service directory record: %w", err)
-					} else if !ok {
-						return fmt.Errorf("invalid record found")
-					}
+			if err != nil {
+				return fmt.Errorf("cannot verify service directory records: %w", err)
+			}
+
+			if records[0].ParentHash == "" {
+				// like the service directory, we only adopt a chain with a
+				// different root if it is endorsed
+				if eligible, err := f.isEligible(records, endpoint); err != nil {
+					return err
+				} else if !eligible {
+					eps.Log.Warningf("Not adopting service directory chain with root %s, as it is not endorsed", records[0].Hash)
+					refusedChainSwitches.Inc()
+					return fmt.Errorf("server tried to provide a chain that is not endorsed")
 				}
+			}
 
-				f.records = fullRecords
-				if resetEntries {
-					f.entries = make(map[string]*eps.DirectoryEntry)
+			// we remember which entries are affected by the new records
+			changedNames := map[string]bool{}
+
+			if resetEntries {
+				for name := range f.entries {
+					changedNames[name] = true
 				}
+				f.records = records
+				f.checkpoint = nil
+			} else {
+				f.records = append(f.records, records...)
+			}
+
+			f.entries = newEntries
+
+			for _, record := range records {
+				changedNames[record.Record.Name] = true
+			}
+
+			if f.settings.CrossCheckTips && time.Since(f.lastCrossCheck) > time.Duration(f.settings.CrossCheckInterval)*time.Second {
+				f.lastCrossCheck = time.Now()
+				// this performs network requests so we run it in the background
+				go f.crossCheckTip(endpoint)
+			}
+
+			if err := f.updateCache(records, resetEntries); err != nil {
+				// the cache is not essential so we only log this
+				eps.Log.Errorf("Cannot update API directory cache: %v", err)
+			}
+
+			changes := make([]*eps.DirectoryEntryChange, 0, len(changedNames))
+			for name := range changedNames {
+				changes = append(changes, &eps.DirectoryEntryChange{Name: name, Entry: f.entries[name]})
+			}
+
+			// watchers will usually query the directory, so we notify them
+			// in the background as we're still holding the mutex
+			go f.Notify(changes)
+
+			return nil
+		}
+	}
+}
+
+// Checks whether the given root record is older than the root of our chain.
+// If we started from a checkpoint we don't have the root record, so we use the
+// root information from the checkpoint instead.
+func (f *APIDirectory) isOutdatedRoot(root *eps.SignedChangeRecord) bool {
+
+	if f.checkpoint == nil {
+		return len(f.records) > 0 && root.Record.CreatedAt.Time.Before(f.records[0].Record.CreatedAt.Time)
+	}
+
+	checkpoint := f.checkpoint.Checkpoint
+
+	if root.Hash == checkpoint.Root {
+		// this is our own chain (e.g. because the server lost our tip)
+		return false
+	}
+
+	if checkpoint.RootCreatedAt != nil {
+		return root.Record.CreatedAt.Time.Before(checkpoint.RootCreatedAt.Time)
+	}
+
+	// older checkpoints don't contain the root, but their root is at least
+	// older than the checkpoint itself
+	return root.Record.CreatedAt.Time.Before(checkpoint.CreatedAt.Time)
+}
+
+// Returns the hash of the root record of our chain, which is empty if we have
+// no chain yet or started from a checkpoint that does not contain the root
+func (f *APIDirectory) rootHash() string {
+	if f.checkpoint != nil {
+		return f.checkpoint.Checkpoint.Root
+	}
+	if len(f.records) > 0 {
+		return f.records[0].Hash
+	}
+	return ""
+}
+
+// Determines whether we may adopt the given (verified) chain, which starts
+// with a root record (see 'RecordDirectory.isEligible' in the 'sd' package).
+// Without a pin, we only accept the chain we already have.
+func (f *APIDirectory) isEligible(records []*eps.SignedChangeRecord, endpoint *APIEndpoint) (bool, error) {
+
+	root := records[0].Hash
+
+	if f.settings.PinnedRoot != "" {
+		return root == f.settings.PinnedRoot, nil
+	}
+
+	if f.tipHash() == "" || root == f.rootHash() {
+		// this is the initial sync or our own chain
+		return true, nil
+	}
+
+	pin, err := f.pinFor(records, endpoint)
+
+	if err != nil {
+		return false, err
+	}
+
+	if pin == nil {
+		return false, nil
+	}
+
+	f.pin = pin
+
+	return true, nil
+}
+
+// Returns the most recent pin from the given endpoint that endorses the given
+// chain and is more recent than the last pin we accepted. Pins are verified
+// against our current entries, as the new chain could simply leave out the
+// revocation of a stolen admin key.
+func (f *APIDirectory) pinFor(records []*eps.SignedChangeRecord, endpoint *APIEndpoint) (*eps.SignedPin, error) {
+
+	request := jsonrpc.MakeRequest("getPins", "", map[string]interface{}{})
+
+	result, err := f.endpoints.CallEndpoint(endpoint, request)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting pins from service directory: %w", err)
+	}
+
+	if result.Error != nil {
+		if result.Error.Code == -32601 {
+			// the service directory does not support pins
+			return nil, nil
+		}
+		return nil, fmt.Errorf("JSON-RPC error: %s", result.Error.Message)
+	}
+
+	results, _ := result.Result.([]interface{})
+
+	hashes := make(map[string]bool, len(records))
+
+	for _, record := range records {
+		hashes[record.Hash] = true
+	}
 
-				// we integrate the new records
-				return f.integrate(records)
+	var latest *eps.SignedPin
+
+	for _, data := range results {
+
+		pin, err := helpers.ParsePin(data)
+
+		if err != nil {
+			eps.Log.Warningf("Invalid pin from service directory: %v", err)
+			continue
+		}
+
+		if pin.Pin == nil || !hashes[pin.Pin.Hash] || pin.Pin.CreatedAt.After(time.Now().Add(maxPinSkew)) {
+			continue
+		}
+
+		if f.pin != nil && !pin.Pin.CreatedAt.After(f.pin.Pin.CreatedAt.Time) {
+			// older pins cannot overrule the one we've accepted before
+			continue
+		}
+
+		if latest != nil && !pin.Pin.CreatedAt.After(latest.Pin.CreatedAt.Time) {
+			continue
+		}
+
+		if ok, err := helpers.VerifyPinEndorsement(pin, f.entries, f.pinCerts, f.rootCerts, f.intermediateCerts, f.settings.Quorum, false); err != nil {
+			eps.Log.Warningf("Cannot verify pin of record %s: %v", pin.Pin.Hash, err)
+		} else if ok {
+			latest = pin
+		}
+	}
+
+	return latest, nil
+}
+
+// Compares the tip of the given endpoint (from which we've retrieved our
+// records) with the tip of another endpoint, to detect lagging or possibly
+// malicious service directory replicas.
+func (f *APIDirectory) crossCheckTip(source *APIEndpoint) {
+
+	other := f.endpoints.other(source)
+
+	if other == nil {
+		// there is no other endpoint we could check against
+		return
+	}
+
+	otherTip, err := f.tipFrom(other)
+
+	if err != nil {
+		eps.Log.Warningf("Cannot cross-check tip with service directory endpoint '%s': %v", other.URL, err)
+		return
+	}
+
+	f.mutex.Lock()
+	ownTip := f.tipHash()
+	known := false
+	if otherTip != nil {
+		for _, record := range f.records {
+			if record.Hash == otherTip.Hash {
+				known = true
+				break
 			}
 		}
 	}
+	f.mutex.Unlock()
+
+	if otherTip == nil {
+		if ownTip != "" {
+			eps.Log.Warningf("Service directory endpoint '%s' returned an empty tip, it seems to be lagging", other.URL)
+			f.endpoints.markLagging(other, true)
+		}
+		return
+	}
+
+	// we make sure the replica does not simply make up tip hashes
+	if ok, err := helpers.VerifyRecordHash(otherTip); err != nil || !ok {
+		eps.Log.Errorf("Service directory endpoint '%s' returned a tip with an invalid hash, it might be malicious", other.URL)
+		f.endpoints.markFailure(other, fmt.Errorf("invalid tip hash"))
+		return
+	}
+
+	if otherTip.Hash == ownTip {
+		// both replicas agree
+		f.endpoints.markLagging(source, false)
+		f.endpoints.markLagging(other, false)
+		return
+	}
+
+	if known {
+		eps.Log.Warningf("Service directory endpoint '%s' is lagging behind endpoint '%s'", other.URL, source.URL)
+		f.endpoints.markLagging(other, true)
+		f.endpoints.markLagging(source, false)
+		return
+	}
+
+	// the other replica has a tip we don't know, we check if it extends our chain
+	request := jsonrpc.MakeRequest("getRecords", "", map[string]interface{}{"after": ownTip})
+
+	if result, err := f.endpoints.CallEndpoint(other, request); err != nil {
+		eps.Log.Warningf("Cannot cross-check records with service directory endpoint '%s': %v", other.URL, err)
+	} else if result.Error != nil {
+		eps.Log.Warningf("Cannot cross-check records with service directory endpoint '%s': %s", other.URL, result.Error.Message)
+	} else if records, ok := result.Result.([]interface{}); ok && len(records) > 0 {
+		if firstRecord, ok := records[0].(map[string]interface{}); ok && firstRecord["parent_hash"] == ownTip && ownTip != "" {
+			eps.Log.Warningf("Service directory endpoint '%s' is lagging behind endpoint '%s'", source.URL, other.URL)
+			f.endpoints.markLagging(source, true)
+			f.endpoints.markLagging(other, false)
+			// we make sure the next query fetches the missing records
+			f.mutex.Lock()
+			f.lastUpdate = time.Time{}
+			f.mutex.Unlock()
+			return
+		}
+	}
+
+	eps.Log.Errorf("Service directory endpoints '%s' and '%s' diverged (tips '%s' and '%s'), one of them might be malicious", source.URL, other.URL, ownTip, otherTip.Hash)
 }
@@ -0,0 +1,372 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+The API directory can persist the verified change records it received from the
+service directory in a local datastore. This makes it possible to start the
+EPS server even if the service directory is unreachable. New records are
+appended to the datastore. Whenever the root of the chain changes or we start
+from a new checkpoint (and when the datastore contains too many outdated
+entries) we compact it, so that it only contains the checkpoint and the records
+after it. Datastores that cannot be compacted receive a reset entry instead.
+*/
+
+package directories
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/datastores"
+	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/kiprotect/go-helpers/forms"
+	"time"
+)
+
+const (
+	CachedRecordEntry     uint8 = 1
+	CachedSyncEntry       uint8 = 2
+	CachedResetEntry      uint8 = 3
+	CachedCheckpointEntry uint8 = 4
+)
+
+var APIDirectoryCacheSettingsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "datastore",
+			Validators: []forms.Validator{
+				forms.IsStringMap{
+					Form: &epsForms.DatastoreForm,
+				},
+			},
+		},
+		{
+			// maximum age (in seconds) of the cached data, 0 means unlimited
+			Name: "max_staleness",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 60 * 60 * 24 * 7},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    0,
+				},
+			},
+		},
+	},
+}
+
+type APIDirectoryCacheSettings struct {
+	Datastore    *eps.DatastoreSettings `json:"datastore"`
+	MaxStaleness int64                  `json:"max_staleness"`
+}
+
+// the datastore definitions that can be used for the cache
+var CacheDefinitions = &eps.Definitions{
+	DatastoreDefinitions: datastores.Definitions,
+}
+
+// we compact the cache once it contains more than twice the number of entries
+// required to store the current chain plus this margin
+const cacheCompactionMargin = 100
+
+type CacheSync struct {
+	SyncedAt time.Time `json:"synced_at"`
+	Tip      string    `json:"tip"`
+}
+
+func (f *APIDirectory) maxStaleness() time.Duration {
+	if f.settings.Cache == nil {
+		return 0
+	}
+	return time.Duration(f.settings.Cache.MaxStaleness) * time.Second
+}
+
+// Returns true if the cached data is too old to be used
+func (f *APIDirectory) isStale(syncedAt time.Time) bool {
+	maxStaleness := f.maxStaleness()
+	return maxStaleness > 0 && time.Since(syncedAt) > maxStaleness
+}
+
+// we write sync entries regularly even if no records changed, but not on
+// every update as the datastore is append-only
+func (f *APIDirectory) syncInterval() time.Duration {
+	interval := time.Hour
+	if maxStaleness := f.maxStaleness(); maxStaleness > 0 && maxStaleness/10 < interval {
+		interval = maxStaleness / 10
+	}
+	return interval
+}
+
+func (f *APIDirectory) initCache() error {
+
+	if f.settings.Cache == nil {
+		return nil
+	}
+
+	dataStore, err := helpers.InitializeDatastore(f.settings.Cache.Datastore, CacheDefinitions)
+
+	if err != nil {
+		return fmt.Errorf("error initializing API directory cache: %w", err)
+	}
+
+	if err := dataStore.Init(); err != nil {
+		return fmt.Errorf("error initializing API directory cache: %w", err)
+	}
+
+	f.cache = dataStore
+
+	return f.loadCache()
+}
+
+// Loads and verifies the records from the cache
+func (f *APIDirectory) loadCache() error {
+
+	dataEntries, err := f.cache.Read()
+
+	if err != nil {
+		return fmt.Errorf("error reading API directory cache: %w", err)
+	}
+
+	records := make([]*eps.SignedChangeRecord, 0)
+	var checkpoint *eps.SignedCheckpoint
+	var syncedAt time.Time
+
+	for _, dataEntry := range dataEntries {
+		switch dataEntry.Type {
+		case CachedRecordEntry:
+			record := &eps.SignedChangeRecord{}
+			if err := json.Unmarshal(dataEntry.Data, record); err != nil {
+				return fmt.Errorf("invalid cached record: %w", err)
+			}
+			records = append(records, record)
+		case CachedSyncEntry:
+			sync := &CacheSync{}
+			if err := json.Unmarshal(dataEntry.Data, sync); err != nil {
+				return fmt.Errorf("invalid cache sync entry: %w", err)
+			}
+			syncedAt = sync.SyncedAt
+		case CachedCheckpointEntry:
+			checkpoint = &eps.SignedCheckpoint{}
+			if err := json.Unmarshal(dataEntry.Data, checkpoint); err != nil {
+				return fmt.Errorf("invalid cached checkpoint: %w", err)
+			}
+		case CachedResetEntry:
+			records = make([]*eps.SignedChangeRecord, 0)
+			checkpoint = nil
+		default:
+			return fmt.Errorf("unknown cache entry type: %d", dataEntry.Type)
+		}
+	}
+
+	f.cacheSize = len(dataEntries)
+
+	// the cache will be rewritten with the next successful update
+	f.cacheDirty = true
+
+	if len(records) == 0 && checkpoint == nil {
+		return nil
+	}
+
+	if f.isStale(syncedAt) {
+		eps.Log.Warningf("Cached service directory records are too old (last synced at %v), ignoring them...", syncedAt)
+		return nil
+	}
+
+	// we verify the cached records just like records from the API, as the
+	// cache might have been tampered with
+	entries := map[string]*eps.DirectoryEntry{}
+	parentHash := ""
+	var parentCreatedAt time.Time
+
+	if checkpoint != nil {
+		// we don't have any trusted entries yet (see 'loadCheckpoint')
+		if ok, err := helpers.VerifyCheckpoint(checkpoint, entries, f.rootCerts, f.intermediateCerts, f.settings.Quorum); err != nil {
+			return fmt.Errorf("cannot verify cached checkpoint: %w", err)
+		} else if !ok {
+			return fmt.Errorf("cached checkpoint is not signed by %d admin(s)", f.settings.Quorum)
+		}
+		entries = helpers.CheckpointEntries(checkpoint.Checkpoint)
+		parentHash = checkpoint.Checkpoint.Hash
+		if checkpoint.Checkpoint.TipCreatedAt != nil {
+			parentCreatedAt = checkpoint.Checkpoint.TipCreatedAt.Time
+		}
+	}
+
+	for _, record := range records {
+		if record.ParentHash != parentHash {
+			return fmt.Errorf("cached records do not form a chain")
+		}
+		parentHash = record.Hash
+	}
+
+	if f.settings.PinnedRoot != "" {
+		root := ""
+		if checkpoint != nil {
+			root = checkpoint.Checkpoint.Root
+		} else {
+			root = records[0].Hash
+		}
+		if root != f.settings.PinnedRoot {
+			return fmt.Errorf("cached records do not belong to the pinned root")
+		}
+	}
+
+	entries, err = helpers.VerifyAndIntegrateRecords(records, entries, parentCreatedAt, f.rootCerts, f.intermediateCerts, f.settings.Quorum)
+
+	if err != nil {
+		return fmt.Errorf("cannot verify cached service directory records: %w", err)
+	}
+
+	f.records = records
+	f.checkpoint = checkpoint
+	f.entries = entries
+	f.lastSync = syncedAt
+	f.cacheDirty = false
+	f.lastCacheSync = syncedAt
+
+	eps.Log.Infof("Loaded %d service directory records from cache (last synced at %v)", len(records), syncedAt)
+
+	return nil
+}
+
+func makeCacheEntry(entryType uint8, data interface{}) (*eps.DataEntry, error) {
+
+	rawData, err := json.Marshal(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := helpers.RandomID(16)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &eps.DataEntry{
+		Type: entryType,
+		ID:   id,
+		Data: rawData,
+	}, nil
+}
+
+func (f *APIDirectory) writeCacheEntry(entryType uint8, data interface{}) error {
+
+	entry, err := makeCacheEntry(entryType, data)
+
+	if err != nil {
+		return err
+	}
+
+	if err := f.cache.Write(entry); err != nil {
+		return err
+	}
+
+	f.cacheSize++
+
+	return nil
+}
+
+// Replaces the contents of the cache with our checkpoint, our records and a
+// sync entry
+func (f *APIDirectory) compactCache(cache eps.CompactableDatastore) error {
+
+	entries := make([]*eps.DataEntry, 0, len(f.records)+2)
+
+	add := func(entryType uint8, data interface{}) error {
+		if entry, err := makeCacheEntry(entryType, data); err != nil {
+			return err
+		} else {
+			entries = append(entries, entry)
+			return nil
+		}
+	}
+
+	if f.checkpoint != nil {
+		if err := add(CachedCheckpointEntry, f.checkpoint); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range f.records {
+		if err := add(CachedRecordEntry, record); err != nil {
+			return err
+		}
+	}
+
+	if err := add(CachedSyncEntry, &CacheSync{SyncedAt: f.lastSync, Tip: f.tipHash()}); err != nil {
+		return err
+	}
+
+	if err := cache.Compact(entries); err != nil {
+		return err
+	}
+
+	eps.Log.Debugf("Compacted API directory cache from %d to %d entries", f.cacheSize, len(entries))
+
+	f.cacheSize = len(entries)
+	f.cacheDirty = false
+	f.lastCacheSync = f.lastSync
+
+	return nil
+}
+
+// Writes newly received records to the cache. If the cache does not contain
+// the current chain (e.g. because the root changed) we write the full chain.
+func (f *APIDirectory) updateCache(newRecords []*eps.SignedChangeRecord, reset bool) error {
+
+	if f.cache == nil {
+		return nil
+	}
+
+	if cache, ok := f.cache.(eps.CompactableDatastore); ok {
+		if reset || f.cacheDirty || f.cacheSize > 2*(len(f.records)+2)+cacheCompactionMargin {
+			return f.compactCache(cache)
+		}
+	} else if reset || f.cacheDirty {
+		if err := f.writeCacheEntry(CachedResetEntry, map[string]interface{}{}); err != nil {
+			return err
+		}
+		if f.checkpoint != nil {
+			// our records start at the checkpoint
+			if err := f.writeCacheEntry(CachedCheckpointEntry, f.checkpoint); err != nil {
+				return err
+			}
+		}
+		newRecords = f.records
+	}
+
+	for _, record := range newRecords {
+		if err := f.writeCacheEntry(CachedRecordEntry, record); err != nil {
+			return err
+		}
+	}
+
+	f.cacheDirty = false
+
+	if len(newRecords) == 0 && time.Since(f.lastCacheSync) < f.syncInterval() {
+		return nil
+	}
+
+	tip := f.tipHash()
+
+	f.lastCacheSync = f.lastSync
+
+	return f.writeCacheEntry(CachedSyncEntry, &CacheSync{
+		SyncedAt: f.lastSync,
+		Tip:      tip,
+	})
+}
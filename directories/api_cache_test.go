@@ -0,0 +1,152 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package directories
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/datastores"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheCompaction(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "cache")
+
+	openCache := func() eps.Datastore {
+		cache, err := datastores.MakeFile(datastores.FileSettings{Filename: filename})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+
+	cacheSize := func() int {
+		if entries, err := openCache().Read(); err != nil {
+			t.Fatal(err)
+			return 0
+		} else {
+			return len(entries)
+		}
+	}
+
+	directory := &APIDirectory{
+		cache:    openCache(),
+		settings: APIDirectorySettings{Cache: &APIDirectoryCacheSettings{MaxStaleness: 60}},
+		records:  []*eps.SignedChangeRecord{},
+	}
+
+	parentHash := ""
+
+	addRecord := func(reset bool) {
+		record := &eps.SignedChangeRecord{
+			Hash:       fmt.Sprintf("%064d", len(directory.records)),
+			ParentHash: parentHash,
+		}
+		parentHash = record.Hash
+		if reset {
+			directory.records = []*eps.SignedChangeRecord{}
+		}
+		directory.records = append(directory.records, record)
+		directory.lastSync = time.Now()
+		if err := directory.updateCache([]*eps.SignedChangeRecord{record}, reset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		addRecord(false)
+	}
+
+	// the records were appended, each of them followed by a sync entry
+	if size := cacheSize(); size != 20 {
+		t.Fatalf("expected 20 cache entries, got %d", size)
+	}
+
+	// a new root replaces the cached chain
+	parentHash = ""
+	addRecord(true)
+
+	if size := cacheSize(); size != 2 {
+		t.Fatalf("expected 2 cache entries after a reset, got %d", size)
+	}
+
+	// outdated sync entries are removed eventually
+	for i := 0; i < 200; i++ {
+		addRecord(false)
+	}
+
+	if size := cacheSize(); size > 2*(len(directory.records)+2)+cacheCompactionMargin {
+		t.Fatalf("expected the cache to be compacted, got %d entries for %d records", size, len(directory.records))
+	}
+}
+
+func TestCachePinnedRoot(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "cache")
+
+	ca := makeTestCA(t)
+	records := ca.makeChain(t, 3, time.Now().Add(-time.Hour))
+	otherRecords := ca.makeChain(t, 3, time.Now().Add(-time.Hour))
+	sd := &testServiceDirectory{}
+	sd.set(records, nil)
+
+	withCache := func(directory *APIDirectory) *APIDirectory {
+		cache, err := datastores.MakeFile(datastores.FileSettings{Filename: filename})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Init(); err != nil {
+			t.Fatal(err)
+		}
+		directory.cache = cache
+		directory.settings.Cache = &APIDirectoryCacheSettings{MaxStaleness: 60}
+		return directory
+	}
+
+	// we fill the cache
+	if err := forceUpdate(withCache(makeTestAPIDirectory(t, ca, sd))); err != nil {
+		t.Fatal(err)
+	}
+
+	directory := withCache(makeTestAPIDirectory(t, ca, sd))
+	directory.settings.PinnedRoot = otherRecords[0].Hash
+
+	if err := directory.loadCache(); err == nil {
+		t.Fatalf("expected cached records with another root to be rejected")
+	}
+
+	if directory.tipHash() != "" {
+		t.Fatalf("expected the directory to be empty")
+	}
+
+	directory = withCache(makeTestAPIDirectory(t, ca, sd))
+	directory.settings.PinnedRoot = records[0].Hash
+
+	if err := directory.loadCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.tipHash() != records[2].Hash {
+		t.Fatalf("expected the cached records to be loaded")
+	}
+}
@@ -0,0 +1,212 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package directories
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/jsonrpc"
+	"sync"
+	"time"
+)
+
+// A single service directory endpoint, together with its health information
+type APIEndpoint struct {
+	URL          string
+	ServerName   string
+	client       *jsonrpc.Client
+	failures     int
+	lastError    error
+	lastSuccess  time.Time
+	backoffUntil time.Time
+	lagging      bool
+}
+
+// A list of service directory endpoints, from which we pick endpoints
+// based on the configured strategy and on their health
+type APIEndpoints struct {
+	endpoints  []*APIEndpoint
+	strategy   string
+	maxBackoff time.Duration
+	next       int
+	mutex      sync.Mutex
+}
+
+func MakeAPIEndpoints(settings *APIDirectorySettings) (*APIEndpoints, error) {
+
+	if len(settings.Endpoints) == 0 {
+		return nil, fmt.Errorf("at least one service directory endpoint is required")
+	}
+
+	if len(settings.ServerNames) > 0 && len(settings.ServerNames) != len(settings.Endpoints) {
+		return nil, fmt.Errorf("number of server names (%d) does not match number of endpoints (%d)", len(settings.ServerNames), len(settings.Endpoints))
+	}
+
+	endpoints := &APIEndpoints{
+		endpoints:  make([]*APIEndpoint, len(settings.Endpoints)),
+		strategy:   settings.Strategy,
+		maxBackoff: time.Duration(settings.MaxBackoff) * time.Second,
+	}
+
+	for i, url := range settings.Endpoints {
+
+		// every endpoint gets its own copy of the client settings, so
+		// that we can use different endpoints concurrently
+		clientSettings := *settings.JSONRPCClient
+		clientSettings.Endpoint = url
+
+		var serverName string
+
+		if len(settings.ServerNames) > 0 {
+			serverName = settings.ServerNames[i]
+			if clientSettings.TLS != nil {
+				tlsSettings := *clientSettings.TLS
+				tlsSettings.ServerName = serverName
+				clientSettings.TLS = &tlsSettings
+			}
+		}
+
+		endpoints.endpoints[i] = &APIEndpoint{
+			URL:        url,
+			ServerName: serverName,
+			client:     jsonrpc.MakeClient(&clientSettings),
+		}
+	}
+
+	return endpoints, nil
+}
+
+// Returns the endpoints in the order in which they should be tried and
+// advances the round robin cursor, so that the next request starts with a
+// different endpoint.
+func (e *APIEndpoints) candidates() []*APIEndpoint {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	candidates := e.ordered()
+
+	if e.strategy == "round_robin" {
+		e.next = (e.next + 1) % len(e.endpoints)
+	}
+
+	return candidates
+}
+
+// Returns the endpoints in the order in which they should be tried, without
+// advancing the round robin cursor. Healthy endpoints come first, followed by
+// lagging ones and finally by endpoints that are currently backing off after
+// a failure. The caller needs to hold the mutex.
+func (e *APIEndpoints) ordered() []*APIEndpoint {
+
+	n := len(e.endpoints)
+	start := 0
+
+	if e.strategy == "round_robin" {
+		start = e.next % n
+	}
+
+	now := time.Now()
+	healthy := make([]*APIEndpoint, 0, n)
+	lagging := make([]*APIEndpoint, 0)
+	backingOff := make([]*APIEndpoint, 0)
+
+	for i := 0; i < n; i++ {
+		endpoint := e.endpoints[(start+i)%n]
+		if endpoint.backoffUntil.After(now) {
+			backingOff = append(backingOff, endpoint)
+		} else if endpoint.lagging {
+			lagging = append(lagging, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+
+	return append(append(healthy, lagging...), backingOff...)
+}
+
+// Returns a healthy endpoint other than the given one (if one exists). This
+// does not affect the round robin rotation.
+func (e *APIEndpoints) other(endpoint *APIEndpoint) *APIEndpoint {
+
+	e.mutex.Lock()
+	candidates := e.ordered()
+	e.mutex.Unlock()
+
+	for _, candidate := range candidates {
+		if candidate != endpoint {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (e *APIEndpoints) markSuccess(endpoint *APIEndpoint) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	endpoint.failures = 0
+	endpoint.lastError = nil
+	endpoint.lastSuccess = time.Now()
+	endpoint.backoffUntil = time.Time{}
+}
+
+func (e *APIEndpoints) markFailure(endpoint *APIEndpoint, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	endpoint.failures++
+	endpoint.lastError = err
+	// we back off exponentially, starting with one second
+	backoff := time.Second << uint(endpoint.failures-1)
+	if backoff > e.maxBackoff || backoff <= 0 {
+		backoff = e.maxBackoff
+	}
+	endpoint.backoffUntil = time.Now().Add(backoff)
+	eps.Log.Warningf("Service directory endpoint '%s' failed %d time(s), backing off for %v: %v", endpoint.URL, endpoint.failures, backoff, err)
+}
+
+func (e *APIEndpoints) markLagging(endpoint *APIEndpoint, lagging bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	endpoint.lagging = lagging
+}
+
+// Performs a JSON-RPC call, trying all endpoints until one of them responds.
+// JSON-RPC errors are returned as part of the response and do not cause a
+// failover, as they are usually not specific to a given endpoint.
+func (e *APIEndpoints) Call(request *jsonrpc.Request) (*jsonrpc.Response, *APIEndpoint, error) {
+	var lastErr error
+	for _, endpoint := range e.candidates() {
+		if response, err := e.CallEndpoint(endpoint, request); err != nil {
+			lastErr = err
+			continue
+		} else {
+			return response, endpoint, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("all service directory endpoints failed, last error: %w", lastErr)
+}
+
+// Performs a JSON-RPC call on a specific endpoint
+func (e *APIEndpoints) CallEndpoint(endpoint *APIEndpoint, request *jsonrpc.Request) (*jsonrpc.Response, error) {
+	if response, err := endpoint.client.Call(request); err != nil {
+		e.markFailure(endpoint, err)
+		return nil, err
+	} else {
+		e.markSuccess(endpoint)
+		return response, nil
+	}
+}
@@ -0,0 +1,48 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package directories
+
+import (
+	"testing"
+)
+
+func TestRoundRobinRotation(t *testing.T) {
+
+	endpoints := &APIEndpoints{
+		endpoints: []*APIEndpoint{{URL: "a"}, {URL: "b"}, {URL: "c"}},
+		strategy:  "round_robin",
+	}
+
+	first := endpoints.candidates()[0]
+
+	// picking a failover endpoint must not skip endpoints in the rotation
+	if other := endpoints.other(first); other == nil || other == first {
+		t.Fatalf("expected another endpoint than '%s'", first.URL)
+	}
+
+	endpoints.other(first)
+
+	for _, expected := range []string{"b", "c", "a"} {
+		if endpoint := endpoints.candidates()[0]; endpoint.URL != expected {
+			t.Fatalf("expected endpoint '%s', got '%s'", expected, endpoint.URL)
+		}
+	}
+
+	if first.URL != "a" {
+		t.Fatalf("expected the rotation to start with endpoint 'a', got '%s'", first.URL)
+	}
+}
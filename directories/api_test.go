@@ -0,0 +1,444 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package directories
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/iris-connect/eps/jsonrpc"
+	th "github.com/iris-connect/eps/testing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal service directory that serves records and a checkpoint
+type testServiceDirectory struct {
+	records    []*eps.SignedChangeRecord
+	checkpoint *eps.SignedCheckpoint
+	pins       []*eps.SignedPin
+	mutex      sync.Mutex
+}
+
+func (s *testServiceDirectory) set(records []*eps.SignedChangeRecord, checkpoint *eps.SignedCheckpoint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+	s.checkpoint = checkpoint
+}
+
+func (s *testServiceDirectory) setPins(pins []*eps.SignedPin) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pins = pins
+}
+
+func (s *testServiceDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	request := &jsonrpc.Request{}
+
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	response := &jsonrpc.Response{JSONRPC: "2.0", ID: request.ID}
+
+	switch request.Method {
+	case "getCheckpoint":
+		if s.checkpoint != nil {
+			response.Result = s.checkpoint
+		}
+	case "getRecords":
+		// like the service directory, we return all records if we don't
+		// know the given hash
+		records := s.records
+		for i, record := range s.records {
+			if record.Hash == request.Params["after"] {
+				records = s.records[i+1:]
+			}
+		}
+		response.Result = records
+	case "getPins":
+		response.Result = s.pins
+	default:
+		response.Error = jsonrpc.MakeError(-32601, "method not found", nil)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+type testCA struct {
+	root      *th.Signer
+	admin     *th.Signer
+	operator  *th.Signer
+	pinKey    *th.Signer
+	rootCerts []*x509.Certificate
+}
+
+func makeTestCA(t *testing.T) *testCA {
+
+	ca := &testCA{}
+	var err error
+
+	if ca.root, err = th.MakeCertificate(1, "root", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.admin, err = th.MakeCertificate(2, "sd-1", []string{"sd-admin"}, ca.root); err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.operator, err = th.MakeCertificate(3, "hd-1", nil, ca.root); err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.pinKey, err = th.MakeCertificate(4, "pin", nil, ca.root); err != nil {
+		t.Fatal(err)
+	}
+
+	ca.rootCerts = []*x509.Certificate{ca.root.Certificate}
+
+	return ca
+}
+
+// Creates a chain of records signed by the admin, with the root record
+// created at the given time
+func (ca *testCA) makeChain(t *testing.T, length int, createdAt time.Time) []*eps.SignedChangeRecord {
+
+	records := make([]*eps.SignedChangeRecord, 0, length)
+	parentHash := ""
+
+	for i := 0; i < length; i++ {
+		record, err := th.SignRecord(ca.admin, parentHash, &eps.ChangeRecord{
+			Name:      "hd-1",
+			Section:   "groups",
+			Data:      []string{"health-departments"},
+			CreatedAt: eps.HashableTime{Time: createdAt.Add(time.Duration(i) * time.Second).UTC()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+		parentHash = record.Hash
+	}
+
+	return records
+}
+
+// Creates a checkpoint for the first 'length' records of the chain
+func (ca *testCA) makeCheckpoint(t *testing.T, records []*eps.SignedChangeRecord, length int, signer *th.Signer) *eps.SignedCheckpoint {
+
+	entries, err := helpers.VerifyAndIntegrateRecords(records[:length], map[string]*eps.DirectoryEntry{}, time.Time{}, ca.rootCerts, nil, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := helpers.SignCheckpoint(helpers.MakeCheckpoint(records[0], records[length-1], length, entries), signer.Key, signer.Certificate)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return checkpoint
+}
+
+func makeTestAPIDirectory(t *testing.T, ca *testCA, sd *testServiceDirectory) *APIDirectory {
+
+	server := httptest.NewServer(sd)
+
+	t.Cleanup(server.Close)
+
+	settings := APIDirectorySettings{
+		Endpoints:      []string{server.URL},
+		JSONRPCClient:  &jsonrpc.JSONRPCClientSettings{},
+		MaxBackoff:     1,
+		UseCheckpoints: true,
+		Quorum:         1,
+	}
+
+	endpoints, err := MakeAPIEndpoints(&settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &APIDirectory{
+		BaseDirectory: eps.BaseDirectory{Name_: "hd-1"},
+		endpoints:     endpoints,
+		entries:       make(map[string]*eps.DirectoryEntry),
+		records:       []*eps.SignedChangeRecord{},
+		rootCerts:     ca.rootCerts,
+		settings:      settings,
+	}
+}
+
+// performs an update right away, regardless of when the last one happened
+func forceUpdate(directory *APIDirectory) error {
+	directory.lastUpdate = time.Time{}
+	return directory.update()
+}
+
+func TestCheckpointSync(t *testing.T) {
+
+	ca := makeTestCA(t)
+	records := ca.makeChain(t, 5, time.Now().Add(-time.Hour))
+	sd := &testServiceDirectory{}
+	sd.set(records, ca.makeCheckpoint(t, records, 3, ca.admin))
+
+	directory := makeTestAPIDirectory(t, ca, sd)
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.checkpoint == nil {
+		t.Fatalf("expected the directory to start from the checkpoint")
+	}
+
+	// we only fetch and verify the records after the checkpoint
+	if len(directory.records) != 2 || directory.tipHash() != records[4].Hash {
+		t.Fatalf("expected the two records after the checkpoint, got %d", len(directory.records))
+	}
+
+	if entry, err := directory.EntryFor("hd-1"); err != nil || entry == nil {
+		t.Fatalf("expected an entry for 'hd-1': %v", err)
+	}
+}
+
+func TestInvalidCheckpoint(t *testing.T) {
+
+	ca := makeTestCA(t)
+	records := ca.makeChain(t, 5, time.Now().Add(-time.Hour))
+	sd := &testServiceDirectory{}
+
+	// only admins may sign checkpoints
+	sd.set(records, ca.makeCheckpoint(t, records, 3, ca.operator))
+
+	directory := makeTestAPIDirectory(t, ca, sd)
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.checkpoint != nil {
+		t.Fatalf("expected the checkpoint to be rejected")
+	}
+
+	// we verify all records instead
+	if len(directory.records) != 5 {
+		t.Fatalf("expected all records to be loaded, got %d", len(directory.records))
+	}
+
+	// checkpoints with modified entries are rejected as well
+	checkpoint := ca.makeCheckpoint(t, records, 3, ca.admin)
+	checkpoint.Checkpoint.Entries = checkpoint.Checkpoint.Entries[:0]
+	sd.set(records, checkpoint)
+
+	directory = makeTestAPIDirectory(t, ca, sd)
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.checkpoint != nil {
+		t.Fatalf("expected the modified checkpoint to be rejected")
+	}
+}
+
+func TestOutdatedRootAfterCheckpoint(t *testing.T) {
+
+	ca := makeTestCA(t)
+	oldRecords := ca.makeChain(t, 3, time.Now().Add(-2*time.Hour))
+	records := ca.makeChain(t, 5, time.Now().Add(-time.Hour))
+	sd := &testServiceDirectory{}
+	sd.set(records, ca.makeCheckpoint(t, records, 5, ca.admin))
+
+	directory := makeTestAPIDirectory(t, ca, sd)
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.checkpoint == nil || len(directory.records) != 0 {
+		t.Fatalf("expected the directory to start from the checkpoint at the tip")
+	}
+
+	// the server replays an older chain
+	sd.set(oldRecords, nil)
+
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected the outdated chain to be rejected")
+	}
+
+	if directory.tipHash() != records[4].Hash {
+		t.Fatalf("expected the directory to keep its chain")
+	}
+
+	// the server serves our chain again
+	sd.set(records, nil)
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.tipHash() != records[4].Hash {
+		t.Fatalf("expected the directory to keep its chain")
+	}
+}
+
+func TestCheckpointQuorum(t *testing.T) {
+
+	ca := makeTestCA(t)
+	records := ca.makeChain(t, 3, time.Now().Add(-time.Hour))
+	sd := &testServiceDirectory{}
+	sd.set(records, ca.makeCheckpoint(t, records, 3, ca.admin))
+
+	directory := makeTestAPIDirectory(t, ca, sd)
+	directory.settings.Quorum = 2
+
+	// a single admin must not be able to bypass the quorum via a checkpoint
+	if err := directory.loadCheckpoint(); err == nil {
+		t.Fatalf("expected a checkpoint with a single signature to be rejected")
+	}
+
+	if directory.checkpoint != nil {
+		t.Fatalf("expected the directory not to use the checkpoint")
+	}
+}
+
+func TestChainSwitchRequiresPin(t *testing.T) {
+
+	ca := makeTestCA(t)
+	records := ca.makeChain(t, 3, time.Now().Add(-2*time.Hour))
+	newRecords := ca.makeChain(t, 2, time.Now().Add(-time.Hour))
+	sd := &testServiceDirectory{}
+	sd.set(records, nil)
+
+	directory := makeTestAPIDirectory(t, ca, sd)
+
+	// the initial sync does not require a pin
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server switches to a newer chain that was not pinned
+	sd.set(newRecords, nil)
+
+	refused := testutil.ToFloat64(refusedChainSwitches)
+
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected the chain without a pin to be rejected")
+	}
+
+	if directory.tipHash() != records[2].Hash {
+		t.Fatalf("expected the directory to keep its chain")
+	}
+
+	if testutil.ToFloat64(refusedChainSwitches) != refused+1 {
+		t.Fatalf("expected the refused chain switch to be counted")
+	}
+
+	// pins signed by operators are not sufficient
+	makePin := func(signer *th.Signer, hash string) *eps.SignedPin {
+		pin, err := helpers.SignPin(&eps.Pin{
+			Hash:      hash,
+			CreatedAt: eps.HashableTime{Time: time.Now().UTC()},
+		}, signer.Key, signer.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pin
+	}
+
+	sd.setPins([]*eps.SignedPin{makePin(ca.operator, newRecords[0].Hash)})
+
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected the chain with an operator pin to be rejected")
+	}
+
+	// pins of records that are not in the new chain are not sufficient either
+	sd.setPins([]*eps.SignedPin{makePin(ca.admin, records[0].Hash)})
+
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected the chain with a pin of another chain to be rejected")
+	}
+
+	// with a quorum of one, a single (possibly stolen) admin key must not be
+	// sufficient to switch to another chain
+	sd.setPins([]*eps.SignedPin{makePin(ca.admin, newRecords[0].Hash)})
+
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected the chain with an admin pin to be rejected")
+	}
+
+	directory.pinCerts = []*x509.Certificate{ca.pinKey.Certificate}
+
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected the chain with an admin pin to be rejected")
+	}
+
+	sd.setPins([]*eps.SignedPin{makePin(ca.pinKey, newRecords[0].Hash)})
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.tipHash() != newRecords[1].Hash || len(directory.records) != 2 {
+		t.Fatalf("expected the directory to adopt the pinned chain")
+	}
+}
+
+func TestPinnedRoot(t *testing.T) {
+
+	ca := makeTestCA(t)
+	records := ca.makeChain(t, 3, time.Now().Add(-time.Hour))
+	otherRecords := ca.makeChain(t, 3, time.Now().Add(-2*time.Hour))
+	sd := &testServiceDirectory{}
+	sd.set(otherRecords, ca.makeCheckpoint(t, otherRecords, 3, ca.admin))
+
+	directory := makeTestAPIDirectory(t, ca, sd)
+	directory.settings.PinnedRoot = records[0].Hash
+
+	// neither the checkpoint nor the records of another chain are accepted
+	if err := forceUpdate(directory); err == nil {
+		t.Fatalf("expected a chain with another root to be rejected")
+	}
+
+	if directory.tipHash() != "" {
+		t.Fatalf("expected the directory to be empty")
+	}
+
+	sd.set(records, ca.makeCheckpoint(t, records, 2, ca.admin))
+
+	if err := forceUpdate(directory); err != nil {
+		t.Fatal(err)
+	}
+
+	if directory.checkpoint == nil || directory.tipHash() != records[2].Hash {
+		t.Fatalf("expected the directory to adopt the pinned chain")
+	}
+}
@@ -14,13 +14,18 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-// The JSON directory loads the service directory from a single JSON file.
-// This is just for testing, for production use please use the "file" directory
-// which provides support for signed service directory records.
+// The JSON directory loads the service directory from a JSON file or from a
+// directory containing JSON files. Parsed entries are cached and only reloaded
+// if the files change (we check their modification times and sizes). If
+// "signed" is set, the files must contain signed change records, which we
+// verify just like the API directory does. This makes the JSON directory
+// suitable for air-gapped setups where the signed records are distributed
+// manually (e.g. using the "sd sign-records" command).
 
 package directories
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/iris-connect/eps"
@@ -32,6 +37,7 @@ import (
 	"path"
 	"regexp"
 	"sync"
+	"time"
 )
 
 var JSONDirectorySettingsForm = forms.Form{
@@ -42,6 +48,60 @@ var JSONDirectorySettingsForm = forms.Form{
 				forms.IsString{},
 			},
 		},
+		{
+			// minimum time (in seconds) between two checks for changed files
+			Name: "check_interval",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 1},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    0,
+					HasMax: true,
+					Max:    3600,
+				},
+			},
+		},
+		{
+			// required number of admin signatures (for signed files only)
+			Name: "quorum",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 1},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+				},
+			},
+		},
+		{
+			// whether the files contain signed change records
+			Name: "signed",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: false},
+				forms.IsBoolean{},
+			},
+		},
+		{
+			Name: "ca_certificate_files",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsString{},
+					},
+				},
+			},
+		},
+		{
+			Name: "ca_intermediate_certificate_files",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsString{},
+					},
+				},
+			},
+		},
 	},
 }
 
@@ -62,20 +122,57 @@ var JSONRecordsForm = forms.Form{
 	},
 }
 
+var JSONSignedRecordsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "records",
+			Validators: []forms.Validator{
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &epsForms.SignedChangeRecordForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
 type JSONDirectorySettings struct {
-	Path string `json:"path"`
+	Path                           string   `json:"path"`
+	CheckInterval                  int64    `json:"check_interval"`
+	Signed                         bool     `json:"signed"`
+	CACertificateFiles             []string `json:"ca_certificate_files"`
+	CAIntermediateCertificateFiles []string `json:"ca_intermediate_certificate_files"`
+	Quorum                         int      `json:"quorum"`
 }
 
 type Records struct {
 	Records []*eps.ChangeRecord `json:"records"`
 }
 
+type SignedRecords struct {
+	Records []*eps.SignedChangeRecord `json:"records"`
+}
+
+// We use the modification time and size of a file to detect changes
+type recordsFileState struct {
+	ModTime time.Time
+	Size    int64
+}
+
 type JSONDirectory struct {
 	eps.BaseDirectory
-	mutex    sync.Mutex
-	settings JSONDirectorySettings
-	records  []*eps.ChangeRecord
-	entries  map[string]*eps.DirectoryEntry
+	eps.DirectoryWatchers
+	mutex             sync.Mutex
+	settings          JSONDirectorySettings
+	rootCerts         []*x509.Certificate
+	intermediateCerts []*x509.Certificate
+	files             map[string]recordsFileState
+	lastCheck         time.Time
+	records           []*eps.SignedChangeRecord
+	entries           map[string]*eps.DirectoryEntry
 }
 
 func JSONDirectorySettingsValidator(settings map[string]interface{}) (interface{}, error) {
@@ -90,57 +187,258 @@ func JSONDirectorySettingsValidator(settings map[string]interface{}) (interface{
 	}
 }
 
+func loadCertificates(certificateFiles []string) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(certificateFiles))
+	for _, certificateFile := range certificateFiles {
+		if cert, err := helpers.LoadCertificate(certificateFile, false); err != nil {
+			return nil, err
+		} else {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
 func MakeJSONDirectory(name string, settings interface{}) (eps.Directory, error) {
+	jsonSettings := settings.(JSONDirectorySettings)
+
 	d := &JSONDirectory{
 		BaseDirectory: eps.BaseDirectory{
 			Name_: name,
 		},
-		settings: settings.(JSONDirectorySettings),
+		settings: jsonSettings,
 	}
 
-	return d, d.load()
+	if jsonSettings.Signed {
+
+		if len(jsonSettings.CACertificateFiles) == 0 {
+			return nil, fmt.Errorf("signed JSON directory requires at least one CA certificate file")
+		}
+
+		var err error
+
+		if d.rootCerts, err = loadCertificates(jsonSettings.CACertificateFiles); err != nil {
+			return nil, fmt.Errorf("error loading JSON directory root certificate: %w", err)
+		}
+
+		if d.intermediateCerts, err = loadCertificates(jsonSettings.CAIntermediateCertificateFiles); err != nil {
+			return nil, fmt.Errorf("error loading JSON directory intermediate certificate: %w", err)
+		}
+	}
+
+	return d, d.update()
 }
 
-func (f *JSONDirectory) load() error {
-	if records, err := loadRecords(f.settings.Path); err != nil {
+// Returns the state of all records files, so that we can detect changes
+func (f *JSONDirectory) filesState() (map[string]recordsFileState, error) {
+	recordsFiles, err := getRecordsPaths(f.settings.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]recordsFileState)
+
+	for _, recordsFile := range recordsFiles {
+		fi, err := os.Stat(recordsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving records file info: %w", err)
+		}
+		files[recordsFile] = recordsFileState{
+			ModTime: fi.ModTime(),
+			Size:    fi.Size(),
+		}
+	}
+
+	return files, nil
+}
+
+func (f *JSONDirectory) changed(files map[string]recordsFileState) bool {
+	if f.files == nil || len(files) != len(f.files) {
+		return true
+	}
+	for name, state := range files {
+		if oldState, ok := f.files[name]; !ok || !oldState.ModTime.Equal(state.ModTime) || oldState.Size != state.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// Reloads the records if the files changed. If the files became invalid we
+// keep using the previously loaded entries, as they might be in the process
+// of being updated.
+func (f *JSONDirectory) update() error {
+
+	if f.entries != nil && time.Since(f.lastCheck) < time.Duration(f.settings.CheckInterval)*time.Second {
+		return nil
+	}
+
+	f.lastCheck = time.Now()
+
+	files, err := f.filesState()
+
+	if err != nil {
+		return f.loadError(err)
+	}
+
+	if !f.changed(files) {
+		return nil
+	}
+
+	if err := f.load(); err != nil {
+		return f.loadError(err)
+	}
+
+	f.files = files
+
+	return nil
+}
+
+func (f *JSONDirectory) loadError(err error) error {
+	if f.entries == nil {
 		return err
-	} else {
-		entries := make(map[string]*eps.DirectoryEntry)
+	}
+	eps.Log.Errorf("Cannot reload JSON directory, using previously loaded entries: %v", err)
+	return nil
+}
+
+func (f *JSONDirectory) load() error {
+
+	var records []*eps.SignedChangeRecord
+	var entries map[string]*eps.DirectoryEntry
+	var err error
 
-		for _, record := range records {
-			entry, ok := entries[record.Name]
-			if !ok {
-				entry = eps.MakeDirectoryEntry()
-				entry.Name = record.Name
+	if f.settings.Signed {
+		records, entries, err = f.loadVerifiedRecords()
+	} else {
+		var changeRecords []*eps.ChangeRecord
+		if changeRecords, err = loadRecords(f.settings.Path); err == nil {
+			records = make([]*eps.SignedChangeRecord, len(changeRecords))
+			for i, changeRecord := range changeRecords {
+				records[i] = &eps.SignedChangeRecord{Record: changeRecord}
 			}
-			if err := helpers.IntegrateChangeRecord(&eps.SignedChangeRecord{Record: record}, entry); err != nil {
-				return err
+			entries, err = integrateRecords(records)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if f.entries != nil {
+		// we notify watchers about changed entries in the background,
+		// as they will usually query the directory
+		go f.Notify(eps.DiffDirectoryEntries(f.entries, entries))
+	}
+
+	f.entries = entries
+	f.records = records
+
+	eps.Log.Tracef("Loaded %d directory entries from %d records...", len(f.entries), len(f.records))
+	return nil
+}
+
+func integrateRecords(records []*eps.SignedChangeRecord) (map[string]*eps.DirectoryEntry, error) {
+
+	entries := make(map[string]*eps.DirectoryEntry)
+
+	for _, record := range records {
+		entry, ok := entries[record.Record.Name]
+		if !ok {
+			entry = eps.MakeDirectoryEntry()
+			entry.Name = record.Record.Name
+		}
+		if err := helpers.IntegrateChangeRecord(record, entry); err != nil {
+			return nil, err
+		}
+		entries[record.Record.Name] = entry
+	}
+
+	return entries, nil
+}
+
+// Loads signed records and verifies them. The records from all files need to
+// form a single chain, with files being read in alphabetical order. If the
+// chain extends the one we loaded before (which is the case if records were
+// added to the files), we only verify the signatures of the new records.
+func (f *JSONDirectory) loadVerifiedRecords() ([]*eps.SignedChangeRecord, map[string]*eps.DirectoryEntry, error) {
+
+	records, err := loadSignedRecords(f.settings.Path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, record := range records {
+		var parentHash string
+		if i > 0 {
+			parentHash = records[i-1].Hash
+		}
+		if record.ParentHash != parentHash {
+			return nil, nil, fmt.Errorf("signed records do not form a chain (record %d)", i)
+		}
+	}
+
+	verified := 0
+
+	if len(f.records) <= len(records) && len(f.records) > 0 && records[len(f.records)-1].Hash == f.records[len(f.records)-1].Hash {
+		// as the records form a chain, they contain our previous records if
+		// their hashes are correct, which is cheaper to check than signatures
+		verified = len(f.records)
+		for i, record := range records[:verified] {
+			if ok, err := helpers.VerifyRecordHash(record); err != nil {
+				return nil, nil, fmt.Errorf("cannot verify hash of record %d: %w", i, err)
+			} else if !ok {
+				return nil, nil, fmt.Errorf("invalid hash found (record %d)", i)
 			}
-			entries[record.Name] = entry
 		}
+	}
 
-		f.entries = entries
-		f.records = records
+	baseEntries := map[string]*eps.DirectoryEntry{}
+	var parentCreatedAt time.Time
 
-		eps.Log.Tracef("Loaded %d directory entries from %d records...", len(f.entries), len(f.records))
-		return nil
+	if verified > 0 {
+		baseEntries = f.entries
+		parentCreatedAt = records[verified-1].Record.CreatedAt.Time
+	}
+
+	entries, err := helpers.VerifyAndIntegrateRecords(records[verified:], baseEntries, parentCreatedAt, f.rootCerts, f.intermediateCerts, f.settings.Quorum)
+
+	if err != nil {
+		return nil, nil, err
 	}
+
+	return records, entries, nil
 }
 
 func (f *JSONDirectory) Entries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
+	return f.queryEntries(query, true)
+}
+
+func (f *JSONDirectory) UnscheduledEntries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
+	return f.queryEntries(query, false)
+}
+
+func (f *JSONDirectory) queryEntries(query *eps.DirectoryQuery, applyScheduled bool) ([]*eps.DirectoryEntry, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	if err := f.load(); err != nil {
+	if err := f.update(); err != nil {
 		return nil, fmt.Errorf("error loading JSON directory: %w", err)
 	}
 
-	entries := make([]*eps.DirectoryEntry, 0)
+	entries := make([]*eps.DirectoryEntry, 0, len(f.entries))
 
 	for _, entry := range f.entries {
 		entries = append(entries, entry)
 	}
 
+	if applyScheduled {
+		// we apply scheduled records that are valid right now
+		entries = helpers.EntriesAt(entries, time.Now())
+	}
+
 	return eps.FilterDirectoryEntriesByQuery(entries, query), nil
 }
 
@@ -176,46 +474,72 @@ func getRecordsFiles(recordsPath string) []string {
 	return paths
 }
 
-func loadRecords(recordsPath string) ([]*eps.ChangeRecord, error) {
-
+// Returns the paths of all records files
+func getRecordsPaths(recordsPath string) ([]string, error) {
 	fi, err := os.Stat(recordsPath)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving records path info: %w", err)
 	}
-	var recordsFiles []string
 	if fi.Mode().IsDir() {
-		recordsFiles = getRecordsFiles(recordsPath)
-	} else {
-		recordsFiles = []string{recordsPath}
+		return getRecordsFiles(recordsPath), nil
 	}
+	return []string{recordsPath}, nil
+}
 
-	allRecords := make([]*eps.ChangeRecord, 0)
+// Reads all records files and validates their content with the given form
+func readRecordsFiles(recordsPath string, form *forms.Form, handler func(params map[string]interface{}) error) error {
+
+	recordsFiles, err := getRecordsPaths(recordsPath)
+
+	if err != nil {
+		return err
+	}
 
 	for _, recordsFile := range recordsFiles {
 		eps.Log.Tracef("Adding records from %v...", recordsFile)
-		if file, err := os.Open(recordsFile); err != nil {
-			return nil, fmt.Errorf("error opening records file '%s': %w", recordsFile, err)
+		if data, err := ioutil.ReadFile(recordsFile); err != nil {
+			return fmt.Errorf("error reading records file '%s': %w", recordsFile, err)
 		} else {
-			if data, err := ioutil.ReadAll(file); err != nil {
-				return nil, fmt.Errorf("error reading records file '%s': %w", recordsFile, err)
-			} else {
-				file.Close()
-				rawRecords := map[string]interface{}{}
-				if err := json.Unmarshal(data, &rawRecords); err != nil {
-					return nil, fmt.Errorf("error parsing JSON from file '%s': %w", recordsFile, err)
-				} else if params, err := JSONRecordsForm.Validate(rawRecords); err != nil {
-					return nil, err
-				} else {
-					records := &Records{}
-					if err := forms.Coerce(records, params); err != nil {
-						// this should not happen if the forms are correct...
-						return nil, err
-					}
-					// records are valid
-					allRecords = append(allRecords, records.Records...)
-				}
+			rawRecords := map[string]interface{}{}
+			if err := json.Unmarshal(data, &rawRecords); err != nil {
+				return fmt.Errorf("error parsing JSON from file '%s': %w", recordsFile, err)
+			} else if params, err := form.Validate(rawRecords); err != nil {
+				return fmt.Errorf("invalid records in file '%s': %w", recordsFile, err)
+			} else if err := handler(params); err != nil {
+				// this should not happen if the forms are correct...
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+func loadRecords(recordsPath string) ([]*eps.ChangeRecord, error) {
+	allRecords := make([]*eps.ChangeRecord, 0)
+	if err := readRecordsFiles(recordsPath, &JSONRecordsForm, func(params map[string]interface{}) error {
+		records := &Records{}
+		if err := forms.Coerce(records, params); err != nil {
+			return err
+		}
+		allRecords = append(allRecords, records.Records...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return allRecords, nil
+}
+
+func loadSignedRecords(recordsPath string) ([]*eps.SignedChangeRecord, error) {
+	allRecords := make([]*eps.SignedChangeRecord, 0)
+	if err := readRecordsFiles(recordsPath, &JSONSignedRecordsForm, func(params map[string]interface{}) error {
+		records := &SignedRecords{}
+		if err := forms.Coerce(records, params); err != nil {
+			return err
+		}
+		allRecords = append(allRecords, records.Records...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 	return allRecords, nil
 }
@@ -17,7 +17,10 @@
 package eps
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -34,9 +37,12 @@ func MakeDirectoryEntry() *DirectoryEntry {
 		Channels:     []*OperatorChannel{},
 		Services:     []*OperatorService{},
 		Certificates: []*OperatorCertificate{},
+		Revocations:  []*OperatorRevocation{},
 		Settings:     []*OperatorSettings{},
 		Records:      []*SignedChangeRecord{},
+		Scheduled:    []*SignedChangeRecord{},
 		Properties:   &OperatorProperties{},
+		Labels:       map[string]string{},
 	}
 }
 
@@ -46,16 +52,54 @@ type DirectoryEntry struct {
 	Channels     []*OperatorChannel     `json:"channels"`
 	Services     []*OperatorService     `json:"services"`
 	Certificates []*OperatorCertificate `json:"certificates"`
+	Revocations  []*OperatorRevocation  `json:"revocations"`
 	Settings     []*OperatorSettings    `json:"settings"`
 	Preferences  []*OperatorPreferences `json:"preferences"`
 	Records      []*SignedChangeRecord  `json:"records"`
+	Scheduled    []*SignedChangeRecord  `json:"scheduled"`
 	Properties   *OperatorProperties    `json:"properties"`
+	Labels       map[string]string      `json:"labels"`
+	// set if the entry was deleted, in which case it only remains as a
+	// tombstone with its records and revocations
+	Deleted bool `json:"deleted,omitempty"`
 }
 
 type OperatorProperties struct {
 	DisplayName string `json:"displayName"`
 }
 
+// Returns the properties as a map, using the JSON names as keys
+func (o *OperatorProperties) AsMap() (map[string]interface{}, error) {
+	var mapData map[string]interface{}
+	if jsonData, err := json.Marshal(o); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonData, &mapData); err != nil {
+		return nil, err
+	}
+	return mapData, nil
+}
+
+// Checks whether the properties contain all of the given values
+func (o *OperatorProperties) Matches(properties map[string]interface{}) bool {
+	if len(properties) == 0 {
+		return true
+	}
+	if o == nil {
+		return false
+	}
+	mapData, err := o.AsMap()
+	if err != nil {
+		Log.Error(err)
+		return false
+	}
+	for key, value := range properties {
+		if propertyValue, ok := mapData[key]; !ok || fmt.Sprint(propertyValue) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
 // preferences may be set by the corresponding operator itself
 type OperatorPreferences struct {
 	Operator    string                 `json:"operator"`
@@ -78,8 +122,29 @@ type OperatorChannel struct {
 }
 
 type OperatorCertificate struct {
+	Fingerprint string     `json:"fingerprint"`
+	KeyUsage    string     `json:"key_usage"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+}
+
+// Checks whether the certificate is valid at the given time. Certificates
+// without validity information are always valid. During a rotation, the old
+// and the new certificate are both valid for an overlap period.
+func (o *OperatorCertificate) ValidAt(t time.Time) bool {
+	if o.NotBefore != nil && t.Before(*o.NotBefore) {
+		return false
+	}
+	if o.NotAfter != nil && t.After(*o.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// revocations may only be added by a directory admin and are permanent
+type OperatorRevocation struct {
 	Fingerprint string `json:"fingerprint"`
-	KeyUsage    string `json:"key_usage"`
+	Reason      string `json:"reason"`
 }
 
 type OperatorService struct {
@@ -114,6 +179,15 @@ type SignedChangeRecord struct {
 	Hash       string        `json:"hash"`
 	Signature  *Signature    `json:"signature"`
 	Record     *ChangeRecord `json:"record"`
+	// co-signatures of further service directory admins, which sign the same
+	// data as the signature (i.e. the record without any signatures)
+	Signatures []*Signature `json:"signatures,omitempty"`
+}
+
+// Change records that still need co-signatures before they can be
+// submitted to a directory that requires a quorum
+type Proposal struct {
+	Records []*SignedChangeRecord `json:"records"`
 }
 
 type Signature struct {
@@ -127,12 +201,115 @@ type SignedData struct {
 	Data      interface{} `json:"data"`
 }
 
+const (
+	ReplaceOp = "replace"
+	DeleteOp  = "delete"
+)
+
 // describes a change in a specific section of the service directory
 type ChangeRecord struct {
-	Name      string       `json:"name"`
-	Section   string       `json:"section"`
+	Name    string `json:"name"`
+	Section string `json:"section"`
+	// the operation, 'replace' (the default) or 'delete'
+	Op        string       `json:"op,omitempty"`
 	Data      interface{}  `json:"data"`
 	CreatedAt HashableTime `json:"created_at"`
+	// optional validity window, evaluated when querying the directory
+	ValidFrom  *HashableTime `json:"valid_from,omitempty"`
+	ValidUntil *HashableTime `json:"valid_until,omitempty"`
+}
+
+// Returns true if the record deletes (parts of) a section or the entry
+func (c *ChangeRecord) IsDelete() bool {
+	return c.Op == DeleteOp
+}
+
+// Returns true if the record has a validity window
+func (c *ChangeRecord) IsScheduled() bool {
+	return c.ValidFrom != nil || c.ValidUntil != nil
+}
+
+// Checks whether the record is valid at the given time. The window includes
+// its start but not its end.
+func (c *ChangeRecord) ValidAt(t time.Time) bool {
+	if c.ValidFrom != nil && t.Before(c.ValidFrom.Time) {
+		return false
+	}
+	if c.ValidUntil != nil && !t.Before(c.ValidUntil.Time) {
+		return false
+	}
+	return true
+}
+
+// a snapshot of all directory entries at a given record, which allows
+// clients to skip verifying the records before it
+type Checkpoint struct {
+	Hash      string            `json:"hash"`
+	Length    int64             `json:"length"`
+	CreatedAt HashableTime      `json:"created_at"`
+	Entries   []*DirectoryEntry `json:"entries"`
+	// the root record of the chain, which allows clients that start from the
+	// checkpoint to detect outdated chains
+	Root          string        `json:"root,omitempty"`
+	RootCreatedAt *HashableTime `json:"root_created_at,omitempty"`
+	// the creation time of the last record, as records after the checkpoint
+	// must not be older (see 'helpers.VerifyRecordTime')
+	TipCreatedAt *HashableTime `json:"tip_created_at,omitempty"`
+}
+
+type SignedCheckpoint struct {
+	Checkpoint *Checkpoint `json:"checkpoint"`
+	Signature  *Signature  `json:"signature"`
+	// co-signatures of other admins, if a quorum of admins is required
+	Signatures []*Signature `json:"signatures,omitempty"`
+}
+
+// marks a record as part of the canonical chain, so that the service
+// directory only adopts chains that contain it
+type Pin struct {
+	Hash      string       `json:"hash"`
+	CreatedAt HashableTime `json:"created_at"`
+}
+
+// a pin signed by one or more service directory admins
+type SignedPin struct {
+	Pin        *Pin         `json:"pin"`
+	Signature  *Signature   `json:"signature"`
+	Signatures []*Signature `json:"signatures,omitempty"`
+}
+
+// a verified chain of records known to the service directory
+type Fork struct {
+	Root      string       `json:"root"`
+	Tip       string       `json:"tip"`
+	Length    int64        `json:"length"`
+	CreatedAt HashableTime `json:"created_at"`
+	// whether the directory currently uses this chain
+	Canonical bool `json:"canonical"`
+	// whether the chain contains the currently pinned record
+	Pinned bool `json:"pinned"`
+}
+
+// the root of a Merkle tree over all directory entries (ordered by name) at
+// a given record, which allows clients to verify individual entries
+type EntriesRoot struct {
+	Hash       string       `json:"hash"`
+	Size       int64        `json:"size"`
+	MerkleRoot string       `json:"merkle_root"`
+	CreatedAt  HashableTime `json:"created_at"`
+}
+
+type SignedEntriesRoot struct {
+	EntriesRoot *EntriesRoot `json:"entries_root"`
+	Signature   *Signature   `json:"signature"`
+}
+
+// an entry together with a proof of its inclusion in a signed entries root
+type EntryProof struct {
+	Entry       *DirectoryEntry    `json:"entry"`
+	Index       int64              `json:"index"`
+	Path        []string           `json:"path"`
+	EntriesRoot *SignedEntriesRoot `json:"entries_root"`
 }
 
 type HashableTime struct {
@@ -145,6 +322,17 @@ func (h HashableTime) HashValue() interface{} {
 	return h.Time.Format(time.RFC3339Nano)
 }
 
+// Returns the revocation for the certificate with the given fingerprint
+// (if it has been revoked)
+func (d *DirectoryEntry) Revocation(fingerprint string) *OperatorRevocation {
+	for _, revocation := range d.Revocations {
+		if revocation.Fingerprint == fingerprint {
+			return revocation
+		}
+	}
+	return nil
+}
+
 func (d *DirectoryEntry) Channel(channelType string) *OperatorChannel {
 	for _, channel := range d.Channels {
 		if channel.Type == channelType {
@@ -154,19 +342,68 @@ func (d *DirectoryEntry) Channel(channelType string) *OperatorChannel {
 	return nil
 }
 
-func (d *DirectoryEntry) SettingsFor(service, operator string) *OperatorSettings {
+// Returns how specifically settings or preferences with the given operator,
+// service and environment apply to the given values, or -1 if they don't
+// apply at all. Empty values apply to everything. An operator match is more
+// specific than a service match, which is more specific than an environment
+// match, so e.g. settings for a given operator always take precedence over
+// settings for a given service.
+func specificity(operator, service, environment, forOperator, forService, forEnvironment string) int {
+	value := 0
+	for _, c := range []struct {
+		value, target string
+		weight        int
+	}{
+		{operator, forOperator, 4},
+		{service, forService, 2},
+		{environment, forEnvironment, 1},
+	} {
+		if c.value == "" {
+			continue
+		}
+		if c.value != c.target {
+			return -1
+		}
+		value += c.weight
+	}
+	return value
+}
+
+// Returns the most specific settings for the given service, operator and
+// environment (if several are equally specific, the first one wins)
+func (d *DirectoryEntry) SettingsFor(service, operator, environment string) *OperatorSettings {
+	var bestSettings *OperatorSettings
+	bestValue := -1
 	for _, settings := range d.Settings {
-		if (settings.Service == service || settings.Service == "") && (settings.Operator == operator || settings.Operator == "") {
-			return settings
+		if value := specificity(settings.Operator, settings.Service, settings.Environment, operator, service, environment); value > bestValue {
+			bestSettings = settings
+			bestValue = value
 		}
 	}
-	return nil
+	return bestSettings
+}
+
+// Returns the most specific preferences for the given service, operator and
+// environment (if several are equally specific, the first one wins)
+func (d *DirectoryEntry) PreferencesFor(service, operator, environment string) *OperatorPreferences {
+	var bestPreferences *OperatorPreferences
+	bestValue := -1
+	for _, preferences := range d.Preferences {
+		if value := specificity(preferences.Operator, preferences.Service, preferences.Environment, operator, service, environment); value > bestValue {
+			bestPreferences = preferences
+			bestValue = value
+		}
+	}
+	return bestPreferences
 }
 
 type DirectoryQuery struct {
-	Group    string   `json:"group"`
-	Operator string   `json:"operator"`
-	Channels []string `json:"channels"`
+	Group      string                 `json:"group"`
+	Operator   string                 `json:"operator"`
+	Channels   []string               `json:"channels"`
+	Service    string                 `json:"service"`
+	Properties map[string]interface{} `json:"properties"`
+	Selector   string                 `json:"selector"`
 }
 
 type DirectoryEntries []*DirectoryEntry
@@ -181,6 +418,96 @@ type Directory interface {
 	Name() string
 }
 
+// describes a change of a directory entry
+type DirectoryEntryChange struct {
+	Name string
+	// the new version of the entry, nil if the entry was removed
+	Entry *DirectoryEntry
+}
+
+// A directory that can notify watchers about changed entries. Watchers
+// receive a list of changes every time the directory gets updated.
+type WatchableDirectory interface {
+	Directory
+	Watch(chan []*DirectoryEntryChange)
+	Unwatch(chan []*DirectoryEntryChange)
+}
+
+// A directory that can return its entries as they are on record, i.e.
+// without applying scheduled records (see 'helpers.EntriesAt'). Changes of
+// the entries need to be based on these, as they replace scheduled records.
+type SchedulingDirectory interface {
+	Directory
+	UnscheduledEntries(*DirectoryQuery) ([]*DirectoryEntry, error)
+}
+
+// A directory that can tell whether its data is up to date, e.g. because it
+// serves cached data while the service directory is unreachable
+type CheckableDirectory interface {
+	Directory
+	CheckFreshness() error
+}
+
+// helper that can be used by directory implementations to manage watchers
+type DirectoryWatchers struct {
+	watchers []chan []*DirectoryEntryChange
+	mutex    sync.Mutex
+}
+
+func (d *DirectoryWatchers) Watch(watcher chan []*DirectoryEntryChange) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.watchers = append(d.watchers, watcher)
+}
+
+func (d *DirectoryWatchers) Unwatch(watcher chan []*DirectoryEntryChange) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	watchers := make([]chan []*DirectoryEntryChange, 0, len(d.watchers))
+	for _, existingWatcher := range d.watchers {
+		if existingWatcher != watcher {
+			watchers = append(watchers, existingWatcher)
+		}
+	}
+	d.watchers = watchers
+}
+
+// Sends the given changes to all watchers. Should not be called while
+// holding a lock that watchers might need to process the changes.
+func (d *DirectoryWatchers) Notify(changes []*DirectoryEntryChange) {
+	if len(changes) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	watchers := d.watchers
+	d.mutex.Unlock()
+	for _, watcher := range watchers {
+		select {
+		case watcher <- changes:
+		case <-time.After(5 * time.Second):
+			Log.Warning("Directory watcher did not accept changes, skipping it...")
+		}
+	}
+}
+
+// Returns the changes between two versions of a set of directory entries
+func DiffDirectoryEntries(oldEntries, newEntries map[string]*DirectoryEntry) []*DirectoryEntryChange {
+	changes := make([]*DirectoryEntryChange, 0)
+	for name, oldEntry := range oldEntries {
+		if newEntry, ok := newEntries[name]; !ok {
+			changes = append(changes, &DirectoryEntryChange{Name: name})
+		} else if !reflect.DeepEqual(oldEntry, newEntry) {
+			changes = append(changes, &DirectoryEntryChange{Name: name, Entry: newEntry})
+		}
+	}
+	for name, newEntry := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			changes = append(changes, &DirectoryEntryChange{Name: name, Entry: newEntry})
+		}
+	}
+	return changes
+}
+
 type WritableDirectory interface {
 	Directory
 	// required for submitting change records
@@ -188,6 +515,14 @@ type WritableDirectory interface {
 	Submit([]*SignedChangeRecord) error
 }
 
+// implemented by directories that allow admins to inspect competing chains
+// and to decide which one is canonical
+type ForkableDirectory interface {
+	WritableDirectory
+	Forks() ([]*Fork, error)
+	Pin(*SignedPin) error
+}
+
 type BaseDirectory struct {
 	Name_ string
 }
@@ -309,7 +644,17 @@ func GetPeers(baseEntry *DirectoryEntry, entries []*DirectoryEntry, incomingOnly
 // have a list of local directory entries
 func FilterDirectoryEntriesByQuery(entries []*DirectoryEntry, query *DirectoryQuery) []*DirectoryEntry {
 	relevantEntries := make([]*DirectoryEntry, 0)
+	selector, err := ParseLabelSelector(query.Selector)
+	if err != nil {
+		// selectors are validated before, so this should not happen
+		Log.Error(err)
+		return relevantEntries
+	}
 	for _, entry := range entries {
+		// deleted entries only remain as tombstones
+		if entry.Deleted {
+			continue
+		}
 		// we filter the entries by the specified operator name
 		if query.Operator != "" && entry.Name != query.Operator {
 			continue
@@ -346,6 +691,27 @@ func FilterDirectoryEntriesByQuery(entries []*DirectoryEntry, query *DirectoryQu
 		if !found {
 			continue
 		}
+		// we filter the entries by the specified service name
+		if query.Service != "" {
+			found := false
+			for _, service := range entry.Services {
+				if service.Name == query.Service {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		// we filter the entries by the specified properties
+		if !entry.Properties.Matches(query.Properties) {
+			continue
+		}
+		// we filter the entries by the specified label selector
+		if !selector.Matches(entry.Labels) {
+			continue
+		}
 		relevantEntries = append(relevantEntries, entry)
 	}
 	return relevantEntries
@@ -0,0 +1,86 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package eps
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettingsFor(t *testing.T) {
+
+	entry := MakeDirectoryEntry()
+	entry.Settings = []*OperatorSettings{
+		{Settings: map[string]interface{}{"id": "default"}},
+		{Environment: "staging", Settings: map[string]interface{}{"id": "staging"}},
+		{Service: "proxy", Settings: map[string]interface{}{"id": "proxy"}},
+		{Service: "proxy", Environment: "staging", Settings: map[string]interface{}{"id": "proxy-staging"}},
+		{Operator: "op-1", Settings: map[string]interface{}{"id": "op-1"}},
+	}
+
+	for _, c := range []struct {
+		service, operator, environment, id string
+	}{
+		{"proxy", "op-1", "staging", "op-1"},
+		{"proxy", "op-2", "staging", "proxy-staging"},
+		{"proxy", "op-2", "production", "proxy"},
+		{"proxy", "op-2", "", "proxy"},
+		{"other", "op-2", "staging", "staging"},
+		{"other", "op-2", "production", "default"},
+	} {
+		if settings := entry.SettingsFor(c.service, c.operator, c.environment); settings == nil {
+			t.Fatalf("no settings found for %v", c)
+		} else if settings.Settings["id"] != c.id {
+			t.Fatalf("expected settings '%s' for %v, got '%s'", c.id, c, settings.Settings["id"])
+		}
+	}
+
+	entry.Settings = entry.Settings[3:]
+
+	if settings := entry.SettingsFor("other", "op-2", "staging"); settings != nil {
+		t.Fatalf("expected no settings")
+	}
+}
+
+func TestChangeRecordValidAt(t *testing.T) {
+
+	from := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(24 * time.Hour)
+
+	record := &ChangeRecord{
+		ValidFrom:  &HashableTime{Time: from},
+		ValidUntil: &HashableTime{Time: until},
+	}
+
+	for _, c := range []struct {
+		t     time.Time
+		valid bool
+	}{
+		{from.Add(-time.Second), false},
+		{from, true},
+		{until.Add(-time.Second), true},
+		{until, false},
+	} {
+		if record.ValidAt(c.t) != c.valid {
+			t.Fatalf("expected validity %v at %v", c.valid, c.t)
+		}
+	}
+
+	if (&ChangeRecord{}).IsScheduled() || !record.IsScheduled() {
+		t.Fatalf("unexpected scheduling status")
+	}
+}
@@ -18,6 +18,7 @@ package forms
 
 import (
 	"fmt"
+	"github.com/iris-connect/eps"
 	"github.com/kiprotect/go-helpers/forms"
 	"regexp"
 )
@@ -43,6 +44,24 @@ var OperatorChannelForm = forms.Form{
 	},
 }
 
+var OperatorRevocationForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "fingerprint",
+			Validators: []forms.Validator{
+				forms.IsString{},
+			},
+		},
+		{
+			Name: "reason",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+			},
+		},
+	},
+}
+
 var OperatorCertificateForm = forms.Form{
 	Fields: []forms.Field{
 		{
@@ -57,6 +76,26 @@ var OperatorCertificateForm = forms.Form{
 				forms.IsString{},
 			},
 		},
+		{
+			Name: "not_before",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsString{},
+				forms.IsTime{
+					Format: "rfc3339",
+				},
+			},
+		},
+		{
+			Name: "not_after",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsString{},
+				forms.IsTime{
+					Format: "rfc3339",
+				},
+			},
+		},
 	},
 }
 
@@ -159,6 +198,26 @@ func (f IsValidRightsList) Validate(value interface{}, values map[string]interfa
 	return rights, nil
 }
 
+type AreValidLabels struct{}
+
+func (f AreValidLabels) Validate(value interface{}, values map[string]interface{}) (interface{}, error) {
+	// string map validation happened before
+	labels := value.(map[string]interface{})
+
+	for key, labelValue := range labels {
+		if !eps.LabelKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid label key '%s'", key)
+		}
+		if strValue, ok := labelValue.(string); !ok {
+			return nil, fmt.Errorf("value of label '%s' is not a string", key)
+		} else if len(strValue) > 256 {
+			return nil, fmt.Errorf("value of label '%s' is too long", key)
+		}
+	}
+
+	return labels, nil
+}
+
 var PermissionForm = forms.Form{
 	Fields: []forms.Field{
 		{
@@ -237,9 +296,9 @@ var OperatorPreferencesForm = forms.Form{
 			},
 		},
 		{
-			Name: "settings",
+			Name: "preferences",
 			Validators: []forms.Validator{
-				forms.IsStringMap{}, // to do: restrict size of settings (?)
+				forms.IsStringMap{}, // to do: restrict size of preferences (?)
 			},
 		},
 	},
@@ -353,6 +412,34 @@ var DirectoryEntryForm = forms.Form{
 				},
 			},
 		},
+		{
+			Name: "revocations",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: []interface{}{}},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &OperatorRevocationForm,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "labels",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: map[string]interface{}{}},
+				forms.IsStringMap{},
+				AreValidLabels{},
+			},
+		},
+		{
+			Name: "deleted",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: false},
+				forms.IsBoolean{},
+			},
+		},
 	},
 }
 
@@ -394,6 +481,76 @@ var SignedChangeRecordForm = forms.Form{
 				},
 			},
 		},
+		{
+			Name: "signatures",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &SignatureForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var SignedPinForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "pin",
+			Validators: []forms.Validator{
+				forms.IsStringMap{
+					Form: &PinForm,
+				},
+			},
+		},
+		{
+			Name: "signature",
+			Validators: []forms.Validator{
+				forms.IsStringMap{
+					Form: &SignatureForm,
+				},
+			},
+		},
+		{
+			Name: "signatures",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &SignatureForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var PinForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "hash",
+			Validators: []forms.Validator{
+				forms.IsString{},
+				forms.MatchesRegex{
+					Regexp: regexp.MustCompile(`^[a-f0-9]{64}$`),
+				},
+			},
+		},
+		{
+			Name: "created_at",
+			Validators: []forms.Validator{
+				forms.IsString{},
+				forms.IsTime{
+					Format: "rfc3339",
+				},
+			},
+		},
 	},
 }
 
@@ -414,76 +571,137 @@ var ChangeRecordForm = forms.Form{
 				},
 			},
 		},
+		{
+			Name: "valid_from",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsString{},
+				forms.IsTime{
+					Format: "rfc3339",
+				},
+			},
+		},
+		{
+			Name: "valid_until",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsString{},
+				forms.IsTime{
+					Format: "rfc3339",
+				},
+			},
+		},
 		{
 			Name: "section",
 			Validators: []forms.Validator{
 				forms.IsString{},
 				forms.IsIn{
-					Choices: []interface{}{"channels", "certificates", "services", "preferences", "settings", "groups"},
+					Choices: []interface{}{"channels", "certificates", "services", "preferences", "settings", "groups", "revocations", "labels", "entry"},
+				},
+			},
+		},
+		{
+			Name: "op",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+				forms.IsIn{
+					Choices: []interface{}{eps.ReplaceOp, eps.DeleteOp},
 				},
 			},
 		},
 		{
 			Name: "data",
 			Validators: []forms.Validator{
-				forms.Switch{
-					Key: "section",
-					Cases: map[string][]forms.Validator{
-						"channels": []forms.Validator{
-							forms.IsList{
-								Validators: []forms.Validator{
-									forms.IsStringMap{
-										Form: &OperatorChannelForm,
-									},
-								},
-							},
-						},
-						"groups": []forms.Validator{
-							forms.IsList{
-								Validators: []forms.Validator{
-									forms.IsString{},
-								},
-							},
-						},
-						"settings": []forms.Validator{
-							forms.IsList{
-								Validators: []forms.Validator{
-									forms.IsStringMap{
-										Form: &OperatorSettingsForm,
-									},
-								},
-							},
-						},
-						"preferences": []forms.Validator{
-							forms.IsList{
-								Validators: []forms.Validator{
-									forms.IsStringMap{
-										Form: &OperatorPreferencesForm,
-									},
-								},
-							},
-						},
-						"services": []forms.Validator{
-							forms.IsList{
-								Validators: []forms.Validator{
-									forms.IsStringMap{
-										Form: &OperatorServiceForm,
-									},
-								},
-							},
-						},
-						"certificates": []forms.Validator{
-							forms.IsList{
-								Validators: []forms.Validator{
-									forms.IsStringMap{
-										Form: &OperatorCertificateForm,
-									},
-								},
-							},
-						},
+				forms.IsOptional{},
+				IsValidRecordData{},
+			},
+		},
+	},
+}
+
+var recordDataValidator = forms.Switch{
+	Key: "section",
+	Cases: map[string][]forms.Validator{
+		"channels": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsStringMap{
+						Form: &OperatorChannelForm,
+					},
+				},
+			},
+		},
+		"groups": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsString{},
+				},
+			},
+		},
+		"settings": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsStringMap{
+						Form: &OperatorSettingsForm,
+					},
+				},
+			},
+		},
+		"preferences": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsStringMap{
+						Form: &OperatorPreferencesForm,
+					},
+				},
+			},
+		},
+		"services": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsStringMap{
+						Form: &OperatorServiceForm,
+					},
+				},
+			},
+		},
+		"certificates": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsStringMap{
+						Form: &OperatorCertificateForm,
+					},
+				},
+			},
+		},
+		"revocations": []forms.Validator{
+			forms.IsList{
+				Validators: []forms.Validator{
+					forms.IsStringMap{
+						Form: &OperatorRevocationForm,
 					},
 				},
 			},
 		},
+		"labels": []forms.Validator{
+			forms.IsStringMap{},
+			AreValidLabels{},
+		},
 	},
 }
+
+// Delete records can contain identifiers of the items to delete
+var recordIdentifiersValidator = forms.IsStringList{}
+
+// Validates the data of a change record. Replace records contain the new data
+// of the section, delete records optionally contain a list of identifiers of
+// the items to delete (e.g. channel types or service names).
+type IsValidRecordData struct{}
+
+func (f IsValidRecordData) Validate(value interface{}, values map[string]interface{}) (interface{}, error) {
+	if values["op"] == eps.DeleteOp {
+		return recordIdentifiersValidator.Validate(value, values)
+	}
+	return recordDataValidator.Validate(value, values)
+}
@@ -83,6 +83,14 @@ var SettingsForm = forms.Form{
 				forms.IsString{},
 			},
 		},
+		{
+			// used to pick settings and preferences from the directory
+			Name: "environment",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+			},
+		},
 		{
 			Name: "directory",
 			Validators: []forms.Validator{
@@ -87,6 +87,19 @@ var SigningSettingsForm = forms.Form{
 				},
 			},
 		},
+		{
+			// certificate revocation lists, signed by the CA or one of the
+			// intermediate CAs
+			Name: "crl_files",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsString{},
+					},
+				},
+			},
+		},
 		{
 			Name: "certificate_file",
 			Validators: []forms.Validator{
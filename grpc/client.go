@@ -98,12 +98,21 @@ func (c *VerifyCredentials) checkFingerprint(cert *x509.Certificate, name string
 		}
 		return nil, false, fmt.Errorf("error retrieving directory entry for '%s' for fingerprint check: %w", name, err)
 	} else {
+		if revocation := entry.Revocation(helpers.CertificateFingerprint(cert)); revocation != nil {
+			eps.Log.Warningf("Rejecting revoked certificate of '%s' (reason: '%s')", name, revocation.Reason)
+			return nil, false, nil
+		}
 		// we go through all certificates for the entry
 		for _, directoryCert := range entry.Certificates {
 			// we make sure the certificate is good for encryption
 			if directoryCert.KeyUsage != "encryption" {
 				continue
 			}
+			// we make sure the certificate is (still) valid, this allows
+			// for an overlap period during certificate rotation
+			if !directoryCert.ValidAt(time.Now()) {
+				continue
+			}
 			// we check if this is a valid certificate for this operator
 			if helpers.VerifyFingerprint(cert, directoryCert.Fingerprint) {
 				return entry, true, nil
@@ -188,12 +197,23 @@ func (c *Client) Connect(address, serverName string) error {
 	var err error
 	opts := []grpc.DialOption{
 		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                30 * time.Second,
-			Timeout:             20 * time.Second,
-			PermitWithoutStream: true,
+			Time:                seconds(c.settings.KeepaliveTime),
+			Timeout:             seconds(c.settings.KeepaliveTimeout),
+			PermitWithoutStream: c.settings.KeepalivePermitWithoutStream,
 		}),
 	}
 
+	callOpts := []grpc.CallOption{
+		grpc.MaxCallRecvMsgSize(int(c.settings.MaxMessageSize)),
+		grpc.MaxCallSendMsgSize(int(c.settings.MaxMessageSize)),
+	}
+
+	if c.settings.Compression != "" && c.settings.Compression != "none" {
+		callOpts = append(callOpts, grpc.UseCompressor(c.settings.Compression))
+	}
+
+	opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+
 	tlsConfig, err := tls.TLSClientConfig(c.settings.TLS)
 
 	if err != nil {
@@ -209,6 +229,10 @@ func (c *Client) Connect(address, serverName string) error {
 
 	if c.dialer != nil {
 		opts = append(opts, grpc.WithContextDialer(c.dialer))
+	} else if c.settings.ProxyURL != "" {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return DialContext(ctx, c.settings, addr)
+		}))
 	}
 
 	c.connection, err = grpc.Dial(address, opts...)
@@ -279,7 +303,9 @@ func (c *Client) ServerCall(handler Handler, stop chan bool) error {
 		}
 
 		if err == io.EOF {
-			continue
+			// the server closed the stream (e.g. because our directory
+			// entry changed), so we need to reconnect
+			return fmt.Errorf("server closed the stream")
 		}
 
 		if err != nil {
@@ -0,0 +1,152 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package grpc
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/protobuf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"net"
+	"time"
+)
+
+// Determines the serving status of the server. The server is healthy if it
+// is running (i.e. it was started, not stopped and still accepts connections),
+// if we can retrieve our own entry from the directory, if the directory data
+// is fresh (for directories that can tell) and if the health check function
+// (e.g. checking the other channels) does not report a problem.
+func (s *Server) servingStatus() grpc_health_v1.HealthCheckResponse_ServingStatus {
+
+	s.mutex.Lock()
+	running := s.running
+	healthCheck := s.healthCheck
+	s.mutex.Unlock()
+
+	if !running {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+
+	if _, err := s.directory.OwnEntry(); err != nil {
+		eps.Log.Warningf("Health check: cannot retrieve own directory entry: %v", err)
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+
+	if checkableDirectory, ok := s.directory.(eps.CheckableDirectory); ok {
+		if err := checkableDirectory.CheckFreshness(); err != nil {
+			eps.Log.Warningf("Health check: directory data is outdated: %v", err)
+			return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+	}
+
+	if healthCheck != nil {
+		if err := healthCheck(); err != nil {
+			eps.Log.Warningf("Health check: %v", err)
+			return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+	}
+
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+// Sets a function that reports additional problems to the health check
+func (s *Server) SetHealthCheck(check func() error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.healthCheck = check
+}
+
+func (s *Server) updateHealth() {
+	status := s.servingStatus()
+	// the empty service name describes the health of the server as a whole
+	s.health.SetServingStatus("", status)
+	s.health.SetServingStatus(protobuf.EPS_ServiceDesc.ServiceName, status)
+}
+
+func (s *Server) healthChecker(stop chan bool) {
+	for {
+		s.updateHealth()
+		select {
+		case <-stop:
+			stop <- true
+			return
+		case <-time.After(seconds(s.settings.HealthCheckInterval)):
+		}
+	}
+}
+
+// Registers the health and reflection services on the given gRPC server,
+// as configured in the settings.
+func (s *Server) registerServices(server *grpc.Server) {
+	if s.health != nil {
+		grpc_health_v1.RegisterHealthServer(server, s.health)
+	}
+	if s.settings.Reflection {
+		reflection.Register(server)
+	}
+}
+
+func (s *Server) startHealth() error {
+
+	if s.health == nil {
+		return nil
+	}
+
+	if s.settings.HealthBindAddress != "" {
+		// we open a separate, unauthenticated listener that only provides
+		// the health service, e.g. for load balancers that do not possess
+		// a certificate that is registered in the directory
+		listener, err := net.Listen("tcp", s.settings.HealthBindAddress)
+		if err != nil {
+			return fmt.Errorf("error binding health service to address '%s': %w", s.settings.HealthBindAddress, err)
+		}
+		s.healthServer = grpc.NewServer()
+		grpc_health_v1.RegisterHealthServer(s.healthServer, s.health)
+		go func() {
+			if err := s.healthServer.Serve(listener); err != nil {
+				eps.Log.Error(err)
+			}
+		}()
+	}
+
+	s.stopHealth = make(chan bool)
+	go s.healthChecker(s.stopHealth)
+
+	return nil
+}
+
+func (s *Server) shutdownHealth() {
+
+	if s.health == nil {
+		return
+	}
+
+	if s.stopHealth != nil {
+		s.stopHealth <- true
+		<-s.stopHealth
+		s.stopHealth = nil
+	}
+
+	s.health.Shutdown()
+
+	if s.healthServer != nil {
+		s.healthServer.Stop()
+		s.healthServer = nil
+	}
+}
@@ -0,0 +1,181 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package grpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Dials the given address, using the outbound proxy configured in the
+// settings unless the address matches the no-proxy list.
+func DialContext(ctx context.Context, settings *GRPCClientSettings, address string) (net.Conn, error) {
+	return DialViaProxy(ctx, settings.ProxyURL, settings.NoProxy, address)
+}
+
+// Dials the given address via the given outbound proxy (if any) unless the
+// address matches the no-proxy list.
+func DialViaProxy(ctx context.Context, rawProxyURL string, noProxy []string, address string) (net.Conn, error) {
+
+	var dialer net.Dialer
+
+	if rawProxyURL == "" || bypassProxy(address, noProxy) {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	proxyURL, err := url.Parse(rawProxyURL)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	eps.Log.Tracef("Dialing '%s' via proxy '%s'...", address, proxyURL.Host)
+
+	switch proxyURL.Scheme {
+	case "http":
+		return dialHTTPConnect(ctx, proxyURL, address)
+	case "socks5", "socks5h":
+		if socksDialer, err := proxy.FromURL(proxyURL, &dialer); err != nil {
+			return nil, fmt.Errorf("error creating SOCKS5 dialer: %w", err)
+		} else if contextDialer, ok := socksDialer.(proxy.ContextDialer); ok {
+			return contextDialer.DialContext(ctx, "tcp", address)
+		} else {
+			return socksDialer.Dial("tcp", address)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: '%s'", proxyURL.Scheme)
+	}
+}
+
+// Establishes a tunnel to the given address via an HTTP CONNECT request.
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy: %w", err)
+	}
+
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending CONNECT request to proxy: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, request)
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response from proxy: %w", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT request: %s", response.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		// the proxy already sent data from the remote side, which we must not lose
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// Checks whether the given address matches an entry of the no-proxy list.
+// Entries can be host names (which also match subdomains), IP addresses or
+// CIDR ranges, optionally with a port (e.g. 'example.com:443'). The special
+// entry '*' matches all addresses.
+func bypassProxy(address string, noProxy []string) bool {
+
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		host = address
+	}
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			// the entry only matches the given port
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+
+	return false
+}
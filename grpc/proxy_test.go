@@ -0,0 +1,201 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package grpc
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBypassProxy(t *testing.T) {
+
+	for _, test := range []struct {
+		address string
+		noProxy []string
+		bypass  bool
+	}{
+		{"example.com:443", nil, false},
+		{"example.com:443", []string{"example.com"}, true},
+		{"EXAMPLE.com:443", []string{" Example.COM "}, true},
+		{"example.com", []string{"example.com"}, true},
+		{"example.org:443", []string{"example.com"}, false},
+		// domain suffixes match subdomains, with or without a leading dot
+		{"sd.example.com:443", []string{"example.com"}, true},
+		{"sd.example.com:443", []string{".example.com"}, true},
+		{"notexample.com:443", []string{"example.com"}, false},
+		{"example.com:443", []string{"sd.example.com"}, false},
+		// the wildcard matches everything
+		{"example.com:443", []string{"*"}, true},
+		{"10.0.0.1:443", []string{"", "*"}, true},
+		// entries with a port only match that port
+		{"example.com:443", []string{"example.com:443"}, true},
+		{"example.com:5555", []string{"example.com:443"}, false},
+		{"sd.example.com:443", []string{".example.com:443"}, true},
+		// IP addresses and CIDR ranges
+		{"10.0.0.1:443", []string{"10.0.0.1"}, true},
+		{"10.0.0.1:443", []string{"10.0.0.0/8"}, true},
+		{"11.0.0.1:443", []string{"10.0.0.0/8"}, false},
+		{"[::1]:443", []string{"::1/128"}, true},
+		{"example.com:443", []string{"10.0.0.0/8"}, false},
+	} {
+		if bypass := bypassProxy(test.address, test.noProxy); bypass != test.bypass {
+			t.Errorf("bypassProxy(%q, %q): expected %t, got %t", test.address, test.noProxy, test.bypass, bypass)
+		}
+	}
+}
+
+// Starts a proxy that answers every CONNECT request with the given status.
+// If the request is accepted, the proxy sends a greeting through the tunnel.
+func startConnectProxy(t *testing.T, status int) (*url.URL, chan *http.Request) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan *http.Request, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- request
+				response := &http.Response{
+					StatusCode: status,
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+				}
+				if err := response.Write(conn); err != nil {
+					return
+				}
+				if status == http.StatusOK {
+					conn.Write([]byte("hello"))
+				}
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: listener.Addr().String(), User: url.UserPassword("user", "secret")}, requests
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyURL, requests := startConnectProxy(t, http.StatusOK)
+
+	conn, err := dialHTTPConnect(ctx, proxyURL, "sd.example.com:443")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	request := <-requests
+
+	if request.Method != "CONNECT" || request.Host != "sd.example.com:443" {
+		t.Fatalf("unexpected request: %s %s", request.Method, request.Host)
+	}
+
+	if username, password, ok := request.BasicAuth(); ok {
+		t.Fatalf("expected credentials in the Proxy-Authorization header only, got %s:%s", username, password)
+	}
+
+	if request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Fatalf("unexpected proxy authorization: %q", request.Header.Get("Proxy-Authorization"))
+	}
+
+	// data sent through the tunnel must reach us
+	greeting := make([]byte, 5)
+
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(greeting) != "hello" {
+		t.Fatalf("unexpected data from tunnel: %q", greeting)
+	}
+}
+
+func TestDialHTTPConnectRefused(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyURL, _ := startConnectProxy(t, http.StatusForbidden)
+
+	if conn, err := dialHTTPConnect(ctx, proxyURL, "sd.example.com:443"); err == nil {
+		conn.Close()
+		t.Fatalf("expected a CONNECT request answered with 403 to fail")
+	}
+}
+
+func TestDialContextBypassesProxy(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	// the proxy refuses all requests, so we can only connect directly
+	proxyURL, _ := startConnectProxy(t, http.StatusForbidden)
+
+	settings := &GRPCClientSettings{
+		ProxyURL: proxyURL.String(),
+		NoProxy:  []string{"127.0.0.1"},
+	}
+
+	conn, err := DialContext(ctx, settings, listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	settings.NoProxy = nil
+
+	if conn, err := DialContext(ctx, settings, listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatalf("expected the connection via the proxy to fail")
+	}
+}
@@ -25,6 +25,9 @@ import (
 	"github.com/iris-connect/eps/tls"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	// we register the gzip compressor so that clients can use it
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/protobuf/types/known/structpb"
@@ -50,31 +53,62 @@ type Server struct {
 	directory        eps.Directory
 	mutex            sync.Mutex
 	handler          Handler
+	health           *health.Server
+	healthServer     *grpc.Server
+	stopHealth       chan bool
+	healthCheck      func() error
+	running          bool
 }
 
 func (s *Server) Start() error {
 
+	s.mutex.Lock()
+	s.running = true
+	s.mutex.Unlock()
+
 	go func() {
-		s.server.Serve(s.listener)
+		if err := s.server.Serve(s.listener); err != nil {
+			eps.Log.Errorf("gRPC server stopped: %v", err)
+		}
+		// the health status reflects that we no longer accept connections
+		s.mutex.Lock()
+		s.running = false
+		s.mutex.Unlock()
 	}()
 
-	return nil
+	return s.startHealth()
 
 }
 
 func (s *Server) Stop() error {
+
+	s.mutex.Lock()
+	s.running = false
+	s.mutex.Unlock()
+
+	// we report that we're not serving anymore before closing connections
+	s.shutdownHealth()
+
+	s.server.Stop()
+
 	return nil
 }
 
-// currently we allow messages up to 4MB in size
-var MaxMessageSize = 1024 * 1024 * 4
-
 func MakeServer(settings *GRPCServerSettings, handler Handler, listener net.Listener, directory eps.Directory) (*Server, error) {
 	opts := []grpc.ServerOption{
-		grpc.MaxRecvMsgSize(MaxMessageSize),
-		grpc.MaxSendMsgSize(MaxMessageSize),
-		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 15 * time.Second, PermitWithoutStream: true}),
-		grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: 60 * time.Second, MaxConnectionAge: 24 * time.Hour, MaxConnectionAgeGrace: 1 * time.Minute, Time: 1 * time.Minute, Timeout: 30 * time.Second}),
+		grpc.MaxRecvMsgSize(int(settings.MaxMessageSize)),
+		grpc.MaxSendMsgSize(int(settings.MaxMessageSize)),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             seconds(settings.KeepaliveMinTime),
+			PermitWithoutStream: settings.KeepalivePermitWithoutStream,
+		}),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionIdle:     seconds(settings.MaxConnectionIdle),
+			MaxConnectionAge:      seconds(settings.MaxConnectionAge),
+			MaxConnectionAgeGrace: seconds(settings.MaxConnectionAgeGrace),
+			Time:                  seconds(settings.KeepaliveTime),
+			Timeout:               seconds(settings.KeepaliveTimeout),
+		}),
 	}
 	if tlsConfig, err := tls.TLSServerConfig(settings.TLS); err != nil {
 		return nil, fmt.Errorf("error retrieving TLS server config: %w", err)
@@ -91,7 +125,12 @@ func MakeServer(settings *GRPCServerSettings, handler Handler, listener net.List
 		settings:         settings,
 	}
 
+	if settings.Health {
+		server.health = health.NewServer()
+	}
+
 	protobuf.RegisterEPSServer(server.server, server)
+	server.registerServices(server.server)
 
 	return server, nil
 }
@@ -293,6 +332,22 @@ func (s *Server) deleteClient(client *ConnectedClient) {
 	s.connectedClients = newClients
 }
 
+// Disconnects the client with the given name (if it is connected), e.g.
+// because its directory entry changed. The client will need to reconnect,
+// which ensures that its certificate gets checked again.
+func (s *Server) DisconnectClient(name string) {
+	client := s.getClient(name)
+	if client == nil {
+		return
+	}
+	eps.Log.Debugf("Disconnecting client '%s'...", name)
+	select {
+	case client.Stop <- true:
+	case <-time.After(time.Second):
+		eps.Log.Warningf("Timeout when disconnecting client '%s'", name)
+	}
+}
+
 type ClientAnnouncement struct {
 	Name string `json:"name"`
 }
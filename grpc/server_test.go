@@ -0,0 +1,211 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package grpc
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/tls"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testDirectory struct {
+	available bool
+	stale     bool
+	mutex     sync.Mutex
+}
+
+// the health checker reads the state concurrently
+func (d *testDirectory) setState(available, stale bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.available, d.stale = available, stale
+}
+
+func (d *testDirectory) Entries(*eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
+	return nil, nil
+}
+
+func (d *testDirectory) EntryFor(name string) (*eps.DirectoryEntry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.available {
+		return nil, fmt.Errorf("directory unavailable")
+	}
+	return &eps.DirectoryEntry{Name: name}, nil
+}
+
+func (d *testDirectory) CheckFreshness() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stale {
+		return fmt.Errorf("directory is stale")
+	}
+	return nil
+}
+
+func (d *testDirectory) OwnEntry() (*eps.DirectoryEntry, error) {
+	return d.EntryFor(d.Name())
+}
+
+func (d *testDirectory) Name() string {
+	return "test-1"
+}
+
+func makeTestServer(t *testing.T, directory eps.Directory) (*Server, net.Listener) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := MakeServer(&GRPCServerSettings{
+		TLS:                 &tls.TLSSettings{},
+		MaxMessageSize:      1024 * 1024,
+		Health:              true,
+		HealthCheckInterval: 0.01,
+	}, nil, listener, directory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, listener
+}
+
+func waitForStatus(t *testing.T, server *Server, status grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	for i := 0; i < 100; i++ {
+		if server.servingStatus() == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected serving status %s, got %s", status, server.servingStatus())
+}
+
+func TestHealthStatus(t *testing.T) {
+
+	directory := &testDirectory{available: true}
+	server, _ := makeTestServer(t, directory)
+
+	if status := server.servingStatus(); status != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected a server that wasn't started to be not serving, got %s", status)
+	}
+
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Stop()
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_SERVING)
+
+	directory.setState(false, false)
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	// cached data that is outdated does not count as healthy either
+	directory.setState(true, true)
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	directory.setState(true, false)
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_SERVING)
+}
+
+func TestHealthCheck(t *testing.T) {
+
+	server, _ := makeTestServer(t, &testDirectory{available: true})
+
+	var mutex sync.Mutex
+	var channelErr error
+
+	// e.g. a channel of the broker that stopped working
+	server.SetHealthCheck(func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return channelErr
+	})
+
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Stop()
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_SERVING)
+
+	mutex.Lock()
+	channelErr = fmt.Errorf("not connected")
+	mutex.Unlock()
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestHealthStatusListenerClosed(t *testing.T) {
+
+	server, listener := makeTestServer(t, &testDirectory{available: true})
+
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Stop()
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_SERVING)
+
+	// the server can no longer accept connections
+	listener.Close()
+
+	waitForStatus(t, server, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestStop(t *testing.T) {
+
+	server, listener := makeTestServer(t, &testDirectory{available: true})
+
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+
+	if conn, err := net.Dial("tcp", address); err != nil {
+		t.Fatalf("expected the server to accept connections: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := server.servingStatus(); status != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected a stopped server to be not serving, got %s", status)
+	}
+
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatalf("expected the listener to be closed after stopping the server")
+	}
+}
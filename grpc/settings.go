@@ -19,19 +19,46 @@ package grpc
 import (
 	"github.com/iris-connect/eps/net"
 	"github.com/iris-connect/eps/tls"
+	"time"
 )
 
 // Settings for the gRPC client
 type GRPCClientSettings struct {
-	TLS      *tls.TLSSettings `json:"tls"`
-	UseProxy bool             `json:"useProxy"`
-	Enabled  bool             `json:"enabled"`
+	TLS                          *tls.TLSSettings `json:"tls"`
+	UseProxy                     bool             `json:"useProxy"`
+	Enabled                      bool             `json:"enabled"`
+	MaxMessageSize               int64            `json:"max_message_size"`
+	KeepaliveTime                float64          `json:"keepalive_time"`
+	KeepaliveTimeout             float64          `json:"keepalive_timeout"`
+	KeepalivePermitWithoutStream bool             `json:"keepalive_permit_without_stream"`
+	Compression                  string           `json:"compression"`
+	ProxyURL                     string           `json:"proxy_url"`
+	NoProxy                      []string         `json:"no_proxy"`
 }
 
 // Settings for the gRPC server
 type GRPCServerSettings struct {
-	TLS           *tls.TLSSettings `json:"tls"`
-	BindAddress   string           `json:"bind_address"`
-	TCPRateLimits []*net.RateLimit `json:"tcp_rate_limits"`
-	Enabled       bool             `json:"enabled"`
+	TLS                          *tls.TLSSettings `json:"tls"`
+	BindAddress                  string           `json:"bind_address"`
+	TCPRateLimits                []*net.RateLimit `json:"tcp_rate_limits"`
+	Enabled                      bool             `json:"enabled"`
+	MaxMessageSize               int64            `json:"max_message_size"`
+	KeepaliveMinTime             float64          `json:"keepalive_min_time"`
+	KeepalivePermitWithoutStream bool             `json:"keepalive_permit_without_stream"`
+	KeepaliveTime                float64          `json:"keepalive_time"`
+	KeepaliveTimeout             float64          `json:"keepalive_timeout"`
+	MaxConnectionIdle            float64          `json:"max_connection_idle"`
+	MaxConnectionAge             float64          `json:"max_connection_age"`
+	MaxConnectionAgeGrace        float64          `json:"max_connection_age_grace"`
+	Health                       bool             `json:"health"`
+	HealthBindAddress            string           `json:"health_bind_address"`
+	HealthCheckInterval          float64          `json:"health_check_interval"`
+	Reflection                   bool             `json:"reflection"`
+	ProxyURL                     string           `json:"proxy_url"`
+	NoProxy                      []string         `json:"no_proxy"`
+}
+
+// converts a duration given in (fractional) seconds to a time.Duration
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
 }
@@ -19,8 +19,71 @@ package helpers
 import (
 	"fmt"
 	"github.com/iris-connect/eps"
+	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/kiprotect/go-helpers/forms"
 )
 
+type ChannelsList struct {
+	Channels []*eps.OperatorChannel `json:"channels"`
+}
+
+var ChannelsListForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "channels",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: []interface{}{}},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &epsForms.OperatorChannelForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// Validates the settings of the channels in a change record against the entry
+// settings form of the channel definition. Channels of unknown types (or
+// without an entry settings form) are accepted, as they might be implemented
+// by other servers.
+func ValidateRecordChannels(record *eps.ChangeRecord, definitions *eps.Definitions) error {
+
+	if record.Section != "channels" || record.IsDelete() || definitions == nil {
+		return nil
+	}
+
+	params, err := ChannelsListForm.Validate(map[string]interface{}{"channels": record.Data})
+
+	if err != nil {
+		return fmt.Errorf("invalid channels for '%s': %w", record.Name, err)
+	}
+
+	channelsList := &ChannelsList{}
+
+	if err := ChannelsListForm.Coerce(channelsList, params); err != nil {
+		return err
+	}
+
+	for _, channel := range channelsList.Channels {
+		definition, ok := definitions.ChannelDefinitions[channel.Type]
+		if !ok || definition.EntrySettingsForm == nil {
+			continue
+		}
+		settings := channel.Settings
+		if settings == nil {
+			settings = map[string]interface{}{}
+		}
+		if _, err := definition.EntrySettingsForm.Validate(settings); err != nil {
+			return fmt.Errorf("invalid settings for channel '%s' of '%s': %w", channel.Type, record.Name, err)
+		}
+	}
+
+	return nil
+}
+
 func GetChannelSettingsAndDefinition(settings *eps.Settings, name string) (*eps.ChannelSettings, *eps.ChannelDefinition, error) {
 	for _, channel := range settings.Channels {
 		if channel.Name == name {
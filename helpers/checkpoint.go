@@ -0,0 +1,205 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"sort"
+	"time"
+)
+
+// Creates a checkpoint for the given entries of the chain with the given root
+// and tip. Records are not included in the checkpoint entries, as the
+// checkpoint should not grow with the length of the history.
+func MakeCheckpoint(root, tip *eps.SignedChangeRecord, length int, entries map[string]*eps.DirectoryEntry) *eps.Checkpoint {
+	checkpointEntries := make([]*eps.DirectoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		entryCopy := *entry
+		entryCopy.Records = []*eps.SignedChangeRecord{}
+		checkpointEntries = append(checkpointEntries, &entryCopy)
+	}
+	sort.Slice(checkpointEntries, func(i, j int) bool { return checkpointEntries[i].Name < checkpointEntries[j].Name })
+	return &eps.Checkpoint{
+		Hash:          tip.Hash,
+		Length:        int64(length),
+		CreatedAt:     eps.HashableTime{Time: time.Now().UTC()},
+		Entries:       checkpointEntries,
+		Root:          root.Hash,
+		RootCreatedAt: &eps.HashableTime{Time: root.Record.CreatedAt.Time},
+		TipCreatedAt:  &eps.HashableTime{Time: tip.Record.CreatedAt.Time},
+	}
+}
+
+// We sign the generic JSON form of checkpoints and similar data (i.e. the
+// result of a JSON round trip), as this is the form in which clients receive it.
+func genericData(value interface{}) (interface{}, error) {
+	var data interface{}
+	if jsonData, err := json.Marshal(value); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func SignCheckpoint(checkpoint *eps.Checkpoint, key *ecdsa.PrivateKey, cert *x509.Certificate) (*eps.SignedCheckpoint, error) {
+
+	data, err := genericData(checkpoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, err := Sign(data, key, cert)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &eps.SignedCheckpoint{
+		Checkpoint: checkpoint,
+		Signature:  signedData.Signature,
+	}, nil
+}
+
+// Adds the signature of another admin to the checkpoint
+func CosignCheckpoint(signedCheckpoint *eps.SignedCheckpoint, key *ecdsa.PrivateKey, cert *x509.Certificate) error {
+
+	cosignedCheckpoint, err := SignCheckpoint(signedCheckpoint.Checkpoint, key, cert)
+
+	if err != nil {
+		return err
+	}
+
+	signedCheckpoint.Signatures = append(signedCheckpoint.Signatures, cosignedCheckpoint.Signature)
+
+	return nil
+}
+
+// Verifies that the checkpoint was signed by at least 'quorum' different
+// service directory admins. As clients trust the entries of a checkpoint
+// without verifying the records before it, it requires the same quorum as
+// records that rely on admin rights. The entries of the admins are looked up
+// in the given entries, which need to come from a trusted source (e.g. the
+// chain up to the checkpoint or the entries the verifier already has). The
+// entries of the checkpoint itself can't be used, as a revoked admin could
+// simply leave out its revocation.
+func VerifyCheckpoint(signedCheckpoint *eps.SignedCheckpoint, entries map[string]*eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (bool, error) {
+
+	if signedCheckpoint.Checkpoint == nil || signedCheckpoint.Signature == nil {
+		return false, fmt.Errorf("incomplete checkpoint")
+	}
+
+	data, err := genericData(signedCheckpoint.Checkpoint)
+
+	if err != nil {
+		return false, err
+	}
+
+	signatures := append([]*eps.Signature{signedCheckpoint.Signature}, signedCheckpoint.Signatures...)
+
+	return verifyAdminQuorum(data, signatures, func(name string) *eps.DirectoryEntry {
+		return entries[name]
+	}, rootCerts, intermediateCerts, quorum)
+}
+
+// Verifies that the data was signed by at least 'quorum' different admins.
+// All signatures need to be valid and the entries of the admins (as returned
+// by the entry function) must not be deleted.
+func verifyAdminQuorum(data interface{}, signatures []*eps.Signature, entry func(name string) *eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (bool, error) {
+
+	admins := map[string]bool{}
+
+	for _, signature := range signatures {
+
+		_, subjectInfo, err := recordSigner(signature)
+
+		if err != nil {
+			return false, err
+		}
+
+		adminEntry := entry(subjectInfo.Name)
+
+		if adminEntry != nil && adminEntry.Deleted {
+			return false, nil
+		}
+
+		if ok, err := verifyAdminSignature(data, signature, rootCerts, intermediateCerts, func(name string) []*eps.OperatorRevocation {
+			if adminEntry == nil {
+				return nil
+			}
+			return adminEntry.Revocations
+		}); err != nil || !ok {
+			return false, err
+		}
+
+		admins[subjectInfo.Name] = true
+	}
+
+	return len(admins) >= quorum, nil
+}
+
+// Verifies that the data was signed by a service directory admin. The
+// revocations function returns the revocations for the given admin.
+func verifyAdminSignature(data interface{}, signature *eps.Signature, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, revocations func(name string) []*eps.OperatorRevocation) (bool, error) {
+
+	cert, err := LoadCertificateFromString(signature.Certificate, true)
+
+	if err != nil {
+		return false, fmt.Errorf("error loading signing certificate: %w", err)
+	}
+
+	subjectInfo, err := GetSubjectInfo(cert)
+
+	if err != nil {
+		return false, fmt.Errorf("error retrieving subject info: %w", err)
+	}
+
+	if !IsAdmin(subjectInfo) {
+		return false, nil
+	}
+
+	return VerifyWithRevocations(&eps.SignedData{
+		Data:      data,
+		Signature: signature,
+	}, rootCerts, intermediateCerts, "", revocations(subjectInfo.Name))
+}
+
+// Returns the entries from the checkpoint as a map. The entries are copied,
+// so records can be integrated into them without modifying the checkpoint.
+func CheckpointEntries(checkpoint *eps.Checkpoint) map[string]*eps.DirectoryEntry {
+	entries := make(map[string]*eps.DirectoryEntry, len(checkpoint.Entries))
+	for _, entry := range checkpoint.Entries {
+		entries[entry.Name] = CopyEntry(entry)
+	}
+	return entries
+}
+
+// Parses a checkpoint from its generic JSON form (e.g. from an API response)
+func ParseCheckpoint(data interface{}) (*eps.SignedCheckpoint, error) {
+	signedCheckpoint := &eps.SignedCheckpoint{}
+	if jsonData, err := json.Marshal(data); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonData, signedCheckpoint); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return signedCheckpoint, nil
+}
@@ -17,12 +17,13 @@
 package helpers
 
 import (
+	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"github.com/iris-connect/eps"
 	epsForms "github.com/iris-connect/eps/forms"
-	"github.com/kiprotect/go-helpers/forms"
+	"time"
 )
 
 func InitializeDirectory(settings *eps.Settings) (eps.Directory, error) {
@@ -33,68 +34,321 @@ func InitializeDirectory(settings *eps.Settings) (eps.Directory, error) {
 // Integrates a record into the directory
 func IntegrateChangeRecord(record *eps.SignedChangeRecord, entry *eps.DirectoryEntry) error {
 
+	if err := ValidateChangeRecordOp(record.Record); err != nil {
+		return err
+	}
+
+	if record.Record.IsScheduled() {
+		return scheduleChangeRecord(record, entry)
+	}
+
+	if err := applyChangeRecord(record.Record, entry); err != nil {
+		return err
+	}
+
+	if record.Record.Section != "entry" {
+		// scheduled records for the same section are superseded
+		entry.Scheduled = withoutSection(entry.Scheduled, record.Record.Section)
+	}
+
+	if entry.Records == nil {
+		entry.Records = make([]*eps.SignedChangeRecord, 0)
+	}
+
+	// we append the change record to the entry for audit logging purposes
+	entry.Records = append(entry.Records, record)
+
+	return nil
+}
+
+// Checks that the operation of the record is supported for its section
+func ValidateChangeRecordOp(record *eps.ChangeRecord) error {
+	switch record.Op {
+	case "", eps.ReplaceOp:
+		if record.Section == "entry" {
+			return fmt.Errorf("entries can only be deleted")
+		}
+		if record.Data == nil {
+			return fmt.Errorf("missing data for section '%s'", record.Section)
+		}
+	case eps.DeleteOp:
+		switch record.Section {
+		case "revocations":
+			// revocations are permanent
+			return fmt.Errorf("revocations cannot be deleted")
+		case "entry", "settings", "preferences":
+			if record.Data != nil {
+				return fmt.Errorf("section '%s' can only be deleted as a whole", record.Section)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation '%s'", record.Op)
+	}
+	return nil
+}
+
+// Applies the data of a record to the given entry
+func applyChangeRecord(record *eps.ChangeRecord, entry *eps.DirectoryEntry) error {
+
+	if record.IsDelete() {
+		return deleteFromEntry(record, entry)
+	}
+
 	config := map[string]interface{}{
-		record.Record.Section: record.Record.Data,
+		record.Section: record.Data,
 	}
 
+	// revocations are permanent, so we keep the existing ones
+	revocations := entry.Revocations
+
 	// we directly coerce the updated settings into the entry
 	if err := epsForms.DirectoryEntryForm.Coerce(entry, config); err != nil {
 		return err
-	} else {
-		if entry.Records == nil {
-			entry.Records = make([]*eps.SignedChangeRecord, 0)
+	}
+
+	if record.Section == "revocations" {
+		entry.Revocations = mergeRevocations(revocations, entry.Revocations)
+	}
+
+	// replacing data of a deleted entry brings it back
+	entry.Deleted = false
+
+	return nil
+}
+
+// Deletes a whole section, individual items of a section (if the record
+// contains their identifiers) or the entire entry. Deleted entries keep their
+// records and revocations, so that they remain verifiable.
+func deleteFromEntry(record *eps.ChangeRecord, entry *eps.DirectoryEntry) error {
+
+	if record.Section == "entry" {
+		deletedEntry := eps.MakeDirectoryEntry()
+		deletedEntry.Name = entry.Name
+		deletedEntry.Revocations = entry.Revocations
+		deletedEntry.Records = entry.Records
+		deletedEntry.Deleted = true
+		*entry = *deletedEntry
+		return nil
+	}
+
+	identifiers, err := recordIdentifiers(record.Data)
+
+	if err != nil {
+		return err
+	}
+
+	// without identifiers we delete all items of the section
+	keep := func(identifier string) bool {
+		return identifiers != nil && !identifiers[identifier]
+	}
+
+	switch record.Section {
+	case "channels":
+		channels := make([]*eps.OperatorChannel, 0, len(entry.Channels))
+		for _, channel := range entry.Channels {
+			if keep(channel.Type) {
+				channels = append(channels, channel)
+			}
 		}
-		// we append the change record to the entry for audit logging purposes
-		entry.Records = append(entry.Records, record)
+		entry.Channels = channels
+	case "services":
+		services := make([]*eps.OperatorService, 0, len(entry.Services))
+		for _, service := range entry.Services {
+			if keep(service.Name) {
+				services = append(services, service)
+			}
+		}
+		entry.Services = services
+	case "certificates":
+		certificates := make([]*eps.OperatorCertificate, 0, len(entry.Certificates))
+		for _, certificate := range entry.Certificates {
+			if keep(certificate.Fingerprint) {
+				certificates = append(certificates, certificate)
+			}
+		}
+		entry.Certificates = certificates
+	case "groups":
+		groups := make([]string, 0, len(entry.Groups))
+		for _, group := range entry.Groups {
+			if keep(group) {
+				groups = append(groups, group)
+			}
+		}
+		entry.Groups = groups
+	case "labels":
+		// we create a new map as the existing one might be shared
+		labels := make(map[string]string)
+		for key, value := range entry.Labels {
+			if keep(key) {
+				labels[key] = value
+			}
+		}
+		entry.Labels = labels
+	case "settings":
+		entry.Settings = []*eps.OperatorSettings{}
+	case "preferences":
+		entry.Preferences = []*eps.OperatorPreferences{}
+	default:
+		return fmt.Errorf("section '%s' cannot be deleted", record.Section)
 	}
+
 	return nil
 }
 
-type CertificatesList struct {
-	Certificates []*eps.OperatorCertificate `json:"certificates"`
+// Returns the identifiers of a delete record as a set, or nil if the record
+// does not contain any
+func recordIdentifiers(data interface{}) (map[string]bool, error) {
+
+	var values []interface{}
+
+	switch v := data.(type) {
+	case nil:
+		return nil, nil
+	case []string:
+		for _, value := range v {
+			values = append(values, value)
+		}
+	case []interface{}:
+		values = v
+	default:
+		return nil, fmt.Errorf("expected a list of identifiers")
+	}
+
+	identifiers := make(map[string]bool, len(values))
+
+	for _, value := range values {
+		if strValue, ok := value.(string); !ok {
+			return nil, fmt.Errorf("expected a list of identifiers")
+		} else {
+			identifiers[strValue] = true
+		}
+	}
+
+	return identifiers, nil
 }
 
-var CertificatesListForm = forms.Form{
-	Fields: []forms.Field{
-		{
-			Name: "certificates",
-			Validators: []forms.Validator{
-				forms.IsOptional{Default: []interface{}{}},
-				forms.IsList{
-					Validators: []forms.Validator{
-						forms.IsStringMap{
-							Form: &epsForms.OperatorCertificateForm,
-						},
-					},
-				},
-			},
-		},
-	},
+// Records with a validity window are not integrated directly. Instead we keep
+// them with the entry and apply them at query time (see 'EntryAt').
+func scheduleChangeRecord(record *eps.SignedChangeRecord, entry *eps.DirectoryEntry) error {
+
+	switch record.Record.Section {
+	case "certificates", "revocations", "entry":
+		// certificates have their own validity, revocations are permanent and
+		// entries can only be deleted for good
+		return fmt.Errorf("section '%s' does not support validity windows", record.Record.Section)
+	}
+
+	if record.Record.ValidFrom != nil && record.Record.ValidUntil != nil && !record.Record.ValidFrom.Before(record.Record.ValidUntil.Time) {
+		return fmt.Errorf("invalid validity window")
+	}
+
+	entry.Scheduled = append(withoutExpired(entry.Scheduled, record.Record.CreatedAt.Time), record)
+	entry.Records = append(entry.Records, record)
+
+	return nil
 }
 
-func GetRecordFingerprint(records []*eps.SignedChangeRecord, name, keyUsage string) string {
-	lastFingerprint := ""
+func withoutSection(records []*eps.SignedChangeRecord, section string) []*eps.SignedChangeRecord {
+	filteredRecords := make([]*eps.SignedChangeRecord, 0, len(records))
 	for _, record := range records {
-		if record.Record.Section != "certificates" || record.Record.Name != name {
-			continue
+		if record.Record.Section != section {
+			filteredRecords = append(filteredRecords, record)
 		}
-		if params, err := CertificatesListForm.Validate(map[string]interface{}{"certificates": record.Record.Data}); err != nil {
-			eps.Log.Error(err)
+	}
+	return filteredRecords
+}
+
+// Removes records whose validity window ended before the given time, which
+// we use to keep the list of scheduled records short
+func withoutExpired(records []*eps.SignedChangeRecord, t time.Time) []*eps.SignedChangeRecord {
+	filteredRecords := make([]*eps.SignedChangeRecord, 0, len(records))
+	for _, record := range records {
+		if record.Record.ValidUntil == nil || record.Record.ValidUntil.After(t) {
+			filteredRecords = append(filteredRecords, record)
+		}
+	}
+	return filteredRecords
+}
+
+// Returns the entry as it is at the given time, i.e. with all scheduled
+// records applied that are valid at that time. Records are applied in the
+// order of the chain, so if several scheduled records for the same section
+// are valid, the most recent one wins. The given entry is not modified.
+func EntryAt(entry *eps.DirectoryEntry, t time.Time) (*eps.DirectoryEntry, error) {
+
+	var entryCopy *eps.DirectoryEntry
+
+	for _, record := range entry.Scheduled {
+		if !record.Record.ValidAt(t) {
 			continue
+		}
+		if entryCopy == nil {
+			entryCopy = CopyEntry(entry)
+		}
+		if err := applyChangeRecord(record.Record, entryCopy); err != nil {
+			return nil, err
+		}
+	}
+
+	if entryCopy == nil {
+		return entry, nil
+	}
+
+	return entryCopy, nil
+}
+
+// Returns the given entries as they are at the given time (see 'EntryAt').
+// Entries whose scheduled records cannot be applied are returned unchanged.
+func EntriesAt(entries []*eps.DirectoryEntry, t time.Time) []*eps.DirectoryEntry {
+	entriesAt := make([]*eps.DirectoryEntry, len(entries))
+	for i, entry := range entries {
+		if entryAt, err := EntryAt(entry, t); err != nil {
+			eps.Log.Errorf("Cannot apply scheduled records to entry '%s': %v", entry.Name, err)
+			entriesAt[i] = entry
 		} else {
-			certificatesList := &CertificatesList{}
-			if err := CertificatesListForm.Coerce(certificatesList, params); err != nil {
-				eps.Log.Error(err)
-				continue
-			}
-			for _, certificate := range certificatesList.Certificates {
-				if certificate.KeyUsage == keyUsage {
-					lastFingerprint = certificate.Fingerprint
+			entriesAt[i] = entryAt
+		}
+	}
+	return entriesAt
+}
+
+// Returns the latest start or end of a validity window of the scheduled
+// records at or before the given time, and the earliest one after it (zero
+// times if there are none). Between these two times, 'EntriesAt' returns the
+// same entries.
+func ScheduleBoundaries(entries []*eps.DirectoryEntry, t time.Time) (time.Time, time.Time) {
+	var last, next time.Time
+	for _, entry := range entries {
+		for _, record := range entry.Scheduled {
+			for _, boundary := range []*eps.HashableTime{record.Record.ValidFrom, record.Record.ValidUntil} {
+				if boundary == nil {
+					continue
+				}
+				if !boundary.After(t) {
+					if boundary.After(last) {
+						last = boundary.Time
+					}
+				} else if next.IsZero() || boundary.Before(next) {
+					next = boundary.Time
 				}
 			}
 		}
 	}
-	return lastFingerprint
+	return last, next
+}
+
+func mergeRevocations(existing, new []*eps.OperatorRevocation) []*eps.OperatorRevocation {
+	merged := append([]*eps.OperatorRevocation{}, existing...)
+outer:
+	for _, revocation := range new {
+		for _, existingRevocation := range existing {
+			if existingRevocation.Fingerprint == revocation.Fingerprint {
+				continue outer
+			}
+		}
+		merged = append(merged, revocation)
+	}
+	return merged
 }
 
 func VerifyRecordHash(record *eps.SignedChangeRecord) (bool, error) {
@@ -114,11 +368,92 @@ func VerifyRecordHash(record *eps.SignedChangeRecord) (bool, error) {
 	return true, nil
 }
 
-func VerifyRecord(record *eps.SignedChangeRecord, verifiedRecords []*eps.SignedChangeRecord, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate) (bool, error) {
-	signedData := &eps.SignedData{
-		Data:      record,
-		Signature: record.Signature,
+// Sections that operators may change for themselves. All other sections can
+// only be changed by service directory admins.
+var SelfServiceSections = []string{"preferences", "certificates"}
+
+func IsAdmin(subjectInfo *SubjectInfo) bool {
+	for _, group := range subjectInfo.Groups {
+		if group == "sd-admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines whether the given subject may sign the given record. Service
+// directory admins can change everything, other operators can only change
+// the self-service sections of their own entry. Only admins can start a new
+// chain (i.e. reset the directory).
+func IsAuthorizedFor(subjectInfo *SubjectInfo, record *eps.SignedChangeRecord) bool {
+	return IsAdmin(subjectInfo) || isSelfService(subjectInfo, record)
+}
+
+// Determines whether the record changes a self-service section of the
+// subject's own entry, which does not require admin rights
+func isSelfService(subjectInfo *SubjectInfo, record *eps.SignedChangeRecord) bool {
+	if record.ParentHash == "" || record.Record == nil || record.Record.Name != subjectInfo.Name {
+		return false
+	}
+	for _, section := range SelfServiceSections {
+		if record.Record.Section == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines whether the record needs to be signed by a quorum of admins,
+// which is the case for all records that rely on admin rights
+func RequiresQuorum(subjectInfo *SubjectInfo, record *eps.SignedChangeRecord, quorum int) bool {
+	return quorum > 1 && !isSelfService(subjectInfo, record)
+}
+
+// Verifies that the record was not created before its parent (given by the
+// creation time of the parent, which is zero for root records). Certificates
+// are checked at the creation time of a record, which is chosen by the signer,
+// so without this bound an old certificate could still be used by backdating
+// records into its validity period.
+func VerifyRecordTime(record *eps.SignedChangeRecord, parentCreatedAt time.Time) bool {
+	return !record.Record.CreatedAt.Time.Before(parentCreatedAt)
+}
+
+// Verifies a record based on the given, previously verified records. Records
+// that rely on admin rights need to be signed by at least 'quorum' different
+// admins (see 'CosignRecord').
+func VerifyRecord(record *eps.SignedChangeRecord, verifiedRecords []*eps.SignedChangeRecord, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (bool, error) {
+	for _, verifiedRecord := range verifiedRecords {
+		if verifiedRecord.Hash == record.ParentHash && !VerifyRecordTime(record, verifiedRecord.Record.CreatedAt.Time) {
+			return false, nil
+		}
 	}
+	return verifyRecord(record, func(name string) *eps.DirectoryEntry {
+		// we integrate the records of the signer, so that deletions and
+		// revocations are taken into account
+		entry := eps.MakeDirectoryEntry()
+		entry.Name = name
+		for _, verifiedRecord := range verifiedRecords {
+			if verifiedRecord.Record.Name != name {
+				continue
+			}
+			if err := IntegrateChangeRecord(verifiedRecord, entry); err != nil {
+				eps.Log.Error(err)
+			}
+		}
+		return entry
+	}, rootCerts, intermediateCerts, quorum)
+}
+
+// Verifies a record based on the given (integrated) directory entries. This
+// is much faster than verifying it against the full record history and also
+// works if the entries were restored from a checkpoint.
+func VerifyRecordWithEntries(record *eps.SignedChangeRecord, entries map[string]*eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (bool, error) {
+	return verifyRecord(record, func(name string) *eps.DirectoryEntry {
+		return entries[name]
+	}, rootCerts, intermediateCerts, quorum)
+}
+
+func verifyRecord(record *eps.SignedChangeRecord, signerEntry func(name string) *eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (bool, error) {
 
 	if ok, err := VerifyRecordHash(record); err != nil {
 		return false, fmt.Errorf("error verifying record hash: %w", err)
@@ -126,49 +461,207 @@ func VerifyRecord(record *eps.SignedChangeRecord, verifiedRecords []*eps.SignedC
 		return false, fmt.Errorf("invalid hash value")
 	}
 
-	// we temporarily remove the signature from the signed record
-	signature := record.Signature
-	record.Signature = nil
-	defer func() { record.Signature = signature }()
+	// we temporarily remove the signatures from the signed record
+	signature, signatures := record.Signature, record.Signatures
+	record.Signature, record.Signatures = nil, nil
+	defer func() { record.Signature, record.Signatures = signature, signatures }()
+
+	cert, subjectInfo, err := recordSigner(signature)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !IsAuthorizedFor(subjectInfo, record) {
+		return false, nil
+	}
+
+	if ok, err := verifyRecordSignature(record, signature, cert, subjectInfo, signerEntry, rootCerts, intermediateCerts); err != nil || !ok {
+		return false, err
+	}
+
+	if !RequiresQuorum(subjectInfo, record, quorum) {
+		return true, nil
+	}
+
+	// the signer is an admin, otherwise the record wouldn't be authorized
+	admins := map[string]bool{subjectInfo.Name: true}
+
+	for _, coSignature := range signatures {
+
+		coCert, coSubjectInfo, err := recordSigner(coSignature)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !IsAdmin(coSubjectInfo) {
+			return false, nil
+		}
+
+		if ok, err := verifyRecordSignature(record, coSignature, coCert, coSubjectInfo, signerEntry, rootCerts, intermediateCerts); err != nil || !ok {
+			return false, err
+		}
+
+		admins[coSubjectInfo.Name] = true
+	}
+
+	return len(admins) >= quorum, nil
+}
+
+// Returns the certificate of the given signature and its subject info
+func recordSigner(signature *eps.Signature) (*x509.Certificate, *SubjectInfo, error) {
+
+	if signature == nil {
+		return nil, nil, fmt.Errorf("signature missing")
+	}
 
 	cert, err := LoadCertificateFromString(signature.Certificate, true)
 
 	if err != nil {
-		return false, fmt.Errorf("error loading entry certificate: %w", err)
+		return nil, nil, fmt.Errorf("error loading entry certificate: %w", err)
 	}
 
 	subjectInfo, err := GetSubjectInfo(cert)
 
 	if err != nil {
-		return false, fmt.Errorf("error retrieving subject info: %w", err)
+		return nil, nil, fmt.Errorf("error retrieving subject info: %w", err)
 	}
 
-	admin := false
-	for _, group := range subjectInfo.Groups {
-		if group == "sd-admin" {
-			// service directory admins can upload its own certificate info
-			// (but only if that info doesn't exist yet)
-			admin = true
-			break
-		}
+	return cert, subjectInfo, nil
+}
+
+// Verifies a single signature of a record (without signatures), checking the
+// certificate against the signer's entry
+func verifyRecordSignature(record *eps.SignedChangeRecord, signature *eps.Signature, cert *x509.Certificate, subjectInfo *SubjectInfo, signerEntry func(name string) *eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate) (bool, error) {
+
+	signedData := &eps.SignedData{
+		Data:      record,
+		Signature: signature,
 	}
 
-	// only service-directory admins can continue
-	if !admin {
+	entry := signerEntry(subjectInfo.Name)
+
+	if entry == nil {
+		entry = eps.MakeDirectoryEntry()
+	} else if entry.Deleted {
+		// decommissioned operators (including admins) cannot sign anymore
 		return false, nil
 	}
 
-	fingerprint := GetRecordFingerprint(verifiedRecords, subjectInfo.Name, "signing")
+	certificates := make([]*eps.OperatorCertificate, 0)
+
+	for _, certificate := range entry.Certificates {
+		if certificate.KeyUsage == "signing" {
+			certificates = append(certificates, certificate)
+		}
+	}
 
-	if fingerprint != "" {
-		if !VerifyFingerprint(cert, fingerprint) {
-			// the fingerprint does not match the one we have on record
+	// we check the certificate against the ones we have on record, using
+	// the creation time of the record so that verification is reproducible
+	// (records can't be older than their parent, see 'VerifyRecordTime')
+	if len(certificates) > 0 {
+		found := false
+		for _, certificate := range certificates {
+			if certificate.ValidAt(record.Record.CreatedAt.Time) && VerifyFingerprint(cert, certificate.Fingerprint) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// the fingerprint does not match any valid one we have on record
 			return false, nil
 		}
+	} else if !IsAdmin(subjectInfo) {
+		// operators can only change their own records if an admin has
+		// registered their signing certificate before
+		return false, nil
 	}
 
 	// finally we verify the cryptographic signature
-	return Verify(signedData, rootCerts, intermediateCerts, "")
+	return VerifyWithRevocations(signedData, rootCerts, intermediateCerts, "", entry.Revocations)
+}
+
+// Adds a co-signature to a record, e.g. to a proposal that needs to be signed
+// by a quorum of admins. Co-signatures sign the same data as the signature.
+func CosignRecord(record *eps.SignedChangeRecord, key *ecdsa.PrivateKey, cert *x509.Certificate) error {
+
+	if ok, err := VerifyRecordHash(record); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("invalid hash value")
+	}
+
+	signature, signatures := record.Signature, record.Signatures
+	record.Signature, record.Signatures = nil, nil
+	signedData, err := Sign(record, key, cert)
+	record.Signature, record.Signatures = signature, signatures
+
+	if err != nil {
+		return err
+	}
+
+	record.Signatures = append(record.Signatures, signedData.Signature)
+
+	return nil
+}
+
+// Copies an entry so that records can be integrated into it without
+// modifying the original (which might still be in use elsewhere)
+func CopyEntry(entry *eps.DirectoryEntry) *eps.DirectoryEntry {
+	entryCopy := *entry
+	entryCopy.Records = append([]*eps.SignedChangeRecord{}, entry.Records...)
+	entryCopy.Scheduled = append([]*eps.SignedChangeRecord{}, entry.Scheduled...)
+	return &entryCopy
+}
+
+// Verifies the given records one after another and integrates them into a
+// copy of the given entries, which is returned. The given entries are not
+// modified. Returns an error if one of the records is invalid. The parent of
+// the first record was created at the given time (see 'VerifyRecordTime').
+func VerifyAndIntegrateRecords(records []*eps.SignedChangeRecord, entries map[string]*eps.DirectoryEntry, parentCreatedAt time.Time, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (map[string]*eps.DirectoryEntry, error) {
+
+	newEntries := make(map[string]*eps.DirectoryEntry, len(entries))
+
+	for name, entry := range entries {
+		newEntries[name] = entry
+	}
+
+	copied := map[string]bool{}
+
+	for _, record := range records {
+		if !VerifyRecordTime(record, parentCreatedAt) {
+			return nil, fmt.Errorf("record '%s' was created before its parent", record.Hash)
+		}
+
+		parentCreatedAt = record.Record.CreatedAt.Time
+
+		if ok, err := VerifyRecordWithEntries(record, newEntries, rootCerts, intermediateCerts, quorum); err != nil {
+			return nil, fmt.Errorf("cannot verify record '%s': %w", record.Hash, err)
+		} else if !ok {
+			return nil, fmt.Errorf("invalid record '%s' found", record.Hash)
+		}
+
+		name := record.Record.Name
+		entry, ok := newEntries[name]
+
+		if !ok {
+			entry = eps.MakeDirectoryEntry()
+			entry.Name = name
+			copied[name] = true
+		} else if !copied[name] {
+			entry = CopyEntry(entry)
+			copied[name] = true
+		}
+
+		if err := IntegrateChangeRecord(record, entry); err != nil {
+			return nil, fmt.Errorf("error integrating change record: %w", err)
+		}
+
+		newEntries[name] = entry
+	}
+
+	return newEntries, nil
 }
 
 func CalculateRecordHash(record *eps.SignedChangeRecord) error {
@@ -0,0 +1,213 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/x509"
+	"github.com/iris-connect/eps"
+	"testing"
+	"time"
+)
+
+func TestIsAuthorizedFor(t *testing.T) {
+
+	admin := &SubjectInfo{Name: "sd-1", Groups: []string{"sd-admin"}}
+	operator := &SubjectInfo{Name: "hd-1", Groups: []string{"health-departments"}}
+
+	record := func(parentHash, name, section string) *eps.SignedChangeRecord {
+		return &eps.SignedChangeRecord{
+			ParentHash: parentHash,
+			Record: &eps.ChangeRecord{
+				Name:    name,
+				Section: section,
+			},
+		}
+	}
+
+	for _, testCase := range []struct {
+		subject    *SubjectInfo
+		record     *eps.SignedChangeRecord
+		authorized bool
+	}{
+		{admin, record("", "hd-1", "services"), true},
+		{admin, record("abc", "hd-1", "groups"), true},
+		{operator, record("abc", "hd-1", "preferences"), true},
+		{operator, record("abc", "hd-1", "certificates"), true},
+		{operator, record("abc", "hd-1", "services"), false},
+		{operator, record("abc", "hd-1", "settings"), false},
+		{operator, record("abc", "hd-1", "groups"), false},
+		{operator, record("abc", "hd-2", "preferences"), false},
+		// operators cannot start a new chain
+		{operator, record("", "hd-1", "preferences"), false},
+	} {
+		if IsAuthorizedFor(testCase.subject, testCase.record) != testCase.authorized {
+			t.Errorf("expected authorized=%v for '%s' changing section '%s' of '%s'", testCase.authorized, testCase.subject.Name, testCase.record.Record.Section, testCase.record.Record.Name)
+		}
+	}
+}
+
+func TestDeleteChangeRecords(t *testing.T) {
+
+	entry := eps.MakeDirectoryEntry()
+	entry.Name = "hd-1"
+	entry.Channels = []*eps.OperatorChannel{{Type: "grpc_client"}, {Type: "grpc_server"}}
+	entry.Groups = []string{"health-departments", "berlin"}
+	entry.Labels = map[string]string{"state": "berlin", "vendor": "acme"}
+	entry.Revocations = []*eps.OperatorRevocation{{Fingerprint: "abc"}}
+
+	record := func(section string, data interface{}) *eps.SignedChangeRecord {
+		return &eps.SignedChangeRecord{
+			Record: &eps.ChangeRecord{
+				Name:    "hd-1",
+				Section: section,
+				Op:      eps.DeleteOp,
+				Data:    data,
+			},
+		}
+	}
+
+	for _, r := range []*eps.SignedChangeRecord{
+		record("channels", []interface{}{"grpc_server"}),
+		record("groups", nil),
+		record("labels", []string{"vendor"}),
+	} {
+		if err := IntegrateChangeRecord(r, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(entry.Channels) != 1 || entry.Channels[0].Type != "grpc_client" {
+		t.Errorf("expected only the 'grpc_client' channel to remain")
+	}
+
+	if len(entry.Groups) != 0 {
+		t.Errorf("expected all groups to be deleted")
+	}
+
+	if len(entry.Labels) != 1 || entry.Labels["state"] != "berlin" {
+		t.Errorf("expected only the 'state' label to remain")
+	}
+
+	if err := IntegrateChangeRecord(record("entry", nil), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if !entry.Deleted || len(entry.Channels) != 0 || len(entry.Revocations) != 1 || len(entry.Records) != 4 {
+		t.Errorf("expected a tombstone with revocations and records")
+	}
+
+	for _, r := range []*eps.SignedChangeRecord{
+		record("revocations", nil),
+		record("settings", []string{"foo"}),
+		record("entry", []string{"foo"}),
+		{Record: &eps.ChangeRecord{Name: "hd-1", Section: "entry", Data: []string{}}},
+		{Record: &eps.ChangeRecord{Name: "hd-1", Section: "groups", Op: "update", Data: []string{}}},
+	} {
+		if err := IntegrateChangeRecord(r, entry); err == nil {
+			t.Errorf("expected an error for op '%s' on section '%s'", r.Record.Op, r.Record.Section)
+		}
+	}
+}
+
+func TestBackdatedRecord(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	oldCert := makeTestCertificate(t, 2, "hd-1", nil, root)
+	newCert := makeTestCertificate(t, 3, "hd-1", nil, root)
+
+	rootCerts := []*x509.Certificate{root.cert}
+
+	// the old certificate was rotated half an hour ago
+	rotatedAt := time.Now().Add(-30 * time.Minute)
+
+	entry := eps.MakeDirectoryEntry()
+	entry.Name = "hd-1"
+	entry.Certificates = []*eps.OperatorCertificate{
+		{Fingerprint: CertificateFingerprint(oldCert.cert), KeyUsage: "signing", NotAfter: &rotatedAt},
+		{Fingerprint: CertificateFingerprint(newCert.cert), KeyUsage: "signing"},
+	}
+
+	entries := map[string]*eps.DirectoryEntry{"hd-1": entry}
+
+	makeRecord := func(signer *testSigner, createdAt time.Time) *eps.SignedChangeRecord {
+		record := &eps.SignedChangeRecord{
+			ParentHash: "ab",
+			Record: &eps.ChangeRecord{
+				Name:      "hd-1",
+				Section:   "certificates",
+				Data:      entry.Certificates,
+				CreatedAt: eps.HashableTime{Time: createdAt.UTC()},
+			},
+		}
+		if err := CalculateRecordHash(record); err != nil {
+			t.Fatal(err)
+		}
+		if signedData, err := Sign(record, signer.key, signer.cert); err != nil {
+			t.Fatal(err)
+		} else {
+			record.Signature = signedData.Signature
+		}
+		return record
+	}
+
+	parentCreatedAt := time.Now().Add(-10 * time.Minute)
+
+	// with a backdated creation time, the old certificate would still be valid
+	backdated := makeRecord(oldCert, time.Now().Add(-time.Hour))
+
+	if _, err := VerifyAndIntegrateRecords([]*eps.SignedChangeRecord{backdated}, entries, time.Time{}, rootCerts, nil, 1); err != nil {
+		t.Fatalf("expected the record to be valid without a parent: %v", err)
+	}
+
+	if _, err := VerifyAndIntegrateRecords([]*eps.SignedChangeRecord{backdated}, entries, parentCreatedAt, rootCerts, nil, 1); err == nil {
+		t.Fatalf("expected a record created before its parent to be rejected")
+	}
+
+	if _, err := VerifyAndIntegrateRecords([]*eps.SignedChangeRecord{makeRecord(oldCert, time.Now())}, entries, parentCreatedAt, rootCerts, nil, 1); err == nil {
+		t.Fatalf("expected a record signed with the rotated certificate to be rejected")
+	}
+
+	if _, err := VerifyAndIntegrateRecords([]*eps.SignedChangeRecord{makeRecord(newCert, time.Now())}, entries, parentCreatedAt, rootCerts, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckRevocation(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	revoked := makeTestCertificate(t, 2, "hd-1", nil, root)
+	valid := makeTestCertificate(t, 3, "hd-1", nil, root)
+
+	entry := eps.MakeDirectoryEntry()
+	entry.Name = "hd-1"
+	entry.Revocations = []*eps.OperatorRevocation{{Fingerprint: CertificateFingerprint(revoked.cert), Reason: "key compromise"}}
+
+	entryFor := func(name string) (*eps.DirectoryEntry, error) {
+		if name == entry.Name {
+			return entry, nil
+		}
+		return nil, eps.NoEntryFound
+	}
+
+	if err := CheckRevocation(revoked.cert, entryFor); err == nil {
+		t.Fatalf("expected the revoked certificate to be rejected")
+	}
+
+	if err := CheckRevocation(valid.cert, entryFor); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 )
 
 // Computes a hash of a structured data type that can contain various types
@@ -76,6 +77,8 @@ func ExtractTags(field reflect.StructField, tag string) []Tag {
 
 var NullValue = fmt.Errorf("null")
 
+var timeType = reflect.TypeOf(time.Time{})
+
 func addValue(sourceValue reflect.Value, h hash.Hash) error {
 
 	if sourceValue.IsZero() {
@@ -84,6 +87,12 @@ func addValue(sourceValue reflect.Value, h hash.Hash) error {
 
 	sourceType := sourceValue.Type()
 
+	// time values contain a location pointer, so we hash their textual
+	// representation (in UTC) instead
+	if sourceType == timeType && sourceValue.CanInterface() {
+		return addHash(sourceValue.Interface().(time.Time).UTC().Format(time.RFC3339Nano), h)
+	}
+
 	// if the type implements a custom hash value we add this instead of the normal one
 	if sourceType.Implements(reflect.TypeOf((*CustomHashValue)(nil)).Elem()) {
 		chv := sourceValue.Interface().(CustomHashValue)
@@ -21,6 +21,7 @@ package helpers
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 type MyStruct struct {
@@ -79,3 +80,26 @@ func TestBasicHash(t *testing.T) {
 		t.Errorf("Hashes should be different")
 	}
 }
+
+func TestTimeHash(t *testing.T) {
+	t1 := time.Date(2021, 5, 17, 10, 0, 0, 0, time.UTC)
+	t2 := t1.In(time.FixedZone("CEST", 2*60*60))
+	h1, err := StructuredHash(map[string]interface{}{"t": t1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := StructuredHash(map[string]interface{}{"t": &t2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h1, h2) {
+		t.Errorf("Hashes of equal times should be equal")
+	}
+	h3, err := StructuredHash(map[string]interface{}{"t": t1.Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(h1, h3) {
+		t.Errorf("Hashes of different times should be different")
+	}
+}
@@ -0,0 +1,125 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+Merkle trees as defined in RFC 6962 (Certificate Transparency). Leaf and
+node hashes use different prefixes to prevent second preimage attacks.
+*/
+
+package helpers
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+type MerkleTree struct {
+	// levels[0] contains the leaf hashes, the last level contains the root
+	levels [][][]byte
+}
+
+func MerkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Builds a tree from the given leaf hashes. Pairing the nodes level by level
+// and promoting an unpaired last node unchanged yields the same root as the
+// recursive definition in RFC 6962.
+func MakeMerkleTree(leaves [][]byte) *MerkleTree {
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		nextLevel := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				nextLevel = append(nextLevel, merkleNodeHash(level[i], level[i+1]))
+			} else {
+				nextLevel = append(nextLevel, level[i])
+			}
+		}
+		levels = append(levels, nextLevel)
+		level = nextLevel
+	}
+	return &MerkleTree{levels: levels}
+}
+
+func (t *MerkleTree) Size() int {
+	return len(t.levels[0])
+}
+
+func (t *MerkleTree) Root() []byte {
+	if t.Size() == 0 {
+		// the root of an empty tree is the hash of an empty string
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Returns the inclusion proof (audit path) for the leaf with the given index
+func (t *MerkleTree) Proof(index int) [][]byte {
+	if index < 0 || index >= t.Size() {
+		return nil
+	}
+	proof := make([][]byte, 0, len(t.levels))
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index >>= 1
+	}
+	return proof
+}
+
+// Verifies an inclusion proof for a leaf hash (RFC 9162, section 2.1.3.2)
+func VerifyMerkleProof(leaf []byte, index, size int, proof [][]byte, root []byte) bool {
+
+	if index < 0 || index >= size {
+		return false
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
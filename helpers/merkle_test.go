@@ -0,0 +1,64 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// the recursive definition of the tree hash from RFC 6962
+func referenceRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	return merkleNodeHash(referenceRoot(leaves[:k]), referenceRoot(leaves[k:]))
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for size := 1; size <= 33; size++ {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			leaves[i] = MerkleLeafHash([]byte(fmt.Sprintf("leaf-%d", i)))
+		}
+
+		tree := MakeMerkleTree(leaves)
+		root := tree.Root()
+
+		if !bytes.Equal(root, referenceRoot(leaves)) {
+			t.Fatalf("root does not match reference root for size %d", size)
+		}
+
+		for i := range leaves {
+			proof := tree.Proof(i)
+			if !VerifyMerkleProof(leaves[i], i, size, proof, root) {
+				t.Fatalf("proof for leaf %d of %d does not verify", i, size)
+			}
+			if VerifyMerkleProof(MerkleLeafHash([]byte("other")), i, size, proof, root) {
+				t.Fatalf("proof for leaf %d of %d verifies for a different leaf", i, size)
+			}
+			if size > 1 && VerifyMerkleProof(leaves[i], (i+1)%size, size, proof, root) {
+				t.Fatalf("proof for leaf %d of %d verifies for a different index", i, size)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"time"
+)
+
+func MakePin(hash string) *eps.Pin {
+	return &eps.Pin{
+		Hash:      hash,
+		CreatedAt: eps.HashableTime{Time: time.Now().UTC()},
+	}
+}
+
+func SignPin(pin *eps.Pin, key *ecdsa.PrivateKey, cert *x509.Certificate) (*eps.SignedPin, error) {
+
+	data, err := genericData(pin)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, err := Sign(data, key, cert)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &eps.SignedPin{
+		Pin:       pin,
+		Signature: signedData.Signature,
+	}, nil
+}
+
+// Adds the signature of another admin to the pin
+func CosignPin(signedPin *eps.SignedPin, key *ecdsa.PrivateKey, cert *x509.Certificate) error {
+
+	cosignedPin, err := SignPin(signedPin.Pin, key, cert)
+
+	if err != nil {
+		return err
+	}
+
+	signedPin.Signatures = append(signedPin.Signatures, cosignedPin.Signature)
+
+	return nil
+}
+
+// Verifies that the pin was signed by at least 'quorum' different admins. The
+// entries need to be the ones we already trust (e.g. of the current canonical
+// chain), not the ones of the chain that contains the pinned record, as that
+// chain could simply leave out the revocation of a stolen admin key. All
+// signatures need to be valid.
+func VerifyPin(signedPin *eps.SignedPin, entries map[string]*eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int) (bool, error) {
+
+	if signedPin.Pin == nil || signedPin.Signature == nil {
+		return false, fmt.Errorf("incomplete pin")
+	}
+
+	data, err := genericData(signedPin.Pin)
+
+	if err != nil {
+		return false, err
+	}
+
+	signatures := append([]*eps.Signature{signedPin.Signature}, signedPin.Signatures...)
+
+	return verifyAdminQuorum(data, signatures, func(name string) *eps.DirectoryEntry {
+		return entries[name]
+	}, rootCerts, intermediateCerts, quorum)
+}
+
+// Verifies that the pin was signed with the key of one of the given pin
+// certificates, which are configured separately from the admin certificates
+func VerifyPinKey(signedPin *eps.SignedPin, pinCerts []*x509.Certificate) (bool, error) {
+
+	if signedPin.Pin == nil || signedPin.Signature == nil {
+		return false, fmt.Errorf("incomplete pin")
+	}
+
+	data, err := genericData(signedPin.Pin)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, signature := range append([]*eps.Signature{signedPin.Signature}, signedPin.Signatures...) {
+
+		cert, err := LoadCertificateFromString(signature.Certificate, true)
+
+		if err != nil {
+			return false, fmt.Errorf("error loading signing certificate: %w", err)
+		}
+
+		for _, pinCert := range pinCerts {
+			if !cert.Equal(pinCert) {
+				continue
+			}
+			// the certificate was configured explicitly, so we only need to
+			// check the signature itself
+			if ok, err := Verify(&eps.SignedData{Data: data, Signature: signature}, nil, nil, ""); err != nil {
+				return false, err
+			} else if ok {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Verifies that the pin may endorse a chain: it needs to be signed with one
+// of the pin keys or by 'quorum' admins, based on the trusted entries. With a
+// quorum of one, a single stolen admin key would suffice to switch to a new
+// chain, so we only accept such pins if 'singleAdmin' is set (e.g. because
+// chains are restricted to a pinned root anyway).
+func VerifyPinEndorsement(signedPin *eps.SignedPin, entries map[string]*eps.DirectoryEntry, pinCerts []*x509.Certificate, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, quorum int, singleAdmin bool) (bool, error) {
+
+	if len(pinCerts) > 0 {
+		if ok, err := VerifyPinKey(signedPin, pinCerts); err != nil || ok {
+			return ok, err
+		}
+	}
+
+	if quorum < 2 && !singleAdmin {
+		return false, nil
+	}
+
+	return VerifyPin(signedPin, entries, rootCerts, intermediateCerts, quorum)
+}
+
+// Parses a pin from its generic JSON form (e.g. from an API response)
+func ParsePin(data interface{}) (*eps.SignedPin, error) {
+	signedPin := &eps.SignedPin{}
+	if jsonData, err := json.Marshal(data); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonData, signedPin); err != nil {
+		return nil, fmt.Errorf("invalid pin: %w", err)
+	}
+	return signedPin, nil
+}
@@ -0,0 +1,88 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"github.com/iris-connect/eps"
+	"strings"
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	admin1 := makeTestCertificate(t, 2, "sd-1", []string{"sd-admin"}, root)
+	admin2 := makeTestCertificate(t, 3, "sd-2", []string{"sd-admin"}, root)
+	operator := makeTestCertificate(t, 4, "hd-1", nil, root)
+
+	rootCerts := []*x509.Certificate{root.cert}
+	entries := map[string]*eps.DirectoryEntry{}
+
+	verify := func(signedPin *eps.SignedPin, quorum int) bool {
+		ok, err := VerifyPin(signedPin, entries, rootCerts, nil, quorum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	pin := MakePin(strings.Repeat("ab", 32))
+
+	signedPin, err := SignPin(pin, operator.key, operator.cert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verify(signedPin, 1) {
+		t.Fatalf("expected a pin signed by an operator to be rejected")
+	}
+
+	if signedPin, err = SignPin(pin, admin1.key, admin1.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if !verify(signedPin, 1) || verify(signedPin, 2) {
+		t.Fatalf("expected a single admin signature to satisfy a quorum of one only")
+	}
+
+	if err := CosignPin(signedPin, admin2.key, admin2.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	// pins are stored and transmitted as JSON
+	var roundTripPin *eps.SignedPin
+
+	if jsonData, err := json.Marshal(signedPin); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(jsonData, &roundTripPin); err != nil {
+		t.Fatal(err)
+	}
+
+	if !verify(roundTripPin, 2) {
+		t.Fatalf("expected two admin signatures to be sufficient")
+	}
+
+	// deleted admins cannot sign pins anymore
+	entries["sd-2"] = &eps.DirectoryEntry{Name: "sd-2", Deleted: true}
+
+	if verify(roundTripPin, 2) {
+		t.Fatalf("expected a signature of a deleted admin to be rejected")
+	}
+}
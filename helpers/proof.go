@@ -0,0 +1,239 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"sort"
+	"time"
+)
+
+// A Merkle tree over directory entries, ordered by name
+type EntriesTree struct {
+	Hash    string
+	tree    *MerkleTree
+	entries []*eps.DirectoryEntry
+	indexes map[string]int
+}
+
+// Like checkpoint entries, entries in the tree do not contain records
+func proofEntry(entry *eps.DirectoryEntry) *eps.DirectoryEntry {
+	entryCopy := *entry
+	entryCopy.Records = []*eps.SignedChangeRecord{}
+	return &entryCopy
+}
+
+// Returns the leaf hash of an entry, which we compute over the generic JSON
+// form of the entry (without records), as clients receive it in that form.
+func EntryLeafHash(entry *eps.DirectoryEntry) ([]byte, error) {
+
+	data, err := genericData(proofEntry(entry))
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := StructuredHash(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return MerkleLeafHash(hash), nil
+}
+
+// Builds the entries tree for the given tip record
+func MakeEntriesTree(tip *eps.SignedChangeRecord, entries map[string]*eps.DirectoryEntry) (*EntriesTree, error) {
+
+	treeEntries := make([]*eps.DirectoryEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		treeEntries = append(treeEntries, proofEntry(entry))
+	}
+
+	sort.Slice(treeEntries, func(i, j int) bool { return treeEntries[i].Name < treeEntries[j].Name })
+
+	leaves := make([][]byte, len(treeEntries))
+	indexes := make(map[string]int, len(treeEntries))
+
+	for i, entry := range treeEntries {
+		leaf, err := EntryLeafHash(entry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot hash entry '%s': %w", entry.Name, err)
+		}
+		leaves[i] = leaf
+		indexes[entry.Name] = i
+	}
+
+	return &EntriesTree{
+		Hash:    tip.Hash,
+		tree:    MakeMerkleTree(leaves),
+		entries: treeEntries,
+		indexes: indexes,
+	}, nil
+}
+
+func (t *EntriesTree) Root() *eps.EntriesRoot {
+	return &eps.EntriesRoot{
+		Hash:       t.Hash,
+		Size:       int64(t.tree.Size()),
+		MerkleRoot: hex.EncodeToString(t.tree.Root()),
+		CreatedAt:  eps.HashableTime{Time: time.Now().UTC()},
+	}
+}
+
+// Returns the entry with the given name and its inclusion proof for the given
+// signed root, or nil if no such entry exists
+func (t *EntriesTree) Proof(name string, signedRoot *eps.SignedEntriesRoot) *eps.EntryProof {
+
+	index, ok := t.indexes[name]
+
+	if !ok {
+		return nil
+	}
+
+	path := make([]string, 0)
+
+	for _, hash := range t.tree.Proof(index) {
+		path = append(path, hex.EncodeToString(hash))
+	}
+
+	return &eps.EntryProof{
+		Entry:       t.entries[index],
+		Index:       int64(index),
+		Path:        path,
+		EntriesRoot: signedRoot,
+	}
+}
+
+func SignEntriesRoot(root *eps.EntriesRoot, key *ecdsa.PrivateKey, cert *x509.Certificate) (*eps.SignedEntriesRoot, error) {
+
+	data, err := genericData(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, err := Sign(data, key, cert)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &eps.SignedEntriesRoot{
+		EntriesRoot: root,
+		Signature:   signedData.Signature,
+	}, nil
+}
+
+// we accept entries roots that are dated slightly into the future
+const maxEntriesRootSkew = 5 * time.Minute
+
+// Verifies that the entries root was signed by a service directory admin and
+// is not older than maxAge (if it is positive). A proof is only as strong as
+// the admin key that signed it: revocations are only taken into account if
+// the client passes entries it already trusts (e.g. from an earlier sync).
+// Without them, a stolen admin key can sign arbitrary roots, while maxAge
+// limits how long an outdated root (e.g. with a since revoked certificate)
+// can be replayed.
+func VerifyEntriesRoot(signedRoot *eps.SignedEntriesRoot, entries map[string]*eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, maxAge time.Duration) (bool, error) {
+
+	if signedRoot.EntriesRoot == nil || signedRoot.Signature == nil {
+		return false, fmt.Errorf("incomplete entries root")
+	}
+
+	age := time.Since(signedRoot.EntriesRoot.CreatedAt.Time)
+
+	if age < -maxEntriesRootSkew || (maxAge > 0 && age > maxAge) {
+		return false, nil
+	}
+
+	data, err := genericData(signedRoot.EntriesRoot)
+
+	if err != nil {
+		return false, err
+	}
+
+	deleted := false
+
+	if ok, err := verifyAdminSignature(data, signedRoot.Signature, rootCerts, intermediateCerts, func(name string) []*eps.OperatorRevocation {
+		if entry, ok := entries[name]; ok {
+			deleted = entry.Deleted
+			return entry.Revocations
+		}
+		return nil
+	}); err != nil || !ok {
+		return false, err
+	}
+
+	return !deleted, nil
+}
+
+// Verifies that the entry of the proof is included in the signed entries root
+// (see 'VerifyEntriesRoot' for the meaning of entries and maxAge)
+func VerifyEntryProof(proof *eps.EntryProof, entries map[string]*eps.DirectoryEntry, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, maxAge time.Duration) (bool, error) {
+
+	if proof.Entry == nil || proof.EntriesRoot == nil {
+		return false, fmt.Errorf("incomplete entry proof")
+	}
+
+	if ok, err := VerifyEntriesRoot(proof.EntriesRoot, entries, rootCerts, intermediateCerts, maxAge); err != nil {
+		return false, fmt.Errorf("cannot verify entries root: %w", err)
+	} else if !ok {
+		return false, nil
+	}
+
+	root, err := hex.DecodeString(proof.EntriesRoot.EntriesRoot.MerkleRoot)
+
+	if err != nil {
+		return false, fmt.Errorf("invalid Merkle root: %w", err)
+	}
+
+	path := make([][]byte, 0, len(proof.Path))
+
+	for _, hexHash := range proof.Path {
+		hash, err := hex.DecodeString(hexHash)
+		if err != nil {
+			return false, fmt.Errorf("invalid proof path: %w", err)
+		}
+		path = append(path, hash)
+	}
+
+	leaf, err := EntryLeafHash(proof.Entry)
+
+	if err != nil {
+		return false, err
+	}
+
+	return VerifyMerkleProof(leaf, int(proof.Index), int(proof.EntriesRoot.EntriesRoot.Size), path, root), nil
+}
+
+// Parses an entry proof from its generic JSON form (e.g. from an API response)
+func ParseEntryProof(data interface{}) (*eps.EntryProof, error) {
+	proof := &eps.EntryProof{}
+	if jsonData, err := json.Marshal(data); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(jsonData, proof); err != nil {
+		return nil, fmt.Errorf("invalid entry proof: %w", err)
+	}
+	return proof, nil
+}
@@ -0,0 +1,87 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/x509"
+	"github.com/iris-connect/eps"
+	"testing"
+	"time"
+)
+
+func TestEntryProofAge(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	admin := makeTestCertificate(t, 2, "sd-1", []string{"sd-admin"}, root)
+
+	rootCerts := []*x509.Certificate{root.cert}
+
+	entries := map[string]*eps.DirectoryEntry{}
+
+	for _, name := range []string{"hd-1", "hd-2", "hd-3"} {
+		entry := eps.MakeDirectoryEntry()
+		entry.Name = name
+		entries[name] = entry
+	}
+
+	tree, err := MakeEntriesTree(&eps.SignedChangeRecord{Hash: "ab"}, entries)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeProof := func(createdAt time.Time) *eps.EntryProof {
+		entriesRoot := tree.Root()
+		entriesRoot.CreatedAt = eps.HashableTime{Time: createdAt.UTC()}
+		signedRoot, err := SignEntriesRoot(entriesRoot, admin.key, admin.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tree.Proof("hd-2", signedRoot)
+	}
+
+	if ok, err := VerifyEntryProof(makeProof(time.Now()), nil, rootCerts, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("expected the proof to be valid")
+	}
+
+	// outdated roots are rejected
+	if ok, err := VerifyEntryProof(makeProof(time.Now().Add(-2*time.Hour)), nil, rootCerts, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected an outdated proof to be rejected")
+	}
+
+	// so are roots from the future, which would never become outdated
+	if ok, err := VerifyEntryProof(makeProof(time.Now().Add(2*time.Hour)), nil, rootCerts, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected a proof from the future to be rejected")
+	}
+
+	// with trusted entries, we take revocations of the admin into account
+	adminEntry := eps.MakeDirectoryEntry()
+	adminEntry.Name = "sd-1"
+	adminEntry.Revocations = []*eps.OperatorRevocation{{Fingerprint: CertificateFingerprint(admin.cert), Reason: "key stolen"}}
+
+	if ok, err := VerifyEntryProof(makeProof(time.Now()), map[string]*eps.DirectoryEntry{"sd-1": adminEntry}, rootCerts, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected a proof signed by a revoked admin to be rejected")
+	}
+}
@@ -0,0 +1,249 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/iris-connect/eps"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testSigner struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func makeTestCertificate(t *testing.T, serial int64, name string, groups []string, parent *testSigner) *testSigner {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	signerKey, signerCert := key, template
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+		template.DNSNames = []string{name}
+		template.URIs = []*url.URL{{Scheme: "iris-name", Host: name}}
+		for _, group := range groups {
+			template.URIs = append(template.URIs, &url.URL{Scheme: "iris-group", Host: group})
+		}
+		signerKey, signerCert = parent.key, parent.cert
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testSigner{key: key, cert: cert}
+}
+
+func TestRecordQuorum(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	admin1 := makeTestCertificate(t, 2, "sd-1", []string{"sd-admin"}, root)
+	admin2 := makeTestCertificate(t, 3, "sd-2", []string{"sd-admin"}, root)
+	operator := makeTestCertificate(t, 4, "hd-1", nil, root)
+
+	rootCerts := []*x509.Certificate{root.cert}
+
+	makeRecord := func() *eps.SignedChangeRecord {
+		record := &eps.SignedChangeRecord{
+			Record: &eps.ChangeRecord{
+				Name:      "hd-1",
+				Section:   "groups",
+				Data:      []string{"health-departments"},
+				CreatedAt: eps.HashableTime{Time: time.Now().UTC()},
+			},
+		}
+		if err := CalculateRecordHash(record); err != nil {
+			t.Fatal(err)
+		}
+		if signedData, err := Sign(record, admin1.key, admin1.cert); err != nil {
+			t.Fatal(err)
+		} else {
+			record.Signature = signedData.Signature
+		}
+		return record
+	}
+
+	verify := func(record *eps.SignedChangeRecord, quorum int) bool {
+		ok, err := VerifyRecordWithEntries(record, map[string]*eps.DirectoryEntry{}, rootCerts, nil, quorum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	record := makeRecord()
+
+	if !verify(record, 1) {
+		t.Fatalf("expected a single admin signature to be sufficient")
+	}
+
+	if verify(record, 2) {
+		t.Fatalf("expected a single admin signature to be insufficient")
+	}
+
+	// signatures of the same admin only count once
+	if err := CosignRecord(record, admin1.key, admin1.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if verify(record, 2) {
+		t.Fatalf("expected duplicate signatures not to count")
+	}
+
+	record = makeRecord()
+
+	if err := CosignRecord(record, admin2.key, admin2.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if !verify(record, 2) {
+		t.Fatalf("expected two admin signatures to be sufficient")
+	}
+
+	if verify(record, 3) {
+		t.Fatalf("expected two admin signatures to be insufficient")
+	}
+
+	// co-signatures by operators make the record invalid
+	if err := CosignRecord(record, operator.key, operator.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if verify(record, 2) {
+		t.Fatalf("expected a co-signature by an operator to be rejected")
+	}
+}
+
+func TestCheckpointQuorum(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	admin1 := makeTestCertificate(t, 2, "sd-1", []string{"sd-admin"}, root)
+	admin2 := makeTestCertificate(t, 3, "sd-2", []string{"sd-admin"}, root)
+
+	rootCerts := []*x509.Certificate{root.cert}
+
+	record := &eps.SignedChangeRecord{
+		Hash: "ab",
+		Record: &eps.ChangeRecord{
+			CreatedAt: eps.HashableTime{Time: time.Now().UTC()},
+		},
+	}
+
+	checkpoint, err := SignCheckpoint(MakeCheckpoint(record, record, 1, map[string]*eps.DirectoryEntry{}), admin1.key, admin1.cert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(quorum int) bool {
+		ok, err := VerifyCheckpoint(checkpoint, nil, rootCerts, nil, quorum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !verify(1) {
+		t.Fatalf("expected a single admin signature to be sufficient")
+	}
+
+	if verify(2) {
+		t.Fatalf("expected a checkpoint with a single admin signature to be rejected")
+	}
+
+	// signatures of the same admin only count once
+	if err := CosignCheckpoint(checkpoint, admin1.key, admin1.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if verify(2) {
+		t.Fatalf("expected duplicate signatures not to count")
+	}
+
+	if err := CosignCheckpoint(checkpoint, admin2.key, admin2.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if !verify(2) {
+		t.Fatalf("expected two admin signatures to be sufficient")
+	}
+}
+
+func TestCheckpointRevokedAdmin(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", nil, nil)
+	admin := makeTestCertificate(t, 2, "sd-1", []string{"sd-admin"}, root)
+
+	rootCerts := []*x509.Certificate{root.cert}
+
+	record := &eps.SignedChangeRecord{
+		Hash: "ab",
+		Record: &eps.ChangeRecord{
+			CreatedAt: eps.HashableTime{Time: time.Now().UTC()},
+		},
+	}
+
+	// the checkpoint leaves out the revocation of the admin
+	checkpoint, err := SignCheckpoint(MakeCheckpoint(record, record, 1, map[string]*eps.DirectoryEntry{}), admin.key, admin.cert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trustedEntry := eps.MakeDirectoryEntry()
+	trustedEntry.Name = "sd-1"
+	trustedEntry.Revocations = []*eps.OperatorRevocation{{Fingerprint: CertificateFingerprint(admin.cert), Reason: "key stolen"}}
+
+	if ok, err := VerifyCheckpoint(checkpoint, map[string]*eps.DirectoryEntry{"sd-1": trustedEntry}, rootCerts, nil, 1); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected a checkpoint signed by a revoked admin to be rejected")
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/tls"
 	"io/ioutil"
 	"math/big"
 	"net/url"
@@ -69,10 +70,14 @@ func LoadCertificate(path string, verifyUsage bool) (*x509.Certificate, error) {
 	return LoadCertificateFromString(string(certificatePEM), verifyUsage)
 }
 
-func VerifyFingerprint(cert *x509.Certificate, fingerprint string) bool {
+// Returns the SHA-256 fingerprint of the certificate (as used in the directory)
+func CertificateFingerprint(cert *x509.Certificate) string {
 	hash := sha256.Sum256(cert.Raw)
-	hexHash := hex.EncodeToString(hash[:])
-	return hexHash == fingerprint
+	return hex.EncodeToString(hash[:])
+}
+
+func VerifyFingerprint(cert *x509.Certificate, fingerprint string) bool {
+	return CertificateFingerprint(cert) == fingerprint
 }
 
 func LoadCertificateFromString(data string, verifyUsage bool) (*x509.Certificate, error) {
@@ -178,6 +183,76 @@ func Verify(signedData *eps.SignedData, rootCerts []*x509.Certificate, intermedi
 	}
 }
 
+// Works like Verify but rejects signatures made with a revoked certificate
+func VerifyWithRevocations(signedData *eps.SignedData, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, name string, revocations []*eps.OperatorRevocation) (bool, error) {
+	return VerifyWithRevocationList(signedData, rootCerts, intermediateCerts, name, revocations, nil)
+}
+
+// Works like VerifyWithRevocations but also rejects signatures made with a
+// certificate that was revoked by one of the given CRLs (if any), which are
+// checked for the signing certificate and the intermediate certificates
+func VerifyWithRevocationList(signedData *eps.SignedData, rootCerts []*x509.Certificate, intermediateCerts []*x509.Certificate, name string, revocations []*eps.OperatorRevocation, revocationList *tls.RevocationList) (bool, error) {
+
+	cert, err := LoadCertificateFromString(signedData.Signature.Certificate, true)
+
+	if err != nil {
+		return false, err
+	}
+
+	fingerprint := CertificateFingerprint(cert)
+
+	for _, revocation := range revocations {
+		if revocation.Fingerprint == fingerprint {
+			eps.Log.Warningf("Signature made with revoked certificate '%s' (reason: '%s')", fingerprint, revocation.Reason)
+			return false, nil
+		}
+	}
+
+	if revocationList != nil {
+		for _, chainCert := range append([]*x509.Certificate{cert}, intermediateCerts...) {
+			// the reason is logged by the revocation list
+			if err := revocationList.Check(chainCert, intermediateCerts); err != nil {
+				return false, nil
+			}
+		}
+	}
+
+	return Verify(signedData, rootCerts, intermediateCerts, name)
+}
+
+// Returns an error if the certificate has been revoked in the directory entry
+// of one of the names it was issued for and logs the reason of the revocation
+func CheckRevocation(cert *x509.Certificate, entryFor func(name string) (*eps.DirectoryEntry, error)) error {
+
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+
+	if subjectInfo, err := GetSubjectInfo(cert); err != nil {
+		return err
+	} else if subjectInfo.Name != "" {
+		names = append(names, subjectInfo.Name)
+	}
+
+	fingerprint := CertificateFingerprint(cert)
+
+	for _, name := range names {
+		entry, err := entryFor(name)
+		if err == eps.NoEntryFound {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error retrieving directory entry for '%s' for revocation check: %w", name, err)
+		}
+		if entry == nil {
+			continue
+		}
+		if revocation := entry.Revocation(fingerprint); revocation != nil {
+			eps.Log.Warningf("Rejecting revoked certificate of '%s' (reason: '%s')", name, revocation.Reason)
+			return fmt.Errorf("the certificate of '%s' has been revoked", name)
+		}
+	}
+
+	return nil
+}
+
 type SubjectInfo struct {
 	Name     string
 	DNSNames []string
@@ -19,6 +19,7 @@ package http
 import (
 	"context"
 	cryptoTls "crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/iris-connect/eps"
 	epsNet "github.com/iris-connect/eps/net"
@@ -62,6 +63,7 @@ type HTTPServer struct {
 	err         error
 	server      *http.Server
 	routeGroups []*RouteGroup
+	certCheck   func(*x509.Certificate) error
 }
 
 func initializeRouteGroup(routeGroup *RouteGroup) error {
@@ -128,6 +130,42 @@ func (h *HTTPServer) SetTLSConfig(config *cryptoTls.Config) {
 	h.tlsConfig = config
 }
 
+// Sets a function that checks the peer certificate of every TLS connection
+// in addition to the TLS config (e.g. against revocations in the directory)
+func (h *HTTPServer) SetCertificateCheck(check func(*x509.Certificate) error) {
+	h.certCheck = check
+}
+
+// Returns a copy of the TLS config that also applies the certificate check
+func (h *HTTPServer) withCertificateCheck(config *cryptoTls.Config) *cryptoTls.Config {
+
+	if h.certCheck == nil {
+		return config
+	}
+
+	config = config.Clone()
+	verifyPeerCertificate := config.VerifyPeerCertificate
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verifyPeerCertificate != nil {
+			if err := verifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		// clients might not present a certificate at all
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("cannot parse peer certificate: %w", err)
+		}
+		return h.certCheck(cert)
+	}
+
+	return config
+}
+
 func handleRouteGroup(context *Context, group *RouteGroup, handlers []Handler) {
 
 	for i, route := range group.Routes {
@@ -186,7 +224,7 @@ func (s *HTTPServer) Start() error {
 
 	if s.tlsConfig != nil {
 		useTLS = true
-		s.server.TLSConfig = s.tlsConfig
+		s.server.TLSConfig = s.withCertificateCheck(s.tlsConfig)
 	}
 
 	if s.listener == nil {
@@ -245,6 +283,13 @@ func (s *HTTPServer) Start() error {
 
 }
 
+// Returns the error that stopped the server (if any)
+func (s *HTTPServer) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
 func (s *HTTPServer) Stop() error {
 	eps.Log.Debugf("Shutting down HTTP server...")
 	return s.server.Shutdown(context.TODO())
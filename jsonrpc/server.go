@@ -17,6 +17,7 @@
 package jsonrpc
 
 import (
+	"crypto/x509"
 	"fmt"
 	"github.com/iris-connect/eps/http"
 )
@@ -67,27 +68,40 @@ func NotFound(c *http.Context) {
 }
 
 func MakeJSONRPCServer(settings *JSONRPCServerSettings, handler Handler) (*JSONRPCServer, error) {
+	return MakeJSONRPCServerWithRoutes(settings, handler, nil)
+}
+
+// Like 'MakeJSONRPCServer', but serves the given routes alongside the JSON-RPC
+// route (e.g. for plain HTTP endpoints). The routes share the CORS handler.
+func MakeJSONRPCServerWithRoutes(settings *JSONRPCServerSettings, handler Handler, routes []*http.Route) (*JSONRPCServer, error) {
+
+	allRoutes := []*http.Route{
+		{
+			Pattern: fmt.Sprintf("^%s$", settings.Path),
+			Handlers: []http.Handler{
+				ExtractJSONRequest,
+				JSONRPC(handler),
+			},
+		},
+	}
+
+	allRoutes = append(allRoutes, routes...)
+
+	// all other paths end up here
+	allRoutes = append(allRoutes, &http.Route{
+		Pattern: "^.*$",
+		Handlers: []http.Handler{
+			NotFound,
+		},
+	})
+
 	routeGroups := []*http.RouteGroup{
 		{
 			// these handlers will be executed for all routes in the group
 			Handlers: []http.Handler{
 				Cors(settings.Cors, false),
 			},
-			Routes: []*http.Route{
-				{
-					Pattern: fmt.Sprintf("^%s$", settings.Path),
-					Handlers: []http.Handler{
-						ExtractJSONRequest,
-						JSONRPC(handler),
-					},
-				},
-				{
-					Pattern: "^.*$",
-					Handlers: []http.Handler{
-						NotFound,
-					},
-				},
-			},
+			Routes: allRoutes,
 		},
 	}
 
@@ -111,6 +125,12 @@ func (s *JSONRPCServer) HTTPServer() *http.HTTPServer {
 	return s.server
 }
 
+// Sets a function that checks the client certificates of TLS connections in
+// addition to the CA certificates and CRLs (see 'http.HTTPServer')
+func (s *JSONRPCServer) SetCertificateCheck(check func(*x509.Certificate) error) {
+	s.server.SetCertificateCheck(check)
+}
+
 func (s *JSONRPCServer) Start() error {
 	return s.server.Start()
 }
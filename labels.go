@@ -0,0 +1,176 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+Directory entries can carry arbitrary key/value labels, which can be selected
+using a simple selector syntax. A selector consists of comma-separated
+requirements, all of which need to match:
+
+	state=berlin               label has the given value ('==' works as well)
+	state!=berlin              label is missing or has a different value
+	state in (berlin,hamburg)  label has one of the given values
+	state notin (berlin)       label is missing or has none of the values
+	vendor                     label exists
+	!vendor                    label does not exist
+*/
+
+package eps
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	LabelEquals       = "="
+	LabelNotEquals    = "!="
+	LabelIn           = "in"
+	LabelNotIn        = "notin"
+	LabelExists       = "exists"
+	LabelDoesNotExist = "!"
+)
+
+var LabelKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]{0,62}$`)
+
+var existsRegexp = regexp.MustCompile(`^(!?)\s*([^\s,()=!]+)$`)
+var comparisonRegexp = regexp.MustCompile(`^([^\s,()=!]+)\s*(==|=|!=)\s*([^,()=!]*)$`)
+var setRegexp = regexp.MustCompile(`^([^\s,()=!]+)\s+(in|notin)\s*\(([^()]*)\)$`)
+
+type LabelRequirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+type LabelSelector []*LabelRequirement
+
+// Splits the selector at all commas that are not within parentheses
+func splitSelector(selector string) ([]string, error) {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses")
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses")
+	}
+	return append(parts, selector[start:]), nil
+}
+
+func parseRequirement(requirement string) (*LabelRequirement, error) {
+
+	var labelRequirement *LabelRequirement
+
+	if match := existsRegexp.FindStringSubmatch(requirement); match != nil {
+		labelRequirement = &LabelRequirement{Key: match[2], Operator: LabelExists}
+		if match[1] == "!" {
+			labelRequirement.Operator = LabelDoesNotExist
+		}
+	} else if match := comparisonRegexp.FindStringSubmatch(requirement); match != nil {
+		labelRequirement = &LabelRequirement{Key: match[1], Operator: LabelEquals, Values: []string{strings.TrimSpace(match[3])}}
+		if match[2] == "!=" {
+			labelRequirement.Operator = LabelNotEquals
+		}
+	} else if match := setRegexp.FindStringSubmatch(requirement); match != nil {
+		labelRequirement = &LabelRequirement{Key: match[1], Operator: match[2]}
+		for _, value := range strings.Split(match[3], ",") {
+			labelRequirement.Values = append(labelRequirement.Values, strings.TrimSpace(value))
+		}
+	} else {
+		return nil, fmt.Errorf("invalid requirement '%s'", requirement)
+	}
+
+	if !LabelKeyRegexp.MatchString(labelRequirement.Key) {
+		return nil, fmt.Errorf("invalid label key '%s'", labelRequirement.Key)
+	}
+
+	return labelRequirement, nil
+}
+
+// Parses a label selector. An empty selector matches all entries.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+
+	labelSelector := LabelSelector{}
+
+	if strings.TrimSpace(selector) == "" {
+		return labelSelector, nil
+	}
+
+	parts, err := splitSelector(selector)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector: %w", err)
+	}
+
+	for _, part := range parts {
+		if requirement, err := parseRequirement(strings.TrimSpace(part)); err != nil {
+			return nil, fmt.Errorf("invalid label selector: %w", err)
+		} else {
+			labelSelector = append(labelSelector, requirement)
+		}
+	}
+
+	return labelSelector, nil
+}
+
+func (r *LabelRequirement) hasValue(value string) bool {
+	for _, v := range r.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *LabelRequirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case LabelExists:
+		return ok
+	case LabelDoesNotExist:
+		return !ok
+	case LabelEquals, LabelIn:
+		return ok && r.hasValue(value)
+	case LabelNotEquals, LabelNotIn:
+		return !ok || !r.hasValue(value)
+	}
+	return false
+}
+
+// Checks whether the labels fulfill all requirements of the selector
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
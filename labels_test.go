@@ -0,0 +1,58 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package eps
+
+import (
+	"testing"
+)
+
+func TestLabelSelector(t *testing.T) {
+
+	labels := map[string]string{
+		"state":    "berlin",
+		"district": "mitte",
+		"vendor":   "acme",
+	}
+
+	for selector, expected := range map[string]bool{
+		"":                                 true,
+		"state=berlin":                     true,
+		"state==berlin":                    true,
+		"state = hamburg":                  false,
+		"state!=hamburg":                   true,
+		"state in (hamburg, berlin)":       true,
+		"state notin (hamburg,berlin)":     false,
+		"contact notin (foo)":              true,
+		"vendor":                           true,
+		"!vendor":                          false,
+		"!contact":                         true,
+		"state=berlin,district in (mitte)": true,
+		"state=berlin, district=pankow":    false,
+	} {
+		if labelSelector, err := ParseLabelSelector(selector); err != nil {
+			t.Fatalf("cannot parse selector '%s': %v", selector, err)
+		} else if labelSelector.Matches(labels) != expected {
+			t.Fatalf("expected selector '%s' to return %v", selector, expected)
+		}
+	}
+
+	for _, selector := range []string{"state in (berlin", "state=berlin,", "=berlin", "state in berlin", "-state=x"} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			t.Fatalf("expected an error for selector '%s'", selector)
+		}
+	}
+}
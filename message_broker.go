@@ -84,9 +84,41 @@ var DirectoryQueryForm = forms.Form{
 				forms.IsStringList{},
 			},
 		},
+		{
+			Name: "service",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsString{},
+			},
+		},
+		{
+			Name: "properties",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsStringMap{},
+			},
+		},
+		{
+			Name: "selector",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+				IsValidLabelSelector{},
+			},
+		},
 	},
 }
 
+type IsValidLabelSelector struct{}
+
+func (f IsValidLabelSelector) Validate(value interface{}, values map[string]interface{}) (interface{}, error) {
+	// string validation happened before
+	if _, err := ParseLabelSelector(value.(string)); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
 func (b *BasicMessageBroker) handleInternalRequest(address *Address, request *Request) (*Response, error) {
 	switch address.Method {
 	case "_connectionRequest":
@@ -149,6 +149,14 @@ var PrivateSettingsForm = forms.Form{
 				forms.IsString{},
 			},
 		},
+		{
+			// used to pick the proxy settings of operators from the directory
+			Name: "environment",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+			},
+		},
 		{
 			Name: "internal_endpoint",
 			Validators: []forms.Validator{
@@ -192,6 +200,14 @@ var PublicSettingsForm = forms.Form{
 				forms.IsString{},
 			},
 		},
+		{
+			// used to pick the proxy settings of operators from the directory
+			Name: "environment",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+			},
+		},
 		net.TCPRateLimitsField,
 		{
 			Name: "tls_bind_address",
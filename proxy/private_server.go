@@ -532,7 +532,7 @@ type PrivateAnnounceConnectionParams struct {
 
 func (c *PrivateServer) announceConnection(context *jsonrpc.Context, params *PrivateAnnounceConnectionParams) *jsonrpc.Response {
 
-	settings := params.ClientInfo.Entry.SettingsFor("proxy", c.settings.Name)
+	settings := params.ClientInfo.Entry.SettingsFor("proxy", c.settings.Name, c.settings.Environment)
 
 	if params.Proxy == c.settings.Name {
 		return context.Error(400, "trying to announce with private proxy name", nil)
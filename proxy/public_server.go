@@ -193,7 +193,7 @@ func (c *PublicServer) announceConnections(context *jsonrpc.Context, params *Pub
 
 	results := []interface{}{}
 
-	settings := params.ClientInfo.Entry.SettingsFor("proxy", c.settings.Name)
+	settings := params.ClientInfo.Entry.SettingsFor("proxy", c.settings.Name, c.settings.Environment)
 
 	if settings == nil {
 		return context.Error(403, "not authorized", nil)
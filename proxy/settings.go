@@ -43,6 +43,7 @@ type DirectorySettings struct {
 type PublicServerSettings struct {
 	Datastore           *eps.DatastoreSettings         `json:"datastore"`
 	Name                string                         `json:"name"`
+	Environment         string                         `json:"environment"`
 	TLSBindAddress      string                         `json:"tls_bind_address"`
 	InternalBindAddress string                         `json:"internal_bind_address"`
 	InternalEndpoint    string                         `json:"internal_endpoint"`
@@ -81,6 +82,7 @@ type InternalEndpointSettings struct {
 type PrivateServerSettings struct {
 	Datastore        *eps.DatastoreSettings         `json:"datastore"`
 	Name             string                         `json:"name"`
+	Environment      string                         `json:"environment"`
 	Announcements    []*PrivateAnnouncement         `json:"announcements"`
 	InternalEndpoint *InternalEndpointSettings      `json:"internal_endpoint"`
 	JSONRPCClient    *jsonrpc.JSONRPCClientSettings `json:"jsonrpc_client"`
@@ -17,35 +17,77 @@
 package sd
 
 import (
+	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/iris-connect/eps"
 	"github.com/iris-connect/eps/helpers"
+	"sort"
 	"sync"
 	"time"
 )
 
 const (
 	SignedChangeRecordEntry uint8 = 1
+	SignedCheckpointEntry   uint8 = 2
+	SignedPinEntry          uint8 = 3
 )
 
+// we tolerate some clock skew between admins and service directories
+const maxRecordSkew = 5 * time.Minute
+
 type RecordDirectorySettings struct {
 	Datastore                      *eps.DatastoreSettings `json:"datastore"`
 	CACertificateFiles             []string               `json:"ca_certificate_files"`
 	CAIntermediateCertificateFiles []string               `json:"ca_intermediate_certificate_files"`
+	Checkpoints                    *CheckpointSettings    `json:"checkpoints"`
+	Quorum                         int                    `json:"quorum"`
+	PinnedRoot                     string                 `json:"pinned_root"`
+	PinCertificateFiles            []string               `json:"pin_certificate_files"`
+	MaxRecordAge                   int64                  `json:"max_record_age"`
+}
+
+type CheckpointSettings struct {
+	Interval int64                `json:"interval"`
+	Signing  *eps.SigningSettings `json:"signing"`
 }
 
 type RecordDirectory struct {
 	rootCerts         []*x509.Certificate
 	intermediateCerts []*x509.Certificate
+	pinCerts          []*x509.Certificate
 	dataStore         eps.Datastore
 	settings          *RecordDirectorySettings
 	entries           map[string]*eps.DirectoryEntry
 	recordsByHash     map[string]*eps.SignedChangeRecord
-	recordChildren    map[string][]*eps.SignedChangeRecord
-	orderedRecords    []*eps.SignedChangeRecord
-	mutex             sync.Mutex
+	// records whose parent we haven't seen yet, by parent hash
+	pendingRecords map[string][]*eps.SignedChangeRecord
+	// the number of ancestors of each record
+	depths map[string]int
+	// records whose signatures don't need to be checked (again)
+	verified map[string]bool
+	// whether a processed record is part of its chain
+	valid          map[string]bool
+	orderedRecords []*eps.SignedChangeRecord
+	// the position of each record of the canonical chain
+	positions   map[string]int
+	checkpoints map[string]*eps.SignedCheckpoint
+	checkpoint  *eps.SignedCheckpoint
+	chains      []*verifiedChain
+	// chains by the hash of their last record
+	chainsByLeaf map[string]*verifiedChain
+	canonical    *verifiedChain
+	pins         []*eps.SignedPin
+	pin          *eps.SignedPin
+	signingKey   *ecdsa.PrivateKey
+	signingCert  *x509.Certificate
+	entriesTree  *helpers.EntriesTree
+	entriesRoot  *eps.SignedEntriesRoot
+	changed      chan struct{}
+	mutex        sync.Mutex
+	// the IDs of the datastore entries we've already processed
+	processedEntries map[string]bool
 }
 
 func MakeRecordDirectory(settings *RecordDirectorySettings, definitions *eps.Definitions) (*RecordDirectory, error) {
@@ -78,62 +120,143 @@ func MakeRecordDirectory(settings *RecordDirectorySettings, definitions *eps.Def
 
 	}
 
+	pinCerts := make([]*x509.Certificate, 0)
+
+	for _, certificateFile := range settings.PinCertificateFiles {
+
+		cert, err := helpers.LoadCertificate(certificateFile, true)
+
+		if err != nil {
+			return nil, fmt.Errorf("error loading pin certificate: %w", err)
+		}
+
+		pinCerts = append(pinCerts, cert)
+
+	}
+
 	dataStore, err := helpers.InitializeDatastore(settings.Datastore, definitions)
 
 	if err != nil {
 		return nil, err
 	}
 
-	f := &RecordDirectory{
-		rootCerts:         rootCerts,
-		intermediateCerts: intermediateCerts,
-		orderedRecords:    make([]*eps.SignedChangeRecord, 0),
-		recordsByHash:     make(map[string]*eps.SignedChangeRecord),
-		recordChildren:    make(map[string][]*eps.SignedChangeRecord),
-		settings:          settings,
-		dataStore:         dataStore,
+	f := makeRecordDirectory(settings, dataStore, rootCerts, intermediateCerts)
+	f.pinCerts = pinCerts
+
+	if settings.Checkpoints != nil && settings.Checkpoints.Signing != nil {
+		// we create signed checkpoints ourselves
+		if f.signingCert, err = helpers.LoadCertificate(settings.Checkpoints.Signing.CertificateFile, true); err != nil {
+			return nil, fmt.Errorf("error loading checkpoint signing certificate: %w", err)
+		}
+		if f.signingKey, err = helpers.LoadPrivateKey(settings.Checkpoints.Signing.KeyFile); err != nil {
+			return nil, fmt.Errorf("error loading checkpoint signing key: %w", err)
+		}
+		if settings.Quorum > 1 {
+			eps.Log.Warningf("Checkpoints need to be signed by %d admins, so we cannot create them with a single key", settings.Quorum)
+		}
 	}
 
 	if err = f.dataStore.Init(); err != nil {
 		return nil, err
 	}
 
-	_, err = f.update()
+	err = f.update()
 
 	return f, err
 }
 
+func makeRecordDirectory(settings *RecordDirectorySettings, dataStore eps.Datastore, rootCerts, intermediateCerts []*x509.Certificate) *RecordDirectory {
+	return &RecordDirectory{
+		rootCerts:         rootCerts,
+		intermediateCerts: intermediateCerts,
+		orderedRecords:    make([]*eps.SignedChangeRecord, 0),
+		recordsByHash:     make(map[string]*eps.SignedChangeRecord),
+		pendingRecords:    make(map[string][]*eps.SignedChangeRecord),
+		depths:            make(map[string]int),
+		verified:          make(map[string]bool),
+		valid:             make(map[string]bool),
+		positions:         make(map[string]int),
+		checkpoints:       make(map[string]*eps.SignedCheckpoint),
+		chains:            make([]*verifiedChain, 0),
+		chainsByLeaf:      make(map[string]*verifiedChain),
+		pins:              make([]*eps.SignedPin, 0),
+		processedEntries:  make(map[string]bool),
+		entries:           make(map[string]*eps.DirectoryEntry),
+		changed:           make(chan struct{}),
+		settings:          settings,
+		dataStore:         dataStore,
+	}
+}
+
 func (f *RecordDirectory) Entry(name string) (*eps.DirectoryEntry, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	if entry, ok := f.entries[name]; !ok {
+	if entry, ok := f.entries[name]; !ok || entry.Deleted {
 		return nil, nil
 	} else {
-		return entry, nil
+		return helpers.EntryAt(entry, time.Now())
 	}
 }
 
 func (f *RecordDirectory) AllEntries() ([]*eps.DirectoryEntry, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	entries := make([]*eps.DirectoryEntry, len(f.entries))
-	i := 0
+	entries := make([]*eps.DirectoryEntry, 0, len(f.entries))
 	for _, entry := range f.entries {
-		entries[i] = entry
-		i++
+		// deleted entries only remain as tombstones
+		if !entry.Deleted {
+			entries = append(entries, entry)
+		}
 	}
-	return entries, nil
+	return helpers.EntriesAt(entries, time.Now()), nil
 }
 
-func (f *RecordDirectory) Entries(*eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
+// Returns all entries matching the given query, ordered by name
+func (f *RecordDirectory) Entries(query *eps.DirectoryQuery) ([]*eps.DirectoryEntry, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	return nil, nil
+	entries := make([]*eps.DirectoryEntry, 0, len(f.entries))
+	for _, entry := range f.entries {
+		entries = append(entries, entry)
+	}
+	// we apply scheduled records that are valid right now
+	entries = helpers.EntriesAt(entries, time.Now())
+	// we sort the entries by name so that results can be paginated
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	if query == nil {
+		query = &eps.DirectoryQuery{}
+	}
+	return eps.FilterDirectoryEntriesByQuery(entries, query), nil
 }
 
 // determines whether a subject can append to the service directory
-func (f *RecordDirectory) canAppend(record *eps.SignedChangeRecord, records []*eps.SignedChangeRecord) (bool, error) {
-	return helpers.VerifyRecord(record, records, f.rootCerts, f.intermediateCerts)
+func (f *RecordDirectory) canAppend(record *eps.SignedChangeRecord) (bool, error) {
+	if record.ParentHash == "" {
+		// this is a new root record, so we verify it against an empty directory
+		return helpers.VerifyRecordWithEntries(record, map[string]*eps.DirectoryEntry{}, f.rootCerts, f.intermediateCerts, f.settings.Quorum)
+	}
+	return helpers.VerifyRecordWithEntries(record, f.entries, f.rootCerts, f.intermediateCerts, f.settings.Quorum)
+}
+
+// Makes sure that new records were created recently (as records are verified
+// at their creation time) and not before their parent
+func (f *RecordDirectory) checkRecordTime(record *eps.SignedChangeRecord, parent *eps.SignedChangeRecord) error {
+
+	createdAt := record.Record.CreatedAt.Time
+
+	if createdAt.After(time.Now().Add(maxRecordSkew)) {
+		return fmt.Errorf("the record was created in the future (%v)", createdAt)
+	}
+
+	if f.settings.MaxRecordAge > 0 && time.Since(createdAt) > time.Duration(f.settings.MaxRecordAge)*time.Second {
+		return fmt.Errorf("the record is too old (created at %v), please create it again", createdAt)
+	}
+
+	if parent != nil && !helpers.VerifyRecordTime(record, parent.Record.CreatedAt.Time) {
+		return fmt.Errorf("the record was created before its parent")
+	}
+
+	return nil
 }
 
 // Appends a series of records
@@ -141,14 +264,13 @@ func (f *RecordDirectory) Append(records []*eps.SignedChangeRecord) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	if _, err := f.update(); err != nil {
+	// other instances might share our datastore
+	if err := f.update(); err != nil {
 		return err
 	}
 
 	for _, record := range records {
 
-		records := f.orderedRecords
-
 		if record.ParentHash != "" {
 
 			tip, err := f.tip()
@@ -162,58 +284,116 @@ func (f *RecordDirectory) Append(records []*eps.SignedChangeRecord) error {
 			}
 		}
 
-		if ok, err := f.canAppend(record, records); err != nil {
+		if err := f.checkRecordTime(record, f.recordsByHash[record.ParentHash]); err != nil {
+			return err
+		}
+
+		if ok, err := f.canAppend(record); err != nil {
 			return err
 		} else if !ok {
 			return fmt.Errorf("you cannot append")
 		}
 
-		id, err := helpers.RandomID(16)
-
-		if err != nil {
+		if err := f.write(record); err != nil {
 			return err
 		}
 
-		rawData, err := json.Marshal(record)
+		// we integrate the record right away instead of reading it back from
+		// the datastore. As we verified it against the entries at its parent
+		// already, we don't need to do that again.
+		f.verified[record.Hash] = true
+		err := f.process(f.addRecords([]*eps.SignedChangeRecord{record}), false)
+		delete(f.verified, record.Hash)
 
 		if err != nil {
 			return err
 		}
 
-		dataEntry := &eps.DataEntry{
-			Type: SignedChangeRecordEntry,
-			ID:   id,
-			Data: rawData,
+		if _, ok := f.positions[record.Hash]; !ok {
+			if record.ParentHash == "" && len(f.orderedRecords) > 0 {
+				return fmt.Errorf("new chain stored, it needs to be pinned to replace the current one")
+			}
+			return fmt.Errorf("new record not found")
 		}
+	}
+	return nil
+}
 
-		if err := f.dataStore.Write(dataEntry); err != nil {
-			return err
+// Imports records received from another service directory instance. We store
+// records even if they don't extend our chain, as the chain selection rules
+// might prefer them (e.g. if two instances accepted different records with
+// the same parent hash). Returns the number of new records.
+func (f *RecordDirectory) Import(records []*eps.SignedChangeRecord) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	imported := 0
+	seen := map[string]bool{}
+
+	for _, record := range records {
+
+		if _, ok := f.recordsByHash[record.Hash]; ok || seen[record.Hash] || f.isPending(record) {
+			continue
 		}
 
-		// we update the store
-		if newRecords, err := f.update(); err != nil {
-			return err
-		} else {
-			found := false
-			for _, newRecord := range newRecords {
-				if newRecord.Hash == record.Hash {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return fmt.Errorf("new record not found")
-			}
+		// records are fully verified when we integrate them, but we make
+		// sure we don't store records with invalid hashes
+		if ok, err := helpers.VerifyRecordHash(record); err != nil {
+			return imported, err
+		} else if !ok {
+			return imported, fmt.Errorf("invalid hash for record '%s'", record.Hash)
+		}
+
+		if err := f.write(record); err != nil {
+			return imported, err
 		}
+
+		seen[record.Hash] = true
+		imported++
 	}
-	return nil
+
+	if imported > 0 {
+		if err := f.update(); err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
+
+// Writes a record to the datastore
+func (f *RecordDirectory) write(record *eps.SignedChangeRecord) error {
+	return f.writeEntry(SignedChangeRecordEntry, record)
+}
+
+// Writes a JSON-encoded value of the given type to the datastore
+func (f *RecordDirectory) writeEntry(entryType uint8, value interface{}) error {
+
+	id, err := helpers.RandomID(16)
+
+	if err != nil {
+		return err
+	}
+
+	rawData, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	dataEntry := &eps.DataEntry{
+		Type: entryType,
+		ID:   id,
+		Data: rawData,
+	}
+
+	return f.dataStore.Write(dataEntry)
 }
 
 func (f *RecordDirectory) Update() error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	_, err := f.update()
-	return err
+	return f.update()
 }
 
 // Returns the latest record
@@ -234,30 +414,63 @@ func (f *RecordDirectory) tip() (*eps.SignedChangeRecord, error) {
 func (f *RecordDirectory) Records(after string) ([]*eps.SignedChangeRecord, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	relevantRecords := make([]*eps.SignedChangeRecord, 0)
-	found := false
 	if after == "" {
-		found = true
+		return f.orderedRecords, nil
 	}
-	for _, record := range f.orderedRecords {
-		if found {
-			relevantRecords = append(relevantRecords, record)
-		}
-		if record.Hash == after {
-			found = true
-		}
+	if position, ok := f.positions[after]; ok {
+		// records are only ever appended to the slice, so we can share it
+		return f.orderedRecords[position+1:], nil
 	}
-	if !found {
-		// we can't find the hash, so we return all records instead
-		// (as the client probably has an outdated version of the directory)
-		return f.orderedRecords, nil
+	// we can't find the hash, so we return all records instead
+	// (as the client probably has an outdated version of the directory)
+	return f.orderedRecords, nil
+}
+
+// Returns the number of records in our chain after the given hash. If we
+// don't know the hash, the second return value is false.
+func (f *RecordDirectory) RecordsAfter(hash string) (int, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if hash == "" {
+		return len(f.orderedRecords), true
 	}
-	return relevantRecords, nil
+	if position, ok := f.positions[hash]; ok {
+		return len(f.orderedRecords) - position - 1, true
+	}
+	return 0, false
 }
 
-// Integrates a record into the directory
-func (f *RecordDirectory) integrate(record *eps.SignedChangeRecord) error {
-	entry, ok := f.entries[record.Record.Name]
+// Waits until the tip differs from the given hash (or until the timeout
+// expires) and returns all records after the given hash
+func (f *RecordDirectory) WaitForRecords(after string, timeout time.Duration) ([]*eps.SignedChangeRecord, error) {
+	f.mutex.Lock()
+	tip, err := f.tip()
+	if err != nil {
+		f.mutex.Unlock()
+		return nil, err
+	}
+	changed := f.changed
+	f.mutex.Unlock()
+
+	if tip == nil || tip.Hash == after {
+		select {
+		case <-changed:
+		case <-time.After(timeout):
+		}
+	}
+
+	return f.Records(after)
+}
+
+// wakes up all clients waiting for new records
+func (f *RecordDirectory) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Integrates a record into the given entries, changing them in place
+func integrate(entries map[string]*eps.DirectoryEntry, record *eps.SignedChangeRecord) error {
+	entry, ok := entries[record.Record.Name]
 	if !ok {
 		entry = eps.MakeDirectoryEntry()
 		entry.Name = record.Record.Name
@@ -265,142 +478,505 @@ func (f *RecordDirectory) integrate(record *eps.SignedChangeRecord) error {
 	if err := helpers.IntegrateChangeRecord(record, entry); err != nil {
 		return err
 	}
-	f.entries[record.Record.Name] = entry
+	entries[record.Record.Name] = entry
 	return nil
 }
 
-// picks the best record from a series of alternatives (based on chain length)
-func (f *RecordDirectory) buildChains(records []*eps.SignedChangeRecord, visited map[string]bool) ([][]*eps.SignedChangeRecord, error) {
+// Returns the latest signed checkpoint of the current chain (if any)
+func (f *RecordDirectory) Checkpoint() (*eps.SignedCheckpoint, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.checkpoint, nil
+}
 
-	chains := make([][]*eps.SignedChangeRecord, 0)
+// Returns the entry with the given name together with a proof of its inclusion
+// in the signed entries root of the current tip. We build and sign the tree
+// for a given tip only when the first proof is requested.
+func (f *RecordDirectory) EntryWithProof(name string) (*eps.EntryProof, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 
-	for _, record := range records {
-		if _, ok := visited[record.Hash]; ok {
+	if f.signingKey == nil {
+		return nil, fmt.Errorf("entry proofs require checkpoint signing settings")
+	}
+
+	tip, err := f.tip()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tip == nil {
+		return nil, nil
+	}
+
+	if f.entriesTree == nil || f.entriesTree.Hash != tip.Hash {
+
+		entriesTree, err := helpers.MakeEntriesTree(tip, f.entries)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entriesRoot, err := helpers.SignEntriesRoot(entriesTree.Root(), f.signingKey, f.signingCert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		f.entriesTree = entriesTree
+		f.entriesRoot = entriesRoot
+	}
+
+	return f.entriesTree.Proof(name, f.entriesRoot), nil
+}
+
+// Returns the latest checkpoint for the given chain. We only use checkpoints
+// whose position matches the position of their record in the chain.
+func (f *RecordDirectory) checkpointFor(chain []*eps.SignedChangeRecord) *eps.SignedCheckpoint {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if checkpoint, ok := f.checkpoints[chain[i].Hash]; ok && checkpoint.Checkpoint.Length == int64(i+1) {
+			return checkpoint
+		}
+	}
+	return nil
+}
+
+// Creates a new signed checkpoint if enough records were added since the
+// last one (and if we have the necessary signing settings)
+func (f *RecordDirectory) createCheckpoint() error {
+
+	// a checkpoint signed by a single admin would bypass the quorum
+	if f.signingKey == nil || f.settings.Quorum > 1 || len(f.orderedRecords) == 0 {
+		return nil
+	}
+
+	var lastLength int64
+
+	if f.checkpoint != nil {
+		lastLength = f.checkpoint.Checkpoint.Length
+	}
+
+	if int64(len(f.orderedRecords))-lastLength < f.settings.Checkpoints.Interval {
+		return nil
+	}
+
+	tip, _ := f.tip()
+
+	signedCheckpoint, err := helpers.SignCheckpoint(helpers.MakeCheckpoint(f.orderedRecords[0], tip, len(f.orderedRecords), f.entries), f.signingKey, f.signingCert)
+
+	if err != nil {
+		return err
+	}
+
+	if err := f.writeEntry(SignedCheckpointEntry, signedCheckpoint); err != nil {
+		return err
+	}
+
+	f.checkpoints[tip.Hash] = signedCheckpoint
+	f.checkpoint = signedCheckpoint
+
+	eps.Log.Infof("Created checkpoint at record %d (%s)", len(f.orderedRecords), tip.Hash)
+
+	return nil
+}
+
+// Determines whether chain a is preferable to chain b. Chains with different
+// roots are ordered by the creation time of the root (the most recently
+// created chain wins), though we only adopt such a chain if it is endorsed
+// (see 'selectChain'). For chains with the same root, the first differing
+// record decides and the older one wins, as it was most likely accepted first.
+// Ties are broken by the record hash, so that all service directory instances
+// pick the same chain.
+func betterChain(a, b []*eps.SignedChangeRecord) bool {
+	if b == nil {
+		return true
+	}
+	if a[0].Hash != b[0].Hash {
+		ta, tb := a[0].Record.CreatedAt.Time, b[0].Record.CreatedAt.Time
+		if !ta.Equal(tb) {
+			return ta.After(tb)
+		}
+		return a[0].Hash < b[0].Hash
+	}
+	for i := 1; ; i++ {
+		if i >= len(a) {
+			return false
+		}
+		if i >= len(b) {
+			return true
+		}
+		if a[i].Hash == b[i].Hash {
 			continue
-		} else {
-			visited[record.Hash] = true
-		}
-		chain := make([]*eps.SignedChangeRecord, 1)
-		chain[0] = record
-		children, ok := f.recordChildren[record.Hash]
-		if ok {
-			childChains, err := f.buildChains(children, visited)
-			if err != nil {
-				return nil, err
+		}
+		ta, tb := a[i].Record.CreatedAt.Time, b[i].Record.CreatedAt.Time
+		if !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return a[i].Hash < b[i].Hash
+	}
+}
+
+func (f *RecordDirectory) update() error {
+
+	dataEntries, err := f.dataStore.Read()
+
+	if err != nil {
+		return err
+	}
+
+	changeRecords := make([]*eps.SignedChangeRecord, 0, len(dataEntries))
+	checkpoints := make([]*eps.SignedCheckpoint, 0)
+	newPins := false
+
+	for _, entry := range dataEntries {
+		// datastores usually only return new entries, but we make sure
+		// we don't process an entry twice
+		if len(entry.ID) > 0 {
+			if f.processedEntries[string(entry.ID)] {
+				continue
 			}
-			for _, childChain := range childChains {
-				fullChain := append(chain, childChain...)
-				chains = append(chains, fullChain)
+			f.processedEntries[string(entry.ID)] = true
+		}
+		switch entry.Type {
+		case SignedChangeRecordEntry:
+			record := &eps.SignedChangeRecord{}
+			if err := json.Unmarshal(entry.Data, &record); err != nil {
+				return fmt.Errorf("invalid record format!")
 			}
-		} else {
-			chains = append(chains, chain)
+			changeRecords = append(changeRecords, record)
+		case SignedCheckpointEntry:
+			checkpoint := &eps.SignedCheckpoint{}
+			if err := json.Unmarshal(entry.Data, &checkpoint); err != nil {
+				return fmt.Errorf("invalid checkpoint format!")
+			}
+			if existing, ok := f.checkpoints[checkpoint.Checkpoint.Hash]; ok && existing.Checkpoint.Length == checkpoint.Checkpoint.Length {
+				// e.g. a checkpoint we've created ourselves
+				continue
+			}
+			// checkpoints are verified once we know the records before them
+			checkpoints = append(checkpoints, checkpoint)
+		case SignedPinEntry:
+			// pins are verified when selecting the chain, as we need the
+			// entries of the chain that contains the pinned record
+			pin := &eps.SignedPin{}
+			if err := json.Unmarshal(entry.Data, &pin); err != nil || pin.Pin == nil {
+				return fmt.Errorf("invalid pin format!")
+			}
+			if !f.hasPin(pin) {
+				f.pins = append(f.pins, pin)
+				newPins = true
+			}
+		default:
+			return fmt.Errorf("unknown entry type found...")
 		}
 	}
 
-	return chains, nil
+	newRecords := f.addRecords(changeRecords)
+
+	// checkpoints usually follow the records they refer to, so we need to
+	// look at them before processing the new records
+	for _, checkpoint := range checkpoints {
+		f.trustCheckpoint(checkpoint)
+	}
 
+	return f.process(newRecords, newPins)
 }
 
-func (f *RecordDirectory) update() ([]*eps.SignedChangeRecord, error) {
-	if entries, err := f.dataStore.Read(); err != nil {
-		return nil, err
-	} else {
-		changeRecords := make([]*eps.SignedChangeRecord, 0, len(entries))
-		for _, entry := range entries {
-			switch entry.Type {
-			case SignedChangeRecordEntry:
-				record := &eps.SignedChangeRecord{}
-				if err := json.Unmarshal(entry.Data, &record); err != nil {
-					return nil, fmt.Errorf("invalid record format!")
-				}
-				changeRecords = append(changeRecords, record)
-			default:
-				return nil, fmt.Errorf("unknown entry type found...")
+// Adds records to our index and returns the new ones, ordered such that
+// parents come before their children. Records whose parent we don't know
+// yet are kept back until the parent arrives.
+func (f *RecordDirectory) addRecords(records []*eps.SignedChangeRecord) []*eps.SignedChangeRecord {
+
+	newRecords := make([]*eps.SignedChangeRecord, 0, len(records))
+
+	for _, record := range records {
+
+		if _, ok := f.recordsByHash[record.Hash]; ok {
+			continue
+		}
+
+		if record.ParentHash != "" {
+			if _, ok := f.recordsByHash[record.ParentHash]; !ok {
+				f.addPendingRecord(record)
+				continue
 			}
 		}
 
-		for _, record := range changeRecords {
+		queue := []*eps.SignedChangeRecord{record}
+
+		for len(queue) > 0 {
+			record, queue = queue[0], queue[1:]
 			f.recordsByHash[record.Hash] = record
+			if record.ParentHash == "" {
+				f.depths[record.Hash] = 0
+			} else {
+				f.depths[record.Hash] = f.depths[record.ParentHash] + 1
+			}
+			newRecords = append(newRecords, record)
+			queue = append(queue, f.pendingRecords[record.Hash]...)
+			delete(f.pendingRecords, record.Hash)
 		}
+	}
 
-		for _, record := range changeRecords {
-			var parentHash string
-			// if a parent exists we set the hash to it. Records without
-			// parent (root records) will be stored under the empty hash...
-			if parentRecord, ok := f.recordsByHash[record.ParentHash]; ok {
-				parentHash = parentRecord.Hash
-			}
-			children, ok := f.recordChildren[parentHash]
-			if !ok {
-				children = make([]*eps.SignedChangeRecord, 0)
-			}
-			children = append(children, record)
-			f.recordChildren[parentHash] = children
+	return newRecords
+}
+
+func (f *RecordDirectory) addPendingRecord(record *eps.SignedChangeRecord) {
+	if !f.isPending(record) {
+		f.pendingRecords[record.ParentHash] = append(f.pendingRecords[record.ParentHash], record)
+	}
+}
+
+func (f *RecordDirectory) isPending(record *eps.SignedChangeRecord) bool {
+	for _, pendingRecord := range f.pendingRecords[record.ParentHash] {
+		if pendingRecord.Hash == record.Hash {
+			return true
 		}
+	}
+	return false
+}
+
+// Verifies a checkpoint and marks the records it covers as verified, so that
+// we don't need to check their signatures (e.g. when starting up). We only use
+// checkpoints whose length matches the position of their record.
+func (f *RecordDirectory) trustCheckpoint(signedCheckpoint *eps.SignedCheckpoint) {
 
-		rootRecords, ok := f.recordChildren[""]
+	checkpoint := signedCheckpoint.Checkpoint
 
-		// no records present it seems
-		if !ok {
-			return nil, nil
+	if depth, ok := f.depths[checkpoint.Hash]; !ok || int64(depth+1) != checkpoint.Length {
+		return
+	}
+
+	// the signers are looked up in the chain up to the checkpoint, as the
+	// entries of the checkpoint might leave out their revocations
+	if ok, err := helpers.VerifyCheckpoint(signedCheckpoint, f.chainEntries(checkpoint.Hash), f.rootCerts, f.intermediateCerts, f.settings.Quorum); err != nil {
+		eps.Log.Errorf("Warning, error verifying checkpoint: %v", err)
+		return
+	} else if !ok {
+		eps.Log.Warningf("checkpoint is not signed by %d admin(s), ignoring it...", f.settings.Quorum)
+		return
+	}
+
+	f.checkpoints[checkpoint.Hash] = signedCheckpoint
+
+	for hash := checkpoint.Hash; hash != ""; hash = f.recordsByHash[hash].ParentHash {
+		// the ancestors of processed or verified records were dealt with
+		if _, processed := f.valid[hash]; processed || f.verified[hash] {
+			return
 		}
+		f.verified[hash] = true
+	}
+}
 
-		chains, err := f.buildChains(rootRecords, map[string]bool{})
+// Integrates the records of the chain that ends with the given record without
+// verifying them. As records are linked by their hashes, the result only
+// depends on the given hash. Records that cannot be integrated are skipped.
+func (f *RecordDirectory) chainEntries(hash string) map[string]*eps.DirectoryEntry {
 
-		eps.Log.Infof("Found %d chains, %d root records", len(chains), len(rootRecords))
+	path := make([]*eps.SignedChangeRecord, 0, f.depths[hash]+1)
 
-		if err != nil {
-			return nil, err
+	for ; hash != ""; hash = f.recordsByHash[hash].ParentHash {
+		path = append(path, f.recordsByHash[hash])
+	}
+
+	entries := make(map[string]*eps.DirectoryEntry)
+
+	for i := len(path) - 1; i >= 0; i-- {
+		if err := integrate(entries, path[i]); err != nil {
+			eps.Log.Errorf("Warning, error integrating record %s: %v", path[i].Hash, err)
 		}
+	}
 
-		verifiedChains := make([][]*eps.SignedChangeRecord, 0)
-		for i, chain := range chains {
-			validRecords := make([]*eps.SignedChangeRecord, 0)
-			for j, record := range chain {
-				eps.Log.Infof("Chain %d, record %d: %s", i, j, record.Hash)
-				// we verify the signature of the record
-				if ok, err := helpers.VerifyRecord(record, chain[:j], f.rootCerts, f.intermediateCerts); err != nil {
-					eps.Log.Errorf("Warning, error verifying record: %v", err)
-					continue
-				} else if !ok {
-					eps.Log.Warning("signature does not match, ignoring this chain...")
-					continue
-				} else {
-					validRecords = append(validRecords, record)
-				}
-			}
-			if len(validRecords) > 0 {
-				verifiedChains = append(verifiedChains, validRecords)
-			}
+	return entries
+}
+
+// Integrates new records into our chains and selects the canonical chain.
+// If all records extend the canonical chain (which is the usual case), we
+// can keep it without comparing it to the other chains again.
+func (f *RecordDirectory) process(records []*eps.SignedChangeRecord, newPins bool) error {
+
+	if len(records) == 0 && !newPins {
+		// nothing changed
+		return nil
+	}
+
+	extended := f.canonical != nil && !newPins
+
+	for _, record := range records {
+		if chain := f.processRecord(record); chain != f.canonical {
+			extended = false
 		}
+	}
+
+	if extended {
+		f.setCanonical(f.canonical)
+		return nil
+	}
 
-		eps.Log.Infof("%d verified chains", len(verifiedChains))
+	chains := make([]*verifiedChain, 0, len(f.chains))
 
-		// the most recently created chain always wins
-		var bestChain []*eps.SignedChangeRecord
-		var maxCreatedAt time.Time
-		for _, chain := range verifiedChains {
-			if bestChain == nil || (len(chain) > 0 && chain[0].Record.CreatedAt.Time.After(maxCreatedAt)) {
-				bestChain = chain
-				maxCreatedAt = chain[0].Record.CreatedAt.Time
-			}
+	for _, chain := range f.chains {
+		if len(chain.records) > 0 {
+			chains = append(chains, chain)
 		}
+	}
 
-		eps.Log.Infof("Best chain created at %v with length %d", maxCreatedAt, len(bestChain))
+	eps.Log.Infof("%d verified chains", len(chains))
 
-		if bestChain == nil {
-			return nil, nil
+	if len(chains) == 0 {
+		return nil
+	}
+
+	forksGauge.Set(float64(len(chains) - 1))
+
+	bestChain := f.selectChain(chains)
+
+	if bestChain == nil {
+		eps.Log.Warning("None of the chains is endorsed, keeping the current one...")
+		if f.canonical != nil {
+			f.setCanonical(f.canonical)
 		}
+		return nil
+	}
+
+	eps.Log.Infof("Best chain created at %v with length %d", bestChain.records[0].Record.CreatedAt.Time, len(bestChain.records))
 
-		// we store the ordered sequence of records
-		f.orderedRecords = bestChain
+	if oldTip, _ := f.tip(); oldTip != nil && !bestChain.contains(oldTip.Hash) {
+		eps.Log.Warningf("Switching from the chain with tip %s to the chain with tip %s", oldTip.Hash, bestChain.tip().Hash)
+		chainSwitches.Inc()
+	}
+
+	f.setCanonical(bestChain)
+
+	return nil
+}
 
-		// we regenerate the entries based on the new set of records
-		f.entries = make(map[string]*eps.DirectoryEntry)
-		for _, record := range bestChain {
-			f.integrate(record)
+// Verifies a new record (unless this was done before) and adds it to the
+// chain whose last record is its parent. Records that don't continue an
+// existing chain start a new one. Returns the chain.
+func (f *RecordDirectory) processRecord(record *eps.SignedChangeRecord) *verifiedChain {
+
+	chain, ok := f.chainsByLeaf[record.ParentHash]
+
+	if record.ParentHash == "" {
+		chain = &verifiedChain{
+			records: make([]*eps.SignedChangeRecord, 0),
+			entries: make(map[string]*eps.DirectoryEntry),
 		}
+		f.chains = append(f.chains, chain)
+	} else if ok {
+		delete(f.chainsByLeaf, record.ParentHash)
+	} else {
+		chain = f.branch(record.ParentHash)
+		f.chains = append(f.chains, chain)
+	}
+
+	f.chainsByLeaf[record.Hash] = chain
+	f.valid[record.Hash] = f.verifyRecord(record, chain.entries) && f.integrateRecord(chain, record)
+	delete(f.verified, record.Hash)
+
+	return chain
+}
+
+func (f *RecordDirectory) verifyRecord(record *eps.SignedChangeRecord, entries map[string]*eps.DirectoryEntry) bool {
+	if parent, ok := f.recordsByHash[record.ParentHash]; ok && !helpers.VerifyRecordTime(record, parent.Record.CreatedAt.Time) {
+		eps.Log.Warningf("record %s was created before its parent, ignoring it...", record.Hash)
+		return false
+	}
+	if f.verified[record.Hash] {
+		return true
+	}
+	if ok, err := helpers.VerifyRecordWithEntries(record, entries, f.rootCerts, f.intermediateCerts, f.settings.Quorum); err != nil {
+		eps.Log.Errorf("Warning, error verifying record %s: %v", record.Hash, err)
+		return false
+	} else if !ok {
+		eps.Log.Warningf("signature of record %s does not match, ignoring it...", record.Hash)
+		return false
+	}
+	return true
+}
+
+// Integrates a verified record into the chain. Entries are copied before
+// changing them, as they might still be in use elsewhere.
+func (f *RecordDirectory) integrateRecord(chain *verifiedChain, record *eps.SignedChangeRecord) bool {
+
+	name := record.Record.Name
+	entry, ok := chain.entries[name]
+
+	if ok {
+		entry = helpers.CopyEntry(entry)
+	} else {
+		entry = eps.MakeDirectoryEntry()
+		entry.Name = name
+	}
+
+	if err := helpers.IntegrateChangeRecord(record, entry); err != nil {
+		eps.Log.Errorf("Warning, error integrating record %s: %v", record.Hash, err)
+		return false
+	}
+
+	chain.entries[name] = entry
+	chain.records = append(chain.records, record)
+
+	return true
+}
+
+// Creates a new chain that ends with the given record by integrating the
+// valid records before it (without verifying them again)
+func (f *RecordDirectory) branch(hash string) *verifiedChain {
+
+	path := make([]*eps.SignedChangeRecord, 0, f.depths[hash]+1)
+
+	for ; hash != ""; hash = f.recordsByHash[hash].ParentHash {
+		path = append(path, f.recordsByHash[hash])
+	}
+
+	chain := &verifiedChain{
+		records: make([]*eps.SignedChangeRecord, 0, len(path)),
+		entries: make(map[string]*eps.DirectoryEntry),
+	}
+
+	// the entries belong to the new chain only, so we can change them
+	for i := len(path) - 1; i >= 0; i-- {
+		if !f.valid[path[i].Hash] {
+			continue
+		}
+		if err := integrate(chain.entries, path[i]); err != nil {
+			eps.Log.Errorf("Warning, error integrating record %s: %v", path[i].Hash, err)
+			continue
+		}
+		chain.records = append(chain.records, path[i])
+	}
+
+	return chain
+}
+
+// Makes the given chain the canonical one. The chain might be the current
+// canonical chain with new records.
+func (f *RecordDirectory) setCanonical(chain *verifiedChain) {
+
+	oldTip, _ := f.tip()
+
+	if chain != f.canonical {
+		f.positions = make(map[string]int, len(chain.records))
+		f.checkpoint = f.checkpointFor(chain.records)
+		f.orderedRecords = nil
+	}
+
+	for i := len(f.orderedRecords); i < len(chain.records); i++ {
+		f.positions[chain.records[i].Hash] = i
+	}
+
+	f.canonical = chain
+	f.orderedRecords = chain.records
+	f.entries = chain.entries
+
+	if newTip, _ := f.tip(); newTip != nil && (oldTip == nil || oldTip.Hash != newTip.Hash) {
+		f.notify()
+	}
 
-		return bestChain, nil
+	if err := f.createCheckpoint(); err != nil {
+		eps.Log.Errorf("Cannot create checkpoint: %v", err)
 	}
 }
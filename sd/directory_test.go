@@ -0,0 +1,383 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sd
+
+import (
+	"crypto/x509"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/helpers"
+	th "github.com/iris-connect/eps/testing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A datastore that returns all entries on every read
+type testDatastore struct {
+	entries []*eps.DataEntry
+	mutex   sync.Mutex
+}
+
+func (d *testDatastore) Init() error {
+	return nil
+}
+
+func (d *testDatastore) Write(entry *eps.DataEntry) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.entries = append(d.entries, entry)
+	return nil
+}
+
+func (d *testDatastore) Read() ([]*eps.DataEntry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]*eps.DataEntry{}, d.entries...), nil
+}
+
+type testCA struct {
+	root   *th.Signer
+	admins []*th.Signer
+	pinKey *th.Signer
+}
+
+func makeTestCA(t *testing.T) *testCA {
+
+	ca := &testCA{}
+	var err error
+
+	if ca.root, err = th.MakeCertificate(1, "root", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"sd-1", "sd-2", "sd-3"} {
+		admin, err := th.MakeCertificate(int64(i+2), name, []string{"sd-admin"}, ca.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ca.admins = append(ca.admins, admin)
+	}
+
+	// the pin key is not an admin
+	if ca.pinKey, err = th.MakeCertificate(5, "pin", nil, ca.root); err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+func makeTestDirectory(t *testing.T, ca *testCA, quorum int) *RecordDirectory {
+
+	directory := makeRecordDirectory(&RecordDirectorySettings{Quorum: quorum}, &testDatastore{}, []*x509.Certificate{ca.root.Certificate}, nil)
+
+	if err := directory.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	return directory
+}
+
+// Creates a record signed (and co-signed) by the given signers
+func makeTestRecord(t *testing.T, parentHash string, record *eps.ChangeRecord, signers ...*th.Signer) *eps.SignedChangeRecord {
+
+	signedRecord, err := th.SignRecord(signers[0], parentHash, record)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signer := range signers[1:] {
+		if err := helpers.CosignRecord(signedRecord, signer.Key, signer.Certificate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return signedRecord
+}
+
+// Creates a chain of records with the given length and signers
+func makeTestChain(t *testing.T, length int, createdAt time.Time, signers ...*th.Signer) []*eps.SignedChangeRecord {
+
+	records := make([]*eps.SignedChangeRecord, 0, length)
+	parentHash := ""
+
+	for i := 0; i < length; i++ {
+		record := makeTestRecord(t, parentHash, &eps.ChangeRecord{
+			Name:      "hd-1",
+			Section:   "groups",
+			Data:      []string{"health-departments"},
+			CreatedAt: eps.HashableTime{Time: createdAt.Add(time.Duration(i) * time.Second).UTC()},
+		}, signers...)
+		records = append(records, record)
+		parentHash = record.Hash
+	}
+
+	return records
+}
+
+func makeTestPin(t *testing.T, hash string, signers ...*th.Signer) *eps.SignedPin {
+
+	pin, err := helpers.SignPin(helpers.MakePin(hash), signers[0].Key, signers[0].Certificate)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signer := range signers[1:] {
+		if err := helpers.CosignPin(pin, signer.Key, signer.Certificate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return pin
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+
+	ca := makeTestCA(t)
+	directory := makeTestDirectory(t, ca, 1)
+	directory.pinCerts = []*x509.Certificate{ca.pinKey.Certificate}
+
+	records := makeTestChain(t, 4, time.Now().Add(-time.Hour), ca.admins[0])
+
+	if _, err := directory.Import(records[:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := directory.Pin(makeTestPin(t, records[0].Hash, ca.pinKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries we've already processed must not be processed again
+	for i := 0; i < 3; i++ {
+		if err := directory.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(directory.pins) != 1 {
+		t.Fatalf("expected a single pin, got %d", len(directory.pins))
+	}
+
+	if len(directory.orderedRecords) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(directory.orderedRecords))
+	}
+
+	// selecting the chain updates the forks gauge, which the fast path skips
+	forksGauge.Set(-1)
+
+	if _, err := directory.Import(records[3:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if tip, _ := directory.Tip(); tip == nil || tip.Hash != records[3].Hash {
+		t.Fatalf("expected the new record to become the tip")
+	}
+
+	if testutil.ToFloat64(forksGauge) != -1 {
+		t.Fatalf("expected the new record to extend the canonical chain without selecting a chain again")
+	}
+}
+
+func TestPinKey(t *testing.T) {
+
+	ca := makeTestCA(t)
+	directory := makeTestDirectory(t, ca, 1)
+
+	records := makeTestChain(t, 2, time.Now().Add(-2*time.Hour), ca.admins[0])
+	newRecords := makeTestChain(t, 2, time.Now().Add(-time.Hour), ca.admins[0])
+
+	if _, err := directory.Import(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new chain is more recent but not endorsed
+	if _, err := directory.Import(newRecords); err != nil {
+		t.Fatal(err)
+	}
+
+	if tip, _ := directory.Tip(); tip.Hash != records[1].Hash {
+		t.Fatalf("expected the directory to keep its chain")
+	}
+
+	// with a quorum of one, a single (possibly stolen) admin key must not
+	// be sufficient to switch to another chain
+	if err := directory.Pin(makeTestPin(t, newRecords[0].Hash, ca.admins[0])); err == nil {
+		t.Fatalf("expected the admin pin to be rejected")
+	}
+
+	directory.pinCerts = []*x509.Certificate{ca.pinKey.Certificate}
+
+	if err := directory.Pin(makeTestPin(t, newRecords[0].Hash, ca.admins[0])); err == nil {
+		t.Fatalf("expected the admin pin to be rejected")
+	}
+
+	if err := directory.Pin(makeTestPin(t, newRecords[0].Hash, ca.pinKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	if tip, _ := directory.Tip(); tip.Hash != newRecords[1].Hash {
+		t.Fatalf("expected the directory to adopt the pinned chain")
+	}
+}
+
+func TestPinOfRevokedAdmin(t *testing.T) {
+
+	ca := makeTestCA(t)
+	directory := makeTestDirectory(t, ca, 2)
+	stolen, other, attacker := ca.admins[0], ca.admins[1], ca.admins[2]
+
+	createdAt := time.Now().Add(-2 * time.Hour)
+	records := makeTestChain(t, 1, createdAt, stolen, other)
+
+	// the key of the first admin was stolen, so it gets revoked
+	records = append(records, makeTestRecord(t, records[0].Hash, &eps.ChangeRecord{
+		Name:    "sd-1",
+		Section: "revocations",
+		Data: []*eps.OperatorRevocation{{
+			Fingerprint: helpers.CertificateFingerprint(stolen.Certificate),
+			Reason:      "key stolen",
+		}},
+		CreatedAt: eps.HashableTime{Time: createdAt.Add(time.Second).UTC()},
+	}, other, attacker))
+
+	if _, err := directory.Import(records); err != nil {
+		t.Fatal(err)
+	}
+
+	if tip, _ := directory.Tip(); tip == nil || tip.Hash != records[1].Hash {
+		t.Fatalf("expected the revocation to be accepted")
+	}
+
+	// the attacker (who also controls another admin key) creates a new chain
+	// without the revocation and pins it
+	fakeRecords := makeTestChain(t, 1, time.Now().Add(-time.Hour), stolen, attacker)
+
+	if _, err := directory.Import(fakeRecords); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := directory.Pin(makeTestPin(t, fakeRecords[0].Hash, stolen, attacker)); err == nil {
+		t.Fatalf("expected the pin of a revoked admin to be rejected")
+	}
+
+	if tip, _ := directory.Tip(); tip.Hash != records[1].Hash {
+		t.Fatalf("expected the directory to keep its chain")
+	}
+
+	// admins of the current chain can still pin another chain
+	if err := directory.Pin(makeTestPin(t, fakeRecords[0].Hash, other, attacker)); err != nil {
+		t.Fatal(err)
+	}
+
+	if tip, _ := directory.Tip(); tip.Hash != fakeRecords[0].Hash {
+		t.Fatalf("expected the directory to adopt the pinned chain")
+	}
+}
+
+func TestCheckpointOfRevokedAdmin(t *testing.T) {
+
+	ca := makeTestCA(t)
+	directory := makeTestDirectory(t, ca, 1)
+	revoked, other := ca.admins[0], ca.admins[1]
+
+	createdAt := time.Now().Add(-time.Hour)
+	records := makeTestChain(t, 1, createdAt, revoked)
+
+	records = append(records, makeTestRecord(t, records[0].Hash, &eps.ChangeRecord{
+		Name:    "sd-1",
+		Section: "revocations",
+		Data: []*eps.OperatorRevocation{{
+			Fingerprint: helpers.CertificateFingerprint(revoked.Certificate),
+			Reason:      "key stolen",
+		}},
+		CreatedAt: eps.HashableTime{Time: createdAt.Add(time.Second).UTC()},
+	}, other))
+
+	if _, err := directory.Import(records); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCheckpoint := func(signer *th.Signer) {
+		// the entries of the checkpoint leave out the revocation
+		checkpoint, err := helpers.SignCheckpoint(helpers.MakeCheckpoint(records[0], records[1], 2, map[string]*eps.DirectoryEntry{}), signer.Key, signer.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := directory.writeEntry(SignedCheckpointEntry, checkpoint); err != nil {
+			t.Fatal(err)
+		}
+		if err := directory.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCheckpoint(revoked)
+
+	if _, ok := directory.checkpoints[records[1].Hash]; ok {
+		t.Fatalf("expected the checkpoint of the revoked admin to be rejected")
+	}
+
+	writeCheckpoint(other)
+
+	if _, ok := directory.checkpoints[records[1].Hash]; !ok {
+		t.Fatalf("expected the checkpoint to be accepted")
+	}
+}
+
+func TestAppendRecordTime(t *testing.T) {
+
+	ca := makeTestCA(t)
+	directory := makeTestDirectory(t, ca, 1)
+	directory.settings.MaxRecordAge = 3600
+
+	records := makeTestChain(t, 1, time.Now().Add(-time.Minute), ca.admins[0])
+
+	if err := directory.Append(records); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, createdAt := range []time.Time{
+		// created before the parent
+		time.Now().Add(-2 * time.Minute),
+		// too old
+		time.Now().Add(-2 * time.Hour),
+		// created in the future
+		time.Now().Add(time.Hour),
+	} {
+		record := makeTestRecord(t, records[0].Hash, &eps.ChangeRecord{
+			Name:      "hd-1",
+			Section:   "groups",
+			Data:      []string{"health-departments"},
+			CreatedAt: eps.HashableTime{Time: createdAt.UTC()},
+		}, ca.admins[0])
+		if err := directory.Append([]*eps.SignedChangeRecord{record}); err == nil {
+			t.Fatalf("expected a record created at %v to be rejected", createdAt)
+		}
+	}
+
+	record := makeTestRecord(t, records[0].Hash, &eps.ChangeRecord{
+		Name:    "hd-1",
+		Section: "groups",
+		Data:    []string{"health-departments"},
+	}, ca.admins[0])
+
+	if err := directory.Append([]*eps.SignedChangeRecord{record}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,305 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+The datastore of the service directory can contain several competing chains
+(forks), e.g. because two instances accepted different records with the same
+parent, or because someone created a new root record. Anyone holding an admin
+key can create a new chain, so we never switch to a chain with a different
+root automatically. Such a chain needs to be endorsed instead, either by the
+'pinned_root' setting or by a pin, i.e. a record hash signed by a quorum of
+admins of the chain we currently trust or with a separate pin key. Forks are
+reported in the logs and via Prometheus metrics.
+*/
+
+package sd
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sort"
+	"time"
+)
+
+// we tolerate some clock skew between admins and service directories
+const maxPinSkew = 5 * time.Minute
+
+var (
+	forksGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "eps_sd_forks",
+		Help: "Number of verified chains besides the canonical one",
+	})
+	refusedChainSwitches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eps_sd_refused_chain_switches_total",
+		Help: "Number of preferable chains that were not adopted because they are not endorsed",
+	})
+	chainSwitches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eps_sd_chain_switches_total",
+		Help: "Number of times the canonical chain was replaced by a chain that does not contain its tip",
+	})
+)
+
+// a chain of verified records together with the resulting entries. Invalid
+// records are skipped, so a chain can be empty.
+type verifiedChain struct {
+	records []*eps.SignedChangeRecord
+	entries map[string]*eps.DirectoryEntry
+}
+
+func (c *verifiedChain) tip() *eps.SignedChangeRecord {
+	return c.records[len(c.records)-1]
+}
+
+func (c *verifiedChain) contains(hash string) bool {
+	for _, record := range c.records {
+		if record.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines whether we may adopt the given chain. Without a pin, only
+// conflicts within the chain with the given root are resolved automatically.
+func (f *RecordDirectory) isEligible(chain *verifiedChain, root string) bool {
+	if f.settings.PinnedRoot != "" && chain.records[0].Hash != f.settings.PinnedRoot {
+		return false
+	}
+	if f.pin != nil {
+		return chain.contains(f.pin.Pin.Hash)
+	}
+	return chain.records[0].Hash == root
+}
+
+// Selects the best eligible chain (see 'betterChain') and reports forks that
+// would be preferable but are not endorsed. Returns nil if no chain is
+// eligible.
+func (f *RecordDirectory) selectChain(chains []*verifiedChain) *verifiedChain {
+
+	// when starting up we stay with the chain whose root was stored first,
+	// as chains are built in the order in which we received root records
+	root, trusted := chains[0].records[0].Hash, chains[0]
+
+	if f.canonical != nil && len(f.orderedRecords) > 0 {
+		root, trusted = f.orderedRecords[0].Hash, f.canonical
+	}
+
+	f.pin = f.latestPin(chains, trusted)
+
+	var best, preferred *verifiedChain
+
+	for _, chain := range chains {
+		if preferred == nil || betterChain(chain.records, preferred.records) {
+			preferred = chain
+		}
+		if !f.isEligible(chain, root) {
+			continue
+		}
+		if best == nil || betterChain(chain.records, best.records) {
+			best = chain
+		}
+	}
+
+	// forks that didn't change since the last pin were already dealt with
+	if preferred != best && (f.pin == nil || preferred.tip().Record.CreatedAt.After(f.pin.Pin.CreatedAt.Time)) {
+		eps.Log.Warningf("Fork detected: not adopting chain with root %s and tip %s, as it is not endorsed", preferred.records[0].Hash, preferred.tip().Hash)
+		refusedChainSwitches.Inc()
+	}
+
+	return best
+}
+
+// Returns the most recent pin that endorses one of the given chains. Pins
+// that are newer than the current one are verified in the order in which they
+// were created, each against the entries of the chain we trust at that point
+// (starting with the given one), so that a pin can't vouch for itself.
+func (f *RecordDirectory) latestPin(chains []*verifiedChain, trusted *verifiedChain) *eps.SignedPin {
+
+	pins := make([]*eps.SignedPin, len(f.pins))
+	copy(pins, f.pins)
+	sort.SliceStable(pins, func(i, j int) bool { return pins[i].Pin.CreatedAt.Before(pins[j].Pin.CreatedAt.Time) })
+
+	latest := f.pin
+
+	for _, pin := range pins {
+		if latest != nil && !pin.Pin.CreatedAt.After(latest.Pin.CreatedAt.Time) {
+			continue
+		}
+		if chain, err := f.verifyPin(pin, chains, trusted.entries); err != nil {
+			eps.Log.Errorf("Warning, error verifying pin of record %s: %v", pin.Pin.Hash, err)
+		} else if chain != nil {
+			latest, trusted = pin, chain
+		}
+	}
+
+	return latest
+}
+
+// Verifies the pin against the given trusted entries and returns the best of
+// the chains that contain the pinned record, or nil if the pin is not valid
+func (f *RecordDirectory) verifyPin(pin *eps.SignedPin, chains []*verifiedChain, entries map[string]*eps.DirectoryEntry) (*verifiedChain, error) {
+
+	if pin.Pin.CreatedAt.After(time.Now().Add(maxPinSkew)) {
+		return nil, nil
+	}
+
+	var endorsed *verifiedChain
+
+	for _, chain := range chains {
+		if chain.contains(pin.Pin.Hash) && (endorsed == nil || betterChain(chain.records, endorsed.records)) {
+			endorsed = chain
+		}
+	}
+
+	if endorsed == nil {
+		return nil, nil
+	}
+
+	if ok, err := helpers.VerifyPinEndorsement(pin, entries, f.pinCerts, f.rootCerts, f.intermediateCerts, f.settings.Quorum, f.settings.PinnedRoot != ""); err != nil || !ok {
+		return nil, err
+	}
+
+	return endorsed, nil
+}
+
+// Determines whether pins can be accepted at all (see 'helpers.VerifyPinEndorsement')
+func (f *RecordDirectory) acceptsPins() bool {
+	return len(f.pinCerts) > 0 || f.settings.Quorum > 1 || f.settings.PinnedRoot != ""
+}
+
+// Returns all verified chains
+func (f *RecordDirectory) Forks() ([]*eps.Fork, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	forks := make([]*eps.Fork, 0, len(f.chains))
+
+	for _, chain := range f.chains {
+		if len(chain.records) == 0 {
+			// chains without valid records are irrelevant
+			continue
+		}
+		forks = append(forks, &eps.Fork{
+			Root:      chain.records[0].Hash,
+			Tip:       chain.tip().Hash,
+			Length:    int64(len(chain.records)),
+			CreatedAt: chain.records[0].Record.CreatedAt,
+			Canonical: chain == f.canonical,
+			Pinned:    f.pin != nil && chain.contains(f.pin.Pin.Hash),
+		})
+	}
+
+	return forks, nil
+}
+
+// Returns all pins we know about
+func (f *RecordDirectory) Pins() ([]*eps.SignedPin, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.pins, nil
+}
+
+// Stores a new pin, which makes the chains containing the pinned record
+// canonical
+func (f *RecordDirectory) Pin(pin *eps.SignedPin) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if pin.Pin == nil {
+		return fmt.Errorf("incomplete pin")
+	}
+
+	if !f.acceptsPins() {
+		return fmt.Errorf("pins require a quorum of at least two admins, a pin certificate or a pinned root")
+	}
+
+	if err := f.update(); err != nil {
+		return err
+	}
+
+	if chain, err := f.verifyPin(pin, f.chains, f.entries); err != nil {
+		return err
+	} else if chain == nil {
+		return fmt.Errorf("invalid pin, it needs to be signed by %d admin(s) of the current chain or with a pin key and refer to a known record", f.settings.Quorum)
+	}
+
+	if f.pin != nil && !pin.Pin.CreatedAt.After(f.pin.Pin.CreatedAt.Time) {
+		return fmt.Errorf("a more recent pin exists")
+	}
+
+	if err := f.writeEntry(SignedPinEntry, pin); err != nil {
+		return err
+	}
+
+	if err := f.update(); err != nil {
+		return err
+	}
+
+	if _, ok := f.positions[pin.Pin.Hash]; ok {
+		return nil
+	}
+
+	return fmt.Errorf("pin was stored but the chain could not be adopted")
+}
+
+// Imports pins received from another service directory instance. Pins that
+// we already know or that are invalid for all of our chains are skipped.
+func (f *RecordDirectory) ImportPins(pins []*eps.SignedPin) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	imported := 0
+
+	for _, pin := range pins {
+
+		if pin.Pin == nil || f.hasPin(pin) {
+			continue
+		}
+
+		if chain, err := f.verifyPin(pin, f.chains, f.entries); err != nil {
+			eps.Log.Warningf("Cannot verify pin of record %s: %v", pin.Pin.Hash, err)
+			continue
+		} else if chain == nil {
+			continue
+		}
+
+		if err := f.writeEntry(SignedPinEntry, pin); err != nil {
+			return imported, err
+		}
+
+		imported++
+	}
+
+	if imported > 0 {
+		if err := f.update(); err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
+
+func (f *RecordDirectory) hasPin(pin *eps.SignedPin) bool {
+	for _, existingPin := range f.pins {
+		if existingPin.Pin.Hash == pin.Pin.Hash && existingPin.Pin.CreatedAt.Equal(pin.Pin.CreatedAt.Time) {
+			return true
+		}
+	}
+	return false
+}
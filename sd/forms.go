@@ -20,8 +20,35 @@ import (
 	epsForms "github.com/iris-connect/eps/forms"
 	"github.com/iris-connect/eps/jsonrpc"
 	"github.com/kiprotect/go-helpers/forms"
+	"regexp"
 )
 
+var CheckpointSettingsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			// number of records between two checkpoints
+			Name: "interval",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 1000},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+				},
+			},
+		},
+		{
+			// checkpoints need to be signed by a service directory admin
+			Name: "signing",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsStringMap{
+					Form: &epsForms.SigningSettingsForm,
+				},
+			},
+		},
+	},
+}
+
 var RecordDirectorySettingsForm = forms.Form{
 	Fields: []forms.Field{
 		{
@@ -62,6 +89,138 @@ var RecordDirectorySettingsForm = forms.Form{
 				},
 			},
 		},
+		{
+			Name: "checkpoints",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsStringMap{
+					Form: &CheckpointSettingsForm,
+				},
+			},
+		},
+		{
+			// number of different admins that need to sign records which rely
+			// on admin rights (see 'helpers.VerifyRecord')
+			Name: "quorum",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 1},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+				},
+			},
+		},
+		{
+			// maximum age (in seconds) of new records, as certificates are
+			// checked at the creation time chosen by the signer (0 disables
+			// the check, the default leaves some time to collect signatures)
+			Name: "max_record_age",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 604800},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    0,
+				},
+			},
+		},
+		{
+			// certificates of keys that may sign pins on their own, which
+			// should be kept apart from the admin keys
+			Name: "pin_certificate_files",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsString{},
+					},
+				},
+			},
+		},
+		{
+			// if set, only chains starting with this root record are adopted
+			Name: "pinned_root",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: ""},
+				forms.IsString{},
+				forms.MatchesRegex{
+					Regexp: regexp.MustCompile(`^([a-f0-9]{64}|)$`),
+				},
+			},
+		},
+	},
+}
+
+var PeerSettingsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "name",
+			Validators: []forms.Validator{
+				forms.IsString{},
+			},
+		},
+		{
+			Name: "jsonrpc_client",
+			Validators: []forms.Validator{
+				forms.IsStringMap{
+					Form: &jsonrpc.JSONRPCClientSettingsForm,
+				},
+			},
+		},
+	},
+}
+
+var ReplicationSettingsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			// time (in seconds) between two synchronizations with the peers
+			Name: "interval",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 5},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    1,
+				},
+			},
+		},
+		{
+			Name: "peers",
+			Validators: []forms.Validator{
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &PeerSettingsForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var RESTSettingsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			// prefix of the read-only HTTP endpoints
+			Name: "path",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: "/directory"},
+				forms.IsString{},
+				forms.MatchesRegex{
+					Regexp: regexp.MustCompile(`^(/[a-zA-Z0-9._-]+)+$`),
+				},
+			},
+		},
+		{
+			// time (in seconds) clients and caches may reuse responses
+			Name: "max_age",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 60},
+				forms.IsInteger{
+					HasMin: true,
+					Min:    0,
+				},
+			},
+		},
 	},
 }
 
@@ -83,5 +242,23 @@ var SettingsForm = forms.Form{
 				},
 			},
 		},
+		{
+			Name: "replication",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsStringMap{
+					Form: &ReplicationSettingsForm,
+				},
+			},
+		},
+		{
+			Name: "rest",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsStringMap{
+					Form: &RESTSettingsForm,
+				},
+			},
+		},
 	},
 }
@@ -0,0 +1,380 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+Several service directory instances can replicate each other's records. Every
+instance regularly pulls new records from its peers via 'getRecords' and
+imports them into its own datastore, followed by the peers' pins (see
+forks.go). Since all instances apply the same chain
+selection rules, they converge to the same chain even if two of them accepted
+conflicting records (i.e. records with the same parent hash).
+*/
+
+package sd
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/jsonrpc"
+	"github.com/kiprotect/go-helpers/forms"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+type ReplicationSettings struct {
+	Interval int64           `json:"interval"`
+	Peers    []*PeerSettings `json:"peers"`
+}
+
+type PeerSettings struct {
+	Name          string                         `json:"name"`
+	JSONRPCClient *jsonrpc.JSONRPCClientSettings `json:"jsonrpc_client"`
+}
+
+type PeerStatus struct {
+	Name string `json:"name"`
+	// the tip of the peer's chain
+	Tip string `json:"tip"`
+	// the number of records in our chain the peer does not have yet, -1 if
+	// unknown or if the chain of the peer diverges from ours
+	Lag int64 `json:"lag"`
+	// the number of records we imported from the peer
+	Imported  int64      `json:"imported"`
+	LastSync  *time.Time `json:"last_sync"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var (
+	replicationLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eps_sd_replication_lag_records",
+		Help: "Number of records a peer is behind this instance (-1 if unknown or if the chains diverge)",
+	}, []string{"peer"})
+	replicationLastSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eps_sd_replication_last_sync_timestamp_seconds",
+		Help: "Time of the last successful synchronization with a peer",
+	}, []string{"peer"})
+	replicationImported = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eps_sd_replication_imported_records_total",
+		Help: "Number of records imported from a peer",
+	}, []string{"peer"})
+	replicationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eps_sd_replication_errors_total",
+		Help: "Number of failed synchronizations with a peer",
+	}, []string{"peer"})
+)
+
+type Replicator struct {
+	settings  *ReplicationSettings
+	directory *RecordDirectory
+	peers     []*peer
+	stop      chan bool
+	mutex     sync.Mutex
+}
+
+type peer struct {
+	settings *PeerSettings
+	client   *jsonrpc.Client
+	status   *PeerStatus
+}
+
+func MakeReplicator(settings *ReplicationSettings, directory *RecordDirectory) *Replicator {
+	peers := make([]*peer, 0, len(settings.Peers))
+	for _, peerSettings := range settings.Peers {
+		peers = append(peers, &peer{
+			settings: peerSettings,
+			client:   jsonrpc.MakeClient(peerSettings.JSONRPCClient),
+			status: &PeerStatus{
+				Name: peerSettings.Name,
+				Lag:  -1,
+			},
+		})
+	}
+	return &Replicator{
+		settings:  settings,
+		directory: directory,
+		peers:     peers,
+	}
+}
+
+func (r *Replicator) Start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		return fmt.Errorf("replicator already running")
+	}
+
+	r.stop = make(chan bool)
+	go r.run(r.stop)
+	return nil
+}
+
+func (r *Replicator) Stop() error {
+	// we must not hold the lock while waiting, as the replication
+	// goroutine needs it to update the peer status
+	r.mutex.Lock()
+	stop := r.stop
+	r.stop = nil
+	r.mutex.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	stop <- true
+	<-stop
+	return nil
+}
+
+// Returns the replication status of all peers
+func (r *Replicator) Status() []*PeerStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	statuses := make([]*PeerStatus, 0, len(r.peers))
+	for _, peer := range r.peers {
+		status := *peer.status
+		statuses = append(statuses, &status)
+	}
+	return statuses
+}
+
+func (r *Replicator) run(stop chan bool) {
+	interval := time.Duration(r.settings.Interval) * time.Second
+	for {
+		for _, peer := range r.peers {
+			r.syncPeer(peer)
+		}
+		select {
+		case <-stop:
+			stop <- true
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (r *Replicator) syncPeer(peer *peer) {
+	status, err := r.sync(peer)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		eps.Log.Warningf("Cannot replicate records from peer '%s': %v", peer.settings.Name, err)
+		replicationErrors.WithLabelValues(peer.settings.Name).Inc()
+		peer.status.LastError = err.Error()
+		return
+	}
+
+	status.Imported += peer.status.Imported
+	peer.status = status
+
+	replicationLag.WithLabelValues(peer.settings.Name).Set(float64(status.Lag))
+	replicationLastSync.WithLabelValues(peer.settings.Name).Set(float64(status.LastSync.Unix()))
+}
+
+// Imports all records from the peer that come after our own tip and
+// determines how far the peer lags behind us
+func (r *Replicator) sync(peer *peer) (*PeerStatus, error) {
+
+	tip, err := r.directory.Tip()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tipHash := ""
+
+	if tip != nil {
+		tipHash = tip.Hash
+	}
+
+	// if the peer doesn't know our tip it returns its full chain
+	records, err := peer.getRecords(tipHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	imported, err := r.directory.Import(records)
+
+	if imported > 0 {
+		eps.Log.Infof("Imported %d records from peer '%s'", imported, peer.settings.Name)
+		replicationImported.WithLabelValues(peer.settings.Name).Add(float64(imported))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error importing records: %w", err)
+	}
+
+	// pins only refer to records we know, so we import them afterwards
+	if pins, err := peer.getPins(); err != nil {
+		// older peers don't support pins yet
+		eps.Log.Warningf("Cannot retrieve pins from peer '%s': %v", peer.settings.Name, err)
+	} else if importedPins, err := r.directory.ImportPins(pins); err != nil {
+		return nil, fmt.Errorf("error importing pins: %w", err)
+	} else if importedPins > 0 {
+		eps.Log.Infof("Imported %d pins from peer '%s'", importedPins, peer.settings.Name)
+	}
+
+	peerTip, err := peer.getTip()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	status := &PeerStatus{
+		Name:     peer.settings.Name,
+		Imported: int64(imported),
+		LastSync: &now,
+		Lag:      -1,
+	}
+
+	if peerTip != nil {
+		status.Tip = peerTip.Hash
+	}
+
+	if lag, ok := r.directory.RecordsAfter(status.Tip); ok {
+		status.Lag = int64(lag)
+	}
+
+	return status, nil
+}
+
+func (p *peer) call(method string, params map[string]interface{}) (interface{}, error) {
+	request := jsonrpc.MakeRequest(method, "", params)
+
+	if response, err := p.client.Call(request); err != nil {
+		return nil, fmt.Errorf("error calling '%s': %w", method, err)
+	} else if response.Error != nil {
+		return nil, fmt.Errorf("JSON-RPC error: %s", response.Error.Message)
+	} else {
+		return response.Result, nil
+	}
+}
+
+func (p *peer) getRecords(after string) ([]*eps.SignedChangeRecord, error) {
+
+	result, err := p.call("getRecords", map[string]interface{}{"after": after})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+
+	params, err := SubmitChangeRecordsForm.Validate(map[string]interface{}{"records": result})
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid records: %w", err)
+	}
+
+	recordsParams := &SubmitChangeRecordsParams{}
+
+	if err := SubmitChangeRecordsForm.Coerce(recordsParams, params); err != nil {
+		return nil, err
+	}
+
+	return recordsParams.Records, nil
+}
+
+var PinsForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "pins",
+			Validators: []forms.Validator{
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsStringMap{
+							Form: &epsForms.SignedPinForm,
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+type PinsParams struct {
+	Pins []*eps.SignedPin `json:"pins"`
+}
+
+func (p *peer) getPins() ([]*eps.SignedPin, error) {
+
+	result, err := p.call("getPins", map[string]interface{}{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+
+	params, err := PinsForm.Validate(map[string]interface{}{"pins": result})
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid pins: %w", err)
+	}
+
+	pinsParams := &PinsParams{}
+
+	if err := PinsForm.Coerce(pinsParams, params); err != nil {
+		return nil, err
+	}
+
+	return pinsParams.Pins, nil
+}
+
+func (p *peer) getTip() (*eps.SignedChangeRecord, error) {
+
+	result, err := p.call("getTip", map[string]interface{}{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+
+	mapResult, ok := result.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("expected a map as result for 'getTip' call")
+	}
+
+	params, err := epsForms.SignedChangeRecordForm.Validate(mapResult)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid tip: %w", err)
+	}
+
+	record := &eps.SignedChangeRecord{}
+
+	if err := epsForms.SignedChangeRecordForm.Coerce(record, params); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
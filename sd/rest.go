@@ -0,0 +1,240 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+The service directory offers read-only GET endpoints next to the JSON-RPC API,
+so that responses can be cached by browsers, CDNs and mirrors:
+
+	{path}/tip                     the latest record
+	{path}/records?after={hash}    all records after the given one
+	{path}/entries?group=...       entries (same parameters as 'getEntries')
+	{path}/entries/{name}          a single entry
+
+Requests are translated into calls of the corresponding JSON-RPC methods.
+Responses carry an ETag based on the tip hash, so clients can revalidate
+them cheaply using 'If-None-Match'.
+*/
+
+package sd
+
+import (
+	"fmt"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/iris-connect/eps/http"
+	"github.com/iris-connect/eps/jsonrpc"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RESTSettings struct {
+	Path   string `json:"path"`
+	MaxAge int64  `json:"max_age"`
+}
+
+// Extracts the parameters of a JSON-RPC method from an HTTP request
+type restParams func(c *http.Context) (map[string]interface{}, error)
+
+func noParams(c *http.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+func recordsParams(c *http.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{"after": c.Request.URL.Query().Get("after")}, nil
+}
+
+func entryParams(c *http.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{"name": c.RouteParams[0]}, nil
+}
+
+func entriesParams(c *http.Context) (map[string]interface{}, error) {
+
+	query := c.Request.URL.Query()
+	params := map[string]interface{}{}
+
+	for _, key := range []string{"group", "operator", "service", "selector"} {
+		if value := query.Get(key); value != "" {
+			params[key] = value
+		}
+	}
+
+	if channels := query.Get("channels"); channels != "" {
+		channelsList := make([]interface{}, 0)
+		for _, channel := range strings.Split(channels, ",") {
+			channelsList = append(channelsList, strings.TrimSpace(channel))
+		}
+		params["channels"] = channelsList
+	}
+
+	for _, key := range []string{"limit", "offset"} {
+		if value := query.Get(key); value != "" {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid '%s' parameter", key)
+			} else {
+				params[key] = n
+			}
+		}
+	}
+
+	return params, nil
+}
+
+// Returns the ETag and the maximum age for responses based on the current
+// state of the directory. As scheduled records can change entries without a
+// new record, entries responses also depend on the last schedule boundary.
+func (s *Server) cacheInfo(withEntries bool) (string, int64, error) {
+
+	tip, err := s.directory.Tip()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	var tipHash string
+
+	if tip != nil {
+		tipHash = tip.Hash
+	}
+
+	maxAge := s.settings.REST.MaxAge
+
+	if !withEntries {
+		return fmt.Sprintf(`"%s"`, tipHash), maxAge, nil
+	}
+
+	entries, err := s.directory.AllEntries()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now()
+	last, next := helpers.ScheduleBoundaries(entries, now)
+
+	// responses must not be reused after the next schedule boundary
+	if !next.IsZero() {
+		if untilNext := int64(next.Sub(now) / time.Second); untilNext < maxAge {
+			maxAge = untilNext
+		}
+	}
+
+	if last.IsZero() {
+		return fmt.Sprintf(`"%s"`, tipHash), maxAge, nil
+	}
+
+	return fmt.Sprintf(`"%s-%d"`, tipHash, last.Unix()), maxAge, nil
+}
+
+func matchesETag(header, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == etag || value == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func restError(c *http.Context, status int, message string) {
+	c.JSON(status, map[string]interface{}{"message": message})
+}
+
+// Returns an HTTP handler that answers GET requests using the given
+// JSON-RPC method
+func (s *Server) restHandler(method string, params restParams, withEntries bool) http.Handler {
+	return func(c *http.Context) {
+
+		if c.Request.Method != "GET" && c.Request.Method != "HEAD" {
+			c.Writer.Header().Set("Allow", "GET, HEAD")
+			restError(c, 405, "method not allowed")
+			return
+		}
+
+		// we determine the ETag before retrieving the data, so that we never
+		// label new data with an old ETag
+		etag, maxAge, err := s.cacheInfo(withEntries)
+
+		if err != nil {
+			eps.Log.Error(err)
+			restError(c, 500, "internal error")
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("ETag", etag)
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+
+		if matchesETag(c.Request.Header.Get("If-None-Match"), etag) {
+			c.AbortWithStatus(304)
+			return
+		}
+
+		requestParams, err := params(c)
+
+		if err != nil {
+			restError(c, 400, err.Error())
+			return
+		}
+
+		context := &jsonrpc.Context{
+			Request:     jsonrpc.MakeRequest(method, "", requestParams),
+			HTTPContext: c,
+		}
+
+		response := s.handler(context)
+
+		if response.Error == nil {
+			c.JSON(200, response.Result)
+			return
+		}
+
+		// errors must not be cached
+		header.Del("ETag")
+		header.Set("Cache-Control", "no-store")
+
+		switch response.Error.Code {
+		case 404:
+			restError(c, 404, "not found")
+		case -32602:
+			c.JSON(400, map[string]interface{}{"message": "invalid params", "data": response.Error.Data})
+		default:
+			restError(c, 500, "internal error")
+		}
+	}
+}
+
+func (s *Server) restRoutes() []*http.Route {
+
+	path := regexp.QuoteMeta(s.settings.REST.Path)
+
+	route := func(pattern, method string, params restParams, withEntries bool) *http.Route {
+		return &http.Route{
+			Pattern: fmt.Sprintf("^%s%s$", path, pattern),
+			Handlers: []http.Handler{
+				s.restHandler(method, params, withEntries),
+			},
+		}
+	}
+
+	return []*http.Route{
+		route("/tip", "getTip", noParams, false),
+		route("/records", "getRecords", recordsParams, false),
+		route("/entries", "getEntries", entriesParams, true),
+		route("/entries/([^/]+)", "getEntry", entryParams, true),
+	}
+}
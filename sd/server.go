@@ -23,18 +23,24 @@ proxy via a separate TCP channel.
 package sd
 
 import (
+	"crypto/x509"
 	"github.com/iris-connect/eps"
 	epsForms "github.com/iris-connect/eps/forms"
+	"github.com/iris-connect/eps/helpers"
+	"github.com/iris-connect/eps/http"
 	"github.com/iris-connect/eps/jsonrpc"
 	"github.com/kiprotect/go-helpers/forms"
 	"regexp"
 	"sync"
+	"time"
 )
 
 type Server struct {
 	settings      *Settings
 	jsonrpcServer *jsonrpc.JSONRPCServer
 	directory     *RecordDirectory
+	replicator    *Replicator
+	handler       jsonrpc.Handler
 	mutex         sync.Mutex
 }
 
@@ -60,6 +66,15 @@ type SubmitChangeRecordsParams struct {
 }
 
 func (c *Server) submitChangeRecords(context *jsonrpc.Context, params *SubmitChangeRecordsParams) *jsonrpc.Response {
+	for _, record := range params.Records {
+		if err := helpers.ValidateChangeRecordOp(record.Record); err != nil {
+			return context.InvalidParams(err)
+		}
+		// we reject invalid settings for known channel types right away
+		if err := helpers.ValidateRecordChannels(record.Record, c.settings.Definitions); err != nil {
+			return context.InvalidParams(err)
+		}
+	}
 	if err := c.directory.Append(params.Records); err != nil {
 		eps.Log.Error(err)
 		return context.InternalError()
@@ -84,18 +99,79 @@ func (c *Server) getTip(context *jsonrpc.Context, params *GetTipParams) *jsonrpc
 	}
 }
 
+var GetCheckpointForm = forms.Form{
+	Fields: []forms.Field{},
+}
+
+type GetCheckpointParams struct {
+}
+
+// Returns the latest signed checkpoint, from which clients can start
+// verifying records instead of replaying the whole chain
+func (c *Server) getCheckpoint(context *jsonrpc.Context, params *GetCheckpointParams) *jsonrpc.Response {
+	if checkpoint, err := c.directory.Checkpoint(); err != nil {
+		eps.Log.Error(err)
+		return context.InternalError()
+	} else {
+		return context.Result(checkpoint)
+	}
+}
+
 type GetEntriesParams struct {
+	Group      string                 `json:"group"`
+	Operator   string                 `json:"operator"`
+	Channels   []string               `json:"channels"`
+	Service    string                 `json:"service"`
+	Properties map[string]interface{} `json:"properties"`
+	Selector   string                 `json:"selector"`
+	Limit      int64                  `json:"limit"`
+	Offset     int64                  `json:"offset"`
 }
 
 var GetEntriesForm = forms.Form{
-	Fields: []forms.Field{},
+	// we copy the fields so that we don't modify the shared query form
+	Fields: append(append([]forms.Field{}, eps.DirectoryQueryForm.Fields...),
+		forms.Field{
+			// a limit of 0 means that all entries will be returned
+			Name: "limit",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 0},
+				forms.IsInteger{HasMin: true, Min: 0, HasMax: true, Max: 10000},
+			},
+		},
+		forms.Field{
+			Name: "offset",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 0},
+				forms.IsInteger{HasMin: true, Min: 0},
+			},
+		},
+	),
 }
 
+// Returns the directory entries matching the given query. Entries are ordered
+// by name and can be paginated using the 'offset' and 'limit' parameters.
 func (c *Server) getEntries(context *jsonrpc.Context, params *GetEntriesParams) *jsonrpc.Response {
-	if entries, err := c.directory.AllEntries(); err != nil {
+	query := &eps.DirectoryQuery{
+		Group:      params.Group,
+		Operator:   params.Operator,
+		Channels:   params.Channels,
+		Service:    params.Service,
+		Properties: params.Properties,
+		Selector:   params.Selector,
+	}
+	if entries, err := c.directory.Entries(query); err != nil {
 		eps.Log.Error(err)
 		return context.InternalError()
 	} else {
+		if params.Offset >= int64(len(entries)) {
+			entries = []*eps.DirectoryEntry{}
+		} else {
+			entries = entries[params.Offset:]
+		}
+		if params.Limit > 0 && params.Limit < int64(len(entries)) {
+			entries = entries[:params.Limit]
+		}
 		return context.Result(entries)
 	}
 }
@@ -126,6 +202,20 @@ func (c *Server) getEntry(context *jsonrpc.Context, params *GetEntryParams) *jso
 	}
 }
 
+// Returns an entry together with a proof of its inclusion in the signed
+// Merkle root over all entries, which clients can verify without retrieving
+// the records (see 'helpers.VerifyEntryProof')
+func (c *Server) getEntryWithProof(context *jsonrpc.Context, params *GetEntryParams) *jsonrpc.Response {
+	if proof, err := c.directory.EntryWithProof(params.Name); err != nil {
+		eps.Log.Error(err)
+		return context.InternalError()
+	} else if proof == nil {
+		return context.NotFound()
+	} else {
+		return context.Result(proof)
+	}
+}
+
 type GetRecordsParams struct {
 	After string `json:"after"`
 }
@@ -154,6 +244,113 @@ func (c *Server) getRecords(context *jsonrpc.Context, params *GetRecordsParams)
 	}
 }
 
+type WaitForRecordsParams struct {
+	After   string `json:"after"`
+	Timeout int64  `json:"timeout"`
+}
+
+var WaitForRecordsForm = forms.Form{
+	Fields: []forms.Field{
+		GetRecordsForm.Fields[0],
+		{
+			// maximum time (in seconds) to wait for new records
+			Name: "timeout",
+			Validators: []forms.Validator{
+				forms.IsOptional{Default: 30},
+				forms.IsInteger{HasMin: true, Min: 0, HasMax: true, Max: 300},
+			},
+		},
+	},
+}
+
+// Long-polling version of 'getRecords': If there are no records after the
+// given hash, the call blocks until new records arrive or the timeout expires.
+func (c *Server) waitForRecords(context *jsonrpc.Context, params *WaitForRecordsParams) *jsonrpc.Response {
+	if records, err := c.directory.WaitForRecords(params.After, time.Duration(params.Timeout)*time.Second); err != nil {
+		eps.Log.Error(err)
+		return context.InternalError()
+	} else {
+		return context.Result(records)
+	}
+}
+
+var GetReplicationStatusForm = forms.Form{
+	Fields: []forms.Field{},
+}
+
+type GetReplicationStatusParams struct {
+}
+
+// Returns the replication status of all peers (or null if replication is
+// disabled for this instance)
+func (c *Server) getReplicationStatus(context *jsonrpc.Context, params *GetReplicationStatusParams) *jsonrpc.Response {
+	if c.replicator == nil {
+		return context.Result(nil)
+	}
+	return context.Result(c.replicator.Status())
+}
+
+var GetForksForm = forms.Form{
+	Fields: []forms.Field{},
+}
+
+type GetForksParams struct {
+}
+
+// Returns all verified chains, so that admins can decide which one should
+// be canonical
+func (c *Server) getForks(context *jsonrpc.Context, params *GetForksParams) *jsonrpc.Response {
+	if forks, err := c.directory.Forks(); err != nil {
+		eps.Log.Error(err)
+		return context.InternalError()
+	} else {
+		return context.Result(forks)
+	}
+}
+
+var GetPinsForm = forms.Form{
+	Fields: []forms.Field{},
+}
+
+type GetPinsParams struct {
+}
+
+func (c *Server) getPins(context *jsonrpc.Context, params *GetPinsParams) *jsonrpc.Response {
+	if pins, err := c.directory.Pins(); err != nil {
+		eps.Log.Error(err)
+		return context.InternalError()
+	} else {
+		return context.Result(pins)
+	}
+}
+
+var SubmitPinForm = forms.Form{
+	Fields: []forms.Field{
+		{
+			Name: "pin",
+			Validators: []forms.Validator{
+				forms.IsStringMap{
+					Form: &epsForms.SignedPinForm,
+				},
+			},
+		},
+	},
+}
+
+type SubmitPinParams struct {
+	Pin *eps.SignedPin `json:"pin"`
+}
+
+// Pins a record, which makes the chain containing it canonical. The pin
+// needs to be signed by a quorum of admins.
+func (c *Server) submitPin(context *jsonrpc.Context, params *SubmitPinParams) *jsonrpc.Response {
+	if err := c.directory.Pin(params.Pin); err != nil {
+		return context.InvalidParams(err)
+	} else {
+		return context.Acknowledge()
+	}
+}
+
 func MakeServer(settings *Settings) (*Server, error) {
 	server := &Server{
 		settings: settings,
@@ -167,6 +364,10 @@ func MakeServer(settings *Settings) (*Server, error) {
 		return nil, err
 	}
 
+	if settings.Replication != nil {
+		server.replicator = MakeReplicator(settings.Replication, server.directory)
+	}
+
 	methods := map[string]*jsonrpc.Method{
 		"submitRecords": {
 			Form:    &SubmitChangeRecordsForm,
@@ -176,10 +377,18 @@ func MakeServer(settings *Settings) (*Server, error) {
 			Form:    &GetTipForm,
 			Handler: server.getTip,
 		},
+		"getCheckpoint": {
+			Form:    &GetCheckpointForm,
+			Handler: server.getCheckpoint,
+		},
 		"getRecords": {
 			Form:    &GetRecordsForm,
 			Handler: server.getRecords,
 		},
+		"waitForRecords": {
+			Form:    &WaitForRecordsForm,
+			Handler: server.waitForRecords,
+		},
 		"getEntries": {
 			Form:    &GetEntriesForm,
 			Handler: server.getEntries,
@@ -188,6 +397,26 @@ func MakeServer(settings *Settings) (*Server, error) {
 			Form:    &GetEntryForm,
 			Handler: server.getEntry,
 		},
+		"getEntryWithProof": {
+			Form:    &GetEntryForm,
+			Handler: server.getEntryWithProof,
+		},
+		"getReplicationStatus": {
+			Form:    &GetReplicationStatusForm,
+			Handler: server.getReplicationStatus,
+		},
+		"getForks": {
+			Form:    &GetForksForm,
+			Handler: server.getForks,
+		},
+		"getPins": {
+			Form:    &GetPinsForm,
+			Handler: server.getPins,
+		},
+		"submitPin": {
+			Form:    &SubmitPinForm,
+			Handler: server.submitPin,
+		},
 	}
 
 	handler, err := jsonrpc.MethodsHandler(methods)
@@ -196,21 +425,55 @@ func MakeServer(settings *Settings) (*Server, error) {
 		return nil, err
 	}
 
-	jsonrpcServer, err := jsonrpc.MakeJSONRPCServer(settings.JSONRPCServer, handler)
+	server.handler = handler
+
+	var routes []*http.Route
+
+	if settings.REST != nil {
+		// we serve read-only GET endpoints alongside the JSON-RPC route
+		routes = server.restRoutes()
+	}
+
+	jsonrpcServer, err := jsonrpc.MakeJSONRPCServerWithRoutes(settings.JSONRPCServer, handler, routes)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// we reject client certificates that were revoked in the directory
+	jsonrpcServer.SetCertificateCheck(server.checkCertificate)
+
 	server.jsonrpcServer = jsonrpcServer
 
 	return server, nil
 }
 
+func (s *Server) checkCertificate(cert *x509.Certificate) error {
+	return helpers.CheckRevocation(cert, func(name string) (*eps.DirectoryEntry, error) {
+		if entries, err := s.directory.Entries(&eps.DirectoryQuery{Operator: name}); err != nil {
+			return nil, err
+		} else if len(entries) == 0 {
+			return nil, eps.NoEntryFound
+		} else {
+			return entries[0], nil
+		}
+	})
+}
+
 func (s *Server) Start() error {
+	if s.replicator != nil {
+		if err := s.replicator.Start(); err != nil {
+			return err
+		}
+	}
 	return s.jsonrpcServer.Start()
 }
 
 func (s *Server) Stop() error {
+	if s.replicator != nil {
+		if err := s.replicator.Stop(); err != nil {
+			return err
+		}
+	}
 	return s.jsonrpcServer.Stop()
 }
@@ -26,4 +26,6 @@ type Settings struct {
 	Metrics       *eps.MetricsSettings           `json:"metrics"`
 	JSONRPCServer *jsonrpc.JSONRPCServerSettings `json:"jsonrpc_server`
 	Directory     *RecordDirectorySettings       `json:"directory"`
+	Replication   *ReplicationSettings           `json:"replication"`
+	REST          *RESTSettings                  `json:"rest"`
 }
@@ -37,6 +37,7 @@ type SigningSettings struct {
 	Name                           string   `json:"name"`
 	CACertificateFile              string   `json:"ca_certificate_file"`
 	CAIntermediateCertificateFiles []string `json:"ca_intermediate_certificate_files"`
+	CRLFiles                       []string `json:"crl_files"`
 	CertificateFile                string   `json:"certificate_file"`
 	KeyFile                        string   `json:"key_file"`
 }
@@ -52,6 +53,7 @@ type Settings struct {
 	Directory   *DirectorySettings `json:"directory"`
 	Metrics     *MetricsSettings   `json:"metrics"`
 	Name        string             `json:"name"`
+	Environment string             `json:"environment"`
 }
 
 type SettingsValidator func(settings map[string]interface{}) (interface{}, error)
@@ -0,0 +1,112 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/iris-connect/eps"
+	"github.com/iris-connect/eps/helpers"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// A key together with its certificate, for tests that need to sign records
+type Signer struct {
+	Key         *ecdsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// Creates a certificate with the given name and groups, signed by the given
+// parent. Without a parent, this creates a self-signed root certificate.
+func MakeCertificate(serial int64, name string, groups []string, parent *Signer) (*Signer, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	signerKey, signerCert := key, template
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+		template.DNSNames = []string{name}
+		template.URIs = []*url.URL{{Scheme: "iris-name", Host: name}}
+		for _, group := range groups {
+			template.URIs = append(template.URIs, &url.URL{Scheme: "iris-group", Host: group})
+		}
+		signerKey, signerCert = parent.Key, parent.Certificate
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{Key: key, Certificate: cert}, nil
+}
+
+// Creates a signed change record with the given parent
+func SignRecord(signer *Signer, parentHash string, record *eps.ChangeRecord) (*eps.SignedChangeRecord, error) {
+
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = eps.HashableTime{Time: time.Now().UTC()}
+	}
+
+	signedRecord := &eps.SignedChangeRecord{
+		ParentHash: parentHash,
+		Record:     record,
+	}
+
+	if err := helpers.CalculateRecordHash(signedRecord); err != nil {
+		return nil, err
+	}
+
+	signedData, err := helpers.Sign(signedRecord, signer.Key, signer.Certificate)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signedRecord.Signature = signedData.Signature
+
+	return signedRecord, nil
+}
@@ -19,6 +19,7 @@ package tls
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 )
@@ -26,6 +27,7 @@ import (
 func TLSConfig(settings *TLSSettings) (*tls.Config, error) {
 
 	certPool := x509.NewCertPool()
+	caCerts := []*x509.Certificate{}
 
 	for _, certificateFile := range settings.CACertificateFiles {
 
@@ -39,6 +41,16 @@ func TLSConfig(settings *TLSSettings) (*tls.Config, error) {
 			return nil, fmt.Errorf("cannot import CA certificate")
 		}
 
+		// we keep the parsed certificates to verify CRL signatures
+		for block, rest := pem.Decode(bs); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				caCerts = append(caCerts, cert)
+			}
+		}
+
 	}
 
 	certs := []tls.Certificate{}
@@ -68,6 +80,17 @@ func TLSConfig(settings *TLSSettings) (*tls.Config, error) {
 		InsecureSkipVerify:       settings.InsecureSkipVerify,
 	}
 
+	if len(settings.CRLFiles) > 0 {
+		revocationList, err := LoadRevocationList(settings.CRLFiles, caCerts)
+
+		if err != nil {
+			return nil, fmt.Errorf("error loading CRLs: %w", err)
+		}
+
+		// this is called for both client and server certificates
+		tlsConfig.VerifyPeerCertificate = revocationList.VerifyPeerCertificate
+	}
+
 	return tlsConfig, nil
 }
 
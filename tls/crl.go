@@ -0,0 +1,255 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tls
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/iris-connect/eps"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// we retry reloading expired CRLs at most this often
+const crlReloadInterval = time.Minute
+
+type revokedCertificate struct {
+	RevokedAt time.Time
+}
+
+type certificateRevocationList struct {
+	file string
+	// the name of the issuing CA
+	issuerName string
+	list       *pkix.CertificateList
+	// the CA certificate that signed the CRL, nil if the CRL was issued by
+	// an intermediate CA and still needs to be verified against it
+	issuer  *x509.Certificate
+	revoked map[string]*revokedCertificate
+}
+
+// Revoked certificates from a set of certificate revocation lists. CRLs are
+// reloaded from their files once one of them reaches its next update time.
+type RevocationList struct {
+	mutex      sync.Mutex
+	crlFiles   []string
+	caCerts    []*x509.Certificate
+	crls       []*certificateRevocationList
+	nextUpdate time.Time
+	lastReload time.Time
+	err        error
+}
+
+// Loads the given CRL files. Every CRL needs to be signed by one of the given
+// CA certificates or by an intermediate CA. As intermediate certificates are
+// usually presented by the peer, CRLs of intermediate CAs are verified
+// against the issuer of the checked certificate, otherwise we reject them.
+func LoadRevocationList(crlFiles []string, caCerts []*x509.Certificate) (*RevocationList, error) {
+
+	revocationList := &RevocationList{
+		crlFiles: crlFiles,
+		caCerts:  caCerts,
+	}
+
+	if err := revocationList.load(); err != nil {
+		return nil, err
+	}
+
+	return revocationList, nil
+}
+
+func (r *RevocationList) load() error {
+
+	crls := []*certificateRevocationList{}
+	var nextUpdate time.Time
+
+	for _, crlFile := range r.crlFiles {
+
+		bs, err := ioutil.ReadFile(crlFile)
+
+		if err != nil {
+			return err
+		}
+
+		list, err := x509.ParseCRL(bs)
+
+		if err != nil {
+			return fmt.Errorf("cannot parse CRL '%s': %w", crlFile, err)
+		}
+
+		if list.HasExpired(time.Now()) {
+			return fmt.Errorf("CRL '%s' has expired", crlFile)
+		}
+
+		var issuerName pkix.Name
+		issuerName.FillFromRDNSequence(&list.TBSCertList.Issuer)
+
+		crl := &certificateRevocationList{
+			file:       crlFile,
+			issuerName: issuerName.String(),
+			list:       list,
+			revoked:    make(map[string]*revokedCertificate),
+		}
+
+		for _, caCert := range r.caCerts {
+			if caCert.Subject.String() != crl.issuerName {
+				continue
+			}
+			if err := caCert.CheckCRLSignature(list); err != nil {
+				return fmt.Errorf("CRL '%s' is not signed by CA '%s'", crlFile, caCert.Subject.CommonName)
+			}
+			crl.issuer = caCert
+			break
+		}
+
+		for _, revokedCert := range list.TBSCertList.RevokedCertificates {
+			crl.revoked[revokedCert.SerialNumber.String()] = &revokedCertificate{
+				RevokedAt: revokedCert.RevocationTime,
+			}
+		}
+
+		if nextUpdate.IsZero() || list.TBSCertList.NextUpdate.Before(nextUpdate) {
+			nextUpdate = list.TBSCertList.NextUpdate
+		}
+
+		crls = append(crls, crl)
+	}
+
+	r.crls = crls
+	r.nextUpdate = nextUpdate
+
+	return nil
+}
+
+// Reloads the CRLs if one of them has reached its next update time. If they
+// cannot be reloaded, all certificates are rejected until they can.
+func (r *RevocationList) update() error {
+
+	now := time.Now()
+
+	if r.nextUpdate.IsZero() || now.Before(r.nextUpdate) {
+		return nil
+	}
+
+	if now.Sub(r.lastReload) < crlReloadInterval {
+		return r.err
+	}
+
+	r.lastReload = now
+
+	if err := r.load(); err != nil {
+		r.err = fmt.Errorf("error reloading CRLs: %w", err)
+		eps.Log.Error(r.err)
+		return r.err
+	}
+
+	r.err = nil
+
+	eps.Log.Info("Reloaded CRLs.")
+
+	return nil
+}
+
+// Returns an error if the given certificate has been revoked. If the CRL for
+// it was issued by an intermediate CA, it is verified against the issuer of
+// the certificate, which needs to be among the given intermediates.
+func (r *RevocationList) Check(cert *x509.Certificate, intermediateCerts []*x509.Certificate) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.update(); err != nil {
+		return err
+	}
+
+	for _, crl := range r.crls {
+
+		if crl.issuerName != cert.Issuer.String() {
+			continue
+		}
+
+		if crl.issuer == nil {
+			issuer := issuerOf(cert, intermediateCerts)
+			if issuer == nil {
+				return fmt.Errorf("cannot verify CRL '%s' as the issuer of certificate '%s' is unknown", crl.file, cert.Subject.CommonName)
+			}
+			if err := issuer.CheckCRLSignature(crl.list); err != nil {
+				return fmt.Errorf("CRL '%s' is not signed by the issuer of certificate '%s'", crl.file, cert.Subject.CommonName)
+			}
+		}
+
+		if revokedCert, ok := crl.revoked[cert.SerialNumber.String()]; ok {
+			eps.Log.Warningf("Rejecting certificate '%s' (serial %s), which was revoked at %v", cert.Subject.CommonName, serialHex(cert.SerialNumber), revokedCert.RevokedAt)
+			return fmt.Errorf("certificate '%s' (serial %s) was revoked at %v", cert.Subject.CommonName, serialHex(cert.SerialNumber), revokedCert.RevokedAt)
+		}
+	}
+	return nil
+}
+
+// Verifies that no certificate in the presented chain has been revoked. This
+// can be used as the VerifyPeerCertificate function in a TLS config.
+func (r *RevocationList) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+
+	// the verified chains contain the intermediate certificates whose CRLs
+	// we can trust (if the peer certificate was verified at all)
+	for _, chain := range verifiedChains {
+		for i, cert := range chain {
+			if err := r.Check(cert, chain[i+1:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(verifiedChains) > 0 {
+		return nil
+	}
+
+	certs := []*x509.Certificate{}
+
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return fmt.Errorf("cannot parse peer certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	for i, cert := range certs {
+		if err := r.Check(cert, certs[i+1:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the certificate that issued (i.e. signed) the given certificate
+func issuerOf(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func serialHex(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
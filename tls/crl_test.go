@@ -0,0 +1,184 @@
+// IRIS Endpoint-Server (EPS)
+// Copyright (C) 2021-2021 The IRIS Endpoint-Server Authors (see AUTHORS.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func makeTestCertificate(t *testing.T, serial int64, name string, isCA bool, parent *testCA) *testCA {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+
+	signerKey, signerCert := key, template
+
+	if parent != nil {
+		signerKey, signerCert = parent.key, parent.cert
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{key: key, cert: cert}
+}
+
+// Writes a CRL revoking the given serials to a file and returns its path
+func writeTestCRL(t *testing.T, path string, issuer *testCA, nextUpdate time.Time, serials ...int64) string {
+
+	revokedCerts := []pkix.RevokedCertificate{}
+
+	for _, serial := range serials {
+		revokedCerts = append(revokedCerts, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:          time.Now().Add(-time.Hour),
+		NextUpdate:          nextUpdate,
+		RevokedCertificates: revokedCerts,
+	}, issuer.cert, issuer.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, der, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestIntermediateCRL(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", true, nil)
+	intermediate := makeTestCertificate(t, 2, "intermediate", true, root)
+	revoked := makeTestCertificate(t, 3, "hd-1", false, intermediate)
+	valid := makeTestCertificate(t, 4, "hd-2", false, intermediate)
+
+	crlFile := writeTestCRL(t, filepath.Join(t.TempDir(), "intermediate.crl"), intermediate, time.Now().Add(time.Hour), 3)
+
+	revocationList, err := LoadRevocationList([]string{crlFile}, []*x509.Certificate{root.cert})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revocationList.VerifyPeerCertificate(nil, [][]*x509.Certificate{{revoked.cert, intermediate.cert, root.cert}}); err == nil {
+		t.Fatalf("expected the revoked certificate to be rejected")
+	}
+
+	if err := revocationList.VerifyPeerCertificate(nil, [][]*x509.Certificate{{valid.cert, intermediate.cert, root.cert}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a CRL that pretends to be issued by the intermediate CA
+	forged := makeTestCertificate(t, 2, "intermediate", true, root)
+	forgedFile := writeTestCRL(t, filepath.Join(t.TempDir(), "forged.crl"), forged, time.Now().Add(time.Hour))
+
+	revocationList, err = LoadRevocationList([]string{forgedFile}, []*x509.Certificate{root.cert})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revocationList.VerifyPeerCertificate(nil, [][]*x509.Certificate{{valid.cert, intermediate.cert, root.cert}}); err == nil {
+		t.Fatalf("expected a CRL that is not signed by the intermediate CA to be rejected")
+	}
+}
+
+func TestCRLReload(t *testing.T) {
+
+	root := makeTestCertificate(t, 1, "root", true, nil)
+	cert := makeTestCertificate(t, 2, "hd-1", false, root)
+
+	crlFile := writeTestCRL(t, filepath.Join(t.TempDir(), "root.crl"), root, time.Now().Add(time.Hour))
+
+	revocationList, err := LoadRevocationList([]string{crlFile}, []*x509.Certificate{root.cert})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revocationList.Check(cert.cert, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CRL is updated after it reached its next update time
+	writeTestCRL(t, crlFile, root, time.Now().Add(time.Hour), 2)
+	revocationList.nextUpdate = time.Now().Add(-time.Second)
+
+	if err := revocationList.Check(cert.cert, nil); err == nil {
+		t.Fatalf("expected the certificate to be revoked by the reloaded CRL")
+	}
+
+	// if the CRL expired and was not updated, we reject all certificates
+	writeTestCRL(t, crlFile, root, time.Now().Add(-time.Second))
+	revocationList.nextUpdate = time.Now().Add(-time.Second)
+	revocationList.lastReload = time.Time{}
+
+	other := makeTestCertificate(t, 3, "hd-2", false, root)
+
+	if err := revocationList.Check(other.cert, nil); err == nil {
+		t.Fatalf("expected certificates to be rejected with an expired CRL")
+	}
+}
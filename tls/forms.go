@@ -53,6 +53,18 @@ var TLSSettingsForm = forms.Form{
 				},
 			},
 		},
+		{
+			// certificate revocation lists, signed by one of the CAs
+			Name: "crl_files",
+			Validators: []forms.Validator{
+				forms.IsOptional{},
+				forms.IsList{
+					Validators: []forms.Validator{
+						forms.IsString{},
+					},
+				},
+			},
+		},
 		{
 			Name: "certificate_file",
 			Validators: []forms.Validator{
@@ -23,6 +23,7 @@ type TLSSettings struct {
 	CACertificateFiles []string `json:"ca_certificate_files"`
 	CertificateFile    string   `json:"certificate_file"`
 	KeyFile            string   `json:"key_file"`
+	CRLFiles           []string `json:"crl_files"`
 
 	// This switch only exists to accomodate the inability of certain
 	// certificate authorities to provide TLS certificates with